@@ -19,7 +19,10 @@ import (
 	"errors"
 	"flag"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -53,6 +56,11 @@ func main() {
 		panic(err.Error())
 	}
 	log.Level = logLevel
+	err = config.ValidateServiceConfig()
+	if err != nil {
+		log.Error("Invalid service configuration: ", err)
+		os.Exit(1)
+	}
 	if config.ChildMode {
 		hostagent.StartPlugin(log, config)
 		return
@@ -82,6 +90,18 @@ func main() {
 
 	agent := hostagent.NewHostAgent(config, env, log)
 	agent.Init()
+
+	// SIGHUP rewrites all the service files, e.g. after an upgrade
+	// changes their format
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP")
+			agent.ForceServiceRewrite()
+		}
+	}()
+
 	agent.Run(wait.NeverStop)
 	agent.RunStatus()
 }
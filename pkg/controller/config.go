@@ -136,6 +136,12 @@ type ControllerConfig struct {
 	// The number of IP addresses to allocate when a pod starts to run low
 	PodIpPoolChunkSize int `json:"pod-subnet-chunk-size,omitempty"`
 
+	// The number of IPv6 addresses to allocate when a pod starts to
+	// run low.  Defaults to pod-subnet-chunk-size, which is a very
+	// small slice of a typical IPv6 pool, so IPv6 deployments will
+	// usually want to set this to a larger value such as 256 (a /120)
+	PodIpPoolChunkSizeV6 int `json:"pod-subnet-chunk-size-v6,omitempty"`
+
 	// Pod subnet CIDRs in the form <gateway-address>/<prefix-length> that
 	// cover all pod-ip-pools
 	PodSubnets []string `json:"pod-subnets,omitempty"`
@@ -171,6 +177,15 @@ func newNetIps() *netIps {
 	}
 }
 
+// Get the number of addresses to allocate in each pod IP chunk for the
+// given address family.  The IPv6 size defaults to the IPv4 size.
+func (config *ControllerConfig) podIpPoolChunkSize(v4 bool) int64 {
+	if !v4 && config.PodIpPoolChunkSizeV6 != 0 {
+		return int64(config.PodIpPoolChunkSizeV6)
+	}
+	return int64(config.PodIpPoolChunkSize)
+}
+
 func NewConfig() *ControllerConfig {
 	t := true
 	return &ControllerConfig{
@@ -432,13 +432,17 @@ func (cont *AciController) allocateIpChunk(podnet *nodePodNetMeta, v4 bool) bool
 		podnetipam = ipam.NewFromRanges(podnet.podNetIps.V6)
 		ipa = cont.podNetworkIps.V6
 	}
+	chunkSize := cont.config.podIpPoolChunkSize(v4)
 	size := podnetipam.GetSize()
-	if int64(len(podnet.nodePods)) >
-		size-int64(cont.config.PodIpPoolChunkSize)/2 {
+	if int64(len(podnet.nodePods)) > size-chunkSize/2 {
 		// we have half a chunk left or less; allocate a new chunk
-		r, err := ipa.GetIpChunk(int64(cont.config.PodIpPoolChunkSize))
+		r, err := ipa.GetIpChunk(chunkSize)
 		if err != nil {
-			cont.log.Error("Could not allocate address chunk: ", err)
+			cont.log.WithFields(logrus.Fields{
+				"available": ipa.GetSize(),
+				"fragments": ipa.FragmentCount(),
+				"largest":   ipa.LargestContiguous().String(),
+			}).Error("Could not allocate address chunk: ", err)
 		} else {
 			podnetipam.AddRanges(r)
 			if v4 {
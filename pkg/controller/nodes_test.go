@@ -220,6 +220,33 @@ func TestPodNetV6Annotation(t *testing.T) {
 	cont.stop()
 }
 
+func TestPodNetV6ChunkSize(t *testing.T) {
+	cont := testController()
+	cont.config.PodIpPoolChunkSize = 2
+	cont.config.PodIpPoolChunkSizeV6 = 4
+	cont.config.PodIpPool = []ipam.IpRange{
+		{Start: net.ParseIP("10.1.1.2"), End: net.ParseIP("10.1.1.13")},
+		{Start: net.ParseIP("1:1:1:1::2"), End: net.ParseIP("1:1:1:1::12")},
+	}
+	cont.AciController.initIpam()
+	cont.run()
+
+	{
+		cont.nodeUpdates = nil
+		cont.fakeNodeSource.Add(node("node1"))
+		waitForPodNetAnnot(t, cont, &metadata.NetIps{
+			V4: []ipam.IpRange{
+				{Start: net.ParseIP("10.1.1.2"), End: net.ParseIP("10.1.1.3")},
+			},
+			V6: []ipam.IpRange{
+				{Start: net.ParseIP("1:1:1:1::2"), End: net.ParseIP("1:1:1:1::5")},
+			},
+		}, "per-family")
+	}
+
+	cont.stop()
+}
+
 func TestPodNetAnnotation(t *testing.T) {
 	cont := testController()
 	cont.config.PodIpPoolChunkSize = 2
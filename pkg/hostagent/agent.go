@@ -15,6 +15,7 @@
 package hostagent
 
 import (
+	"net"
 	"sync"
 	"time"
 
@@ -42,6 +43,8 @@ type HostAgent struct {
 	opflexServices map[string]*opflexService
 	epMetadata     map[string]map[string]*md.ContainerMetadata
 	serviceEp      md.ServiceEndpoint
+	nodeIpV4       net.IP
+	nodeIpV6       net.IP
 
 	podInformer       cache.SharedIndexInformer
 	endpointsInformer cache.SharedIndexInformer
@@ -62,6 +65,53 @@ type HostAgent struct {
 	syncQueue           workqueue.RateLimitingInterface
 	syncProcessors      map[string]func() bool
 
+	// serializes service directory syncs so that a sync pass never
+	// overlaps another; the index lock is held only to take a snapshot
+	serviceSyncMutex sync.Mutex
+
+	// when each removed opflex service was first seen missing, for
+	// services whose files are kept for the removal grace period;
+	// guarded by serviceSyncMutex
+	pendingServiceRemovals map[string]time.Time
+
+	// number of service files in each service directory, counted by
+	// the last full sync and updated by later syncs; guarded by
+	// serviceSyncMutex
+	serviceFileCounts map[string]int
+
+	// filesystem holding the OpFlex service directory; replaced in
+	// tests
+	fs fileSystem
+
+	serviceSyncTime     time.Time
+	serviceSyncErr      error
+	forceServiceRewrite bool
+
+	// opflex service UUIDs changed since the last service sync, and
+	// whether the next sync must rescan the whole service directory
+	dirtyServicesMutex sync.Mutex
+	dirtyServices      map[string]bool
+	dirtyServicesAll   bool
+
+	// called with the UUID and namespace/name of an opflex service
+	// whose mapping was withdrawn, and the withdrawals not yet reported
+	serviceInvalidHook func(uuid, name string)
+	invalidServices    []invalidService
+
+	// loggers for services with a more verbose log level annotation,
+	// by level, and the writer they share
+	serviceLoggersMutex sync.Mutex
+	serviceLoggers      map[logrus.Level]*logrus.Logger
+	serviceLogOut       *lockedWriter
+
+	// number of updates that changed the opflex services for each
+	// Kubernetes service, keyed by namespace/name
+	serviceChanges map[string]uint64
+
+	// number of LoadBalancer ingress IPs last mapped for each
+	// Kubernetes service, keyed by UID
+	serviceIngressCounts map[string]int
+
 	ignoreOvsPorts map[string][]string
 
 	netNsFuncChan chan func()
@@ -74,12 +124,20 @@ func NewHostAgent(config *HostAgentConfig, env Environment, log *logrus.Logger)
 		env:            env,
 		opflexEps:      make(map[string][]*opflexEndpoint),
 		opflexServices: make(map[string]*opflexService),
+		serviceChanges: make(map[string]uint64),
+		dirtyServices:  make(map[string]bool),
 		epMetadata:     make(map[string]map[string]*md.ContainerMetadata),
+		fs:             osFileSystem{},
+
+		// the first service sync must reconcile the whole directory
+		dirtyServicesAll: true,
 
 		podIps: ipam.NewIpCache(),
 
 		ignoreOvsPorts: make(map[string][]string),
 
+		serviceIngressCounts: make(map[string]int),
+
 		netNsFuncChan: make(chan func()),
 		syncQueue: workqueue.NewNamedRateLimitingQueue(
 			&workqueue.BucketRateLimiter{
@@ -102,6 +160,11 @@ func (agent *HostAgent) Init() {
 	agent.log.Info("Loaded cached endpoint CNI metadata: ", len(agent.epMetadata))
 	agent.buildUsedIPs()
 
+	agent.indexMutex.Lock()
+	agent.serviceEp = agent.config.configuredServiceEp()
+	agent.updateNodeIps()
+	agent.indexMutex.Unlock()
+
 	err = agent.env.Init(agent)
 	if err != nil {
 		panic(err.Error())
@@ -116,10 +179,60 @@ func (agent *HostAgent) scheduleSyncEps() {
 	agent.ScheduleSync("eps")
 }
 
+// Schedule a full service sync, which rescans the service directory
 func (agent *HostAgent) scheduleSyncServices() {
+	agent.markAllServicesDirty()
 	agent.ScheduleSync("services")
 }
 
+// Schedule a service sync that only writes the services marked dirty
+func (agent *HostAgent) scheduleSyncDirtyServices() {
+	agent.ScheduleSync("services")
+}
+
+// Mark an opflex service as changed so that the next service sync
+// writes or removes its file
+func (agent *HostAgent) markServiceDirty(uuid string) {
+	agent.dirtyServicesMutex.Lock()
+	agent.dirtyServices[uuid] = true
+	agent.dirtyServicesMutex.Unlock()
+}
+
+func (agent *HostAgent) markAllServicesDirty() {
+	agent.dirtyServicesMutex.Lock()
+	agent.dirtyServicesAll = true
+	agent.dirtyServicesMutex.Unlock()
+}
+
+// Get and clear the set of dirty services
+func (agent *HostAgent) takeDirtyServices() (map[string]bool, bool) {
+	agent.dirtyServicesMutex.Lock()
+	defer agent.dirtyServicesMutex.Unlock()
+	dirty, all := agent.dirtyServices, agent.dirtyServicesAll
+	agent.dirtyServices = make(map[string]bool)
+	agent.dirtyServicesAll = false
+	return dirty, all
+}
+
+// Rewrite every service file from the current in-memory state on the
+// next service sync, even if the file appears up to date
+func (agent *HostAgent) ForceServiceRewrite() {
+	agent.indexMutex.Lock()
+	agent.forceServiceRewrite = true
+	agent.indexMutex.Unlock()
+	agent.scheduleSyncServices()
+}
+
+// Set a function called when an opflex service mapping is withdrawn
+// because the service no longer has a valid mapping, for example when
+// it has lost all its endpoints.  The hook is called without holding
+// any agent locks.
+func (agent *HostAgent) SetServiceInvalidHook(hook func(uuid, name string)) {
+	agent.indexMutex.Lock()
+	agent.serviceInvalidHook = hook
+	agent.indexMutex.Unlock()
+}
+
 func (agent *HostAgent) runTickers(stopCh <-chan struct{}) {
 	ticker := time.NewTicker(time.Second * 30)
 	defer ticker.Stop()
@@ -134,6 +247,21 @@ func (agent *HostAgent) runTickers(stopCh <-chan struct{}) {
 	}
 }
 
+func (agent *HostAgent) runServiceResync(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Second *
+		time.Duration(agent.config.OpFlexServiceResyncInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			agent.resyncServices()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
 func (agent *HostAgent) processSyncQueue(queue workqueue.RateLimitingInterface,
 	queueStop <-chan struct{}) {
 
@@ -180,20 +308,30 @@ func (agent *HostAgent) EnableSync() (changed bool) {
 	return
 }
 
+// Check whether the OpFlex endpoint and service directories are set,
+// without which endpoints and services are never synced
+func (agent *HostAgent) syncConfigured() bool {
+	return agent.config.OpFlexEndpointDir != "" &&
+		(agent.config.OpFlexServiceDir != "" ||
+			len(agent.config.OpFlexServiceDirs) > 0)
+}
+
 func (agent *HostAgent) Run(stopCh <-chan struct{}) {
 	syncEnabled, err := agent.env.PrepareRun(stopCh)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	if agent.config.OpFlexEndpointDir == "" ||
-		agent.config.OpFlexServiceDir == "" {
+	if !agent.syncConfigured() {
 		agent.log.Warn("OpFlex endpoint and service directories not set")
 	} else {
 		if syncEnabled {
 			agent.EnableSync()
 		}
 		go agent.processSyncQueue(agent.syncQueue, stopCh)
+		if agent.config.OpFlexServiceResyncInterval > 0 {
+			go agent.runServiceResync(stopCh)
+		}
 	}
 
 	agent.log.Info("Starting endpoint RPC")
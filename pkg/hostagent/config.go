@@ -15,8 +15,11 @@
 package hostagent
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"net"
+	"strings"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/noironetworks/aci-containers/pkg/metadata"
@@ -105,6 +108,57 @@ type HostAgentConfig struct {
 	// Directory for writing OpFlex service metadata
 	OpFlexServiceDir string `json:"opflex-service-dir,omitempty"`
 
+	// Directories to spread the OpFlex service metadata across, for
+	// example one per agent instance on the node.  Each service is
+	// written to one of them chosen by a hash of its UUID.  Replaces
+	// OpFlexServiceDir when set.
+	OpFlexServiceDirs []string `json:"opflex-service-dirs,omitempty"`
+
+	// Permissions for the OpFlex service directory if it must be
+	// created.  Octal string
+	OpFlexServiceDirPerms string `json:"opflex-service-dir-perms,omitempty"`
+
+	// Number of times to retry a failed operation on the OpFlex
+	// service directory
+	OpFlexServiceDirRetries int `json:"opflex-service-dir-retries,omitempty"`
+
+	// Initial delay in milliseconds between retries of OpFlex service
+	// directory operations; doubled after each attempt
+	OpFlexServiceDirRetryDelay int `json:"opflex-service-dir-retry-delay,omitempty"`
+
+	// Maximum number of service files in the OpFlex service
+	// directory, or 0 for no limit.  New services are not written once
+	// the limit is reached.
+	OpFlexServiceMaxFiles int `json:"opflex-service-max-files,omitempty"`
+
+	// Number of service files written or removed concurrently
+	// during a service sync.  0 or 1 does all the file IO serially.
+	OpFlexServiceSyncWorkers int `json:"opflex-service-sync-workers,omitempty"`
+
+	// Time in seconds to keep the file for a removed service before
+	// deleting it, or 0 to delete it immediately.  A service that
+	// returns within this period keeps its file.
+	ServiceRemovalGracePeriod int `json:"service-removal-grace-period,omitempty"`
+
+	// Time in seconds to keep a withdrawn tombstone in place of the
+	// file of a removed service, after any grace period, before
+	// deleting it.  0 deletes the file without writing a tombstone.
+	ServiceTombstoneTime int `json:"service-tombstone-time,omitempty"`
+
+	// Omit fields from service files when they have the value opflex
+	// uses by default, such as the loadbalancer service mode, to make
+	// the files smaller.  Only for opflex agents that apply the same
+	// defaults.
+	CompactServiceFiles bool `json:"compact-service-files,omitempty"`
+
+	// Flush service files and the service directory to disk after
+	// each write
+	Fsync bool `json:"fsync,omitempty"`
+
+	// Interval in seconds between full resyncs of the OpFlex services
+	// from the Kubernetes caches, or 0 to disable
+	OpFlexServiceResyncInterval int `json:"opflex-service-resync-interval,omitempty"`
+
 	// OpFlex agent's flow-ID cache directory
 	OpFlexFlowIdCacheDir string `json:"opflex-flowid-cache-dir,omitempty"`
 
@@ -130,6 +184,50 @@ type HostAgentConfig struct {
 	// VLAN for service traffic
 	ServiceVlan uint `json:"service-vlan,omitempty"`
 
+	// MAC and IP address of the service interface of this node, used
+	// for external service mappings when the node object has no
+	// service endpoint annotation.  Both must be set if either is.
+	ServiceIfaceMac string `json:"service-iface-mac,omitempty"`
+	ServiceIfaceIp  string `json:"service-iface-ip,omitempty"`
+
+	// Opflex service mode for each Kubernetes service type.  Types
+	// not listed use the loadbalancer mode.
+	// map service type -> service mode
+	ServiceModes map[string]string `json:"service-modes,omitempty"`
+
+	// Minimum number of next hops a service mapping must have before
+	// the service is programmed
+	MinNextHops int `json:"min-next-hops,omitempty"`
+
+	// Comma-separated IP addresses of this node, at most one per
+	// address family, used for NodePort service mappings.  If neither
+	// this nor node-ip-iface is set, no NodePort mappings are made.
+	NodeIp string `json:"node-ip,omitempty"`
+
+	// Interface whose addresses are used for NodePort service
+	// mappings when node-ip has no address of the service's family
+	NodeIpIface string `json:"node-ip-iface,omitempty"`
+
+	// Comma-separated address families ("ipv4", "ipv6") for which
+	// service mappings are programmed.  When set, next hops in the
+	// other family than the service IP are also left out.  If empty,
+	// every service is programmed with all of its next hops.
+	ServiceIpFamilies string `json:"service-ip-families,omitempty"`
+
+	// Comma-separated keys of namespace labels to add to the
+	// attributes of the services in the namespace, as
+	// "namespace-label:<key>" so they cannot collide with the labels
+	// of the service itself
+	ServiceNamespaceLabels string `json:"service-namespace-labels,omitempty"`
+
+	// Maximum number of next hops programmed for a service mapping,
+	// or 0 for no limit
+	MaxNextHops int `json:"max-next-hops,omitempty"`
+
+	// Disable conntrack for well-known connectionless UDP services,
+	// such as DNS and NTP, unless the service sets conntrack itself
+	AutoDisableUdpConntrack bool `json:"auto-disable-udp-conntrack,omitempty"`
+
 	// Type of encapsulation to use for uplink; either vlan or vxlan
 	EncapType string `json:"encap-type,omitempty"`
 
@@ -181,6 +279,16 @@ func (config *HostAgentConfig) InitFlags() {
 	flag.StringVar(&config.OpFlexConfigPath, "opflex-config-path", "/usr/local/etc/opflex-agent-ovs/base-conf.d", "Directory for writing Opflex configuration")
 	flag.StringVar(&config.OpFlexEndpointDir, "opflex-endpoint-dir", "/usr/local/var/lib/opflex-agent-ovs/endpoints/", "Directory for writing OpFlex endpoint metadata")
 	flag.StringVar(&config.OpFlexServiceDir, "opflex-service-dir", "/usr/local/var/lib/opflex-agent-ovs/services/", "Directory for writing OpFlex anycast service metadata")
+	flag.StringVar(&config.OpFlexServiceDirPerms, "opflex-service-dir-perms", "0755", "Permissions for the OpFlex service directory if it must be created. Octal string")
+	flag.IntVar(&config.OpFlexServiceDirRetries, "opflex-service-dir-retries", 3, "Number of times to retry a failed operation on the OpFlex service directory")
+	flag.IntVar(&config.OpFlexServiceDirRetryDelay, "opflex-service-dir-retry-delay", 100, "Initial delay in milliseconds between retries of OpFlex service directory operations")
+	flag.IntVar(&config.OpFlexServiceMaxFiles, "opflex-service-max-files", 0, "Maximum number of service files in the OpFlex service directory, or 0 for no limit")
+	flag.IntVar(&config.OpFlexServiceSyncWorkers, "opflex-service-sync-workers", 1, "Number of service files written or removed concurrently during a service sync")
+	flag.IntVar(&config.ServiceRemovalGracePeriod, "service-removal-grace-period", 0, "Time in seconds to keep the file for a removed service before deleting it, or 0 to delete it immediately")
+	flag.IntVar(&config.ServiceTombstoneTime, "service-tombstone-time", 0, "Time in seconds to keep a withdrawn tombstone in place of the file of a removed service before deleting it, or 0 to delete the file without a tombstone")
+	flag.BoolVar(&config.CompactServiceFiles, "compact-service-files", false, "Omit service file fields that have the value opflex uses by default")
+	flag.BoolVar(&config.Fsync, "fsync", false, "Flush OpFlex service files and their directory to disk after each write")
+	flag.IntVar(&config.OpFlexServiceResyncInterval, "opflex-service-resync-interval", 600, "Interval in seconds between full resyncs of the OpFlex services, or 0 to disable")
 	flag.StringVar(&config.OpFlexFlowIdCacheDir, "opflex-flowid-cache-dir",
 		"/usr/local/var/lib/opflex-agent-ovs/ids/",
 		"OpFlex agent's flow-ID cache directory")
@@ -198,7 +306,16 @@ func (config *HostAgentConfig) InitFlags() {
 	flag.IntVar(&config.InterfaceMtu, "interface-mtu", 1500, "Interface MTU to use when configuring container interfaces")
 
 	flag.UintVar(&config.ServiceVlan, "service-vlan", 4003, "VLAN for service traffic")
-
+	flag.StringVar(&config.ServiceIfaceMac, "service-iface-mac", "", "MAC address of the service interface, used when the node has no service endpoint annotation")
+	flag.StringVar(&config.ServiceIfaceIp, "service-iface-ip", "", "IP address of the service interface, used when the node has no service endpoint annotation")
+	flag.IntVar(&config.MinNextHops, "min-next-hops", 1, "Minimum number of next hops a service mapping must have before the service is programmed")
+	flag.IntVar(&config.MaxNextHops, "max-next-hops", 0, "Maximum number of next hops programmed for a service mapping, or 0 for no limit")
+	flag.BoolVar(&config.AutoDisableUdpConntrack, "auto-disable-udp-conntrack", false, "Disable conntrack for well-known connectionless UDP services unless overridden by the service")
+
+	flag.StringVar(&config.NodeIp, "node-ip", "", "Comma-separated IP addresses of this node used for NodePort service mappings")
+	flag.StringVar(&config.NodeIpIface, "node-ip-iface", "", "Interface whose addresses are used for NodePort service mappings when node-ip is not set")
+	flag.StringVar(&config.ServiceIpFamilies, "service-ip-families", "", "Comma-separated address families (ipv4, ipv6) to program service mappings for. All families if not set")
+	flag.StringVar(&config.ServiceNamespaceLabels, "service-namespace-labels", "", "Comma-separated keys of namespace labels to add to the attributes of the services in the namespace")
 	flag.StringVar(&config.UplinkIface, "uplink-iface", "eth1", "Uplink interface for this host")
 	flag.UintVar(&config.AciInfraVlan, "aci-infra-vlan", 4093, "Vlan used for ACI infrastructure traffic")
 	flag.StringVar(&config.EncapType, "encap-type", "vxlan", "Type of encapsulation to use for uplink; either vlan or vxlan")
@@ -213,3 +330,72 @@ func (config *HostAgentConfig) InitFlags() {
 	flag.StringVar(&config.AciVrf, "aci-vrf", "kubernetes-vrf", "ACI VRF for this kubernetes instance")
 	flag.StringVar(&config.AciVrfTenant, "aci-vrf-tenant", "common", "ACI Tenant containing the ACI VRF for this kubernetes instance")
 }
+
+// Check that the settings used for external service mappings are
+// consistent.  The uplink interface may be discovered at runtime, but
+// if it is set then it must be a valid interface name and a valid
+// service VLAN is required.  A service interface MAC or IP address
+// requires the uplink interface and the other address, and both must
+// parse.
+func (config *HostAgentConfig) ValidateServiceConfig() error {
+	if config.ServiceVlan > 4094 {
+		return fmt.Errorf("Invalid service VLAN %d", config.ServiceVlan)
+	}
+	if config.UplinkIface != "" {
+		if err := validateIfaceName(config.UplinkIface); err != nil {
+			return err
+		}
+		if config.ServiceVlan == 0 {
+			return errors.New("Service VLAN must be set when uplink " +
+				"interface " + config.UplinkIface + " is set")
+		}
+	}
+
+	if config.ServiceIfaceMac == "" && config.ServiceIfaceIp == "" {
+		return nil
+	}
+	if config.UplinkIface == "" {
+		return errors.New("Uplink interface must be set when the " +
+			"service interface MAC or IP address is set")
+	}
+	if config.ServiceIfaceMac == "" {
+		return errors.New("Service interface MAC must be set when the " +
+			"service interface IP address is set")
+	}
+	if _, err := net.ParseMAC(config.ServiceIfaceMac); err != nil {
+		return fmt.Errorf("Invalid service interface MAC %s: %v",
+			config.ServiceIfaceMac, err)
+	}
+	if config.ServiceIfaceIp == "" {
+		return errors.New("Service interface IP address must be set " +
+			"when the service interface MAC is set")
+	}
+	if net.ParseIP(config.ServiceIfaceIp) == nil {
+		return errors.New("Invalid service interface IP address " +
+			config.ServiceIfaceIp)
+	}
+	return nil
+}
+
+// Check that a name can be used as a Linux network interface name
+func validateIfaceName(name string) error {
+	if len(name) > 15 || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/ \t\n") {
+		return errors.New("Invalid interface name " + name)
+	}
+	return nil
+}
+
+// Get the service endpoint set by the service interface MAC and IP
+// address options, or an empty endpoint if they are not set
+func (config *HostAgentConfig) configuredServiceEp() metadata.ServiceEndpoint {
+	ep := metadata.ServiceEndpoint{Mac: config.ServiceIfaceMac}
+	if ip := net.ParseIP(config.ServiceIfaceIp); ip == nil {
+		ep.Mac = ""
+	} else if ip.To4() != nil {
+		ep.Ipv4 = ip
+	} else {
+		ep.Ipv6 = ip
+	}
+	return ep
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostagent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/noironetworks/aci-containers/pkg/metadata"
+)
+
+type serviceConfigTest struct {
+	uplinkIface string
+	serviceVlan uint
+	mac         string
+	ip          string
+	err         bool
+	desc        string
+}
+
+var serviceConfigTests = []serviceConfigTest{
+	{"", 0, "", "", false, "unset"},
+	{"eth1", 4003, "", "", false, "complete"},
+	{"", 4003, "", "", false, "uplink discovered"},
+	{"eth1", 0, "", "", true, "missing vlan"},
+	{"eth1", 4095, "", "", true, "invalid vlan"},
+	{"eth1/0", 4003, "", "", true, "invalid interface name"},
+	{"averyverylongiface", 4003, "", "", true, "interface name too long"},
+	{"eth1", 4003, "76:47:db:97:ba:4c", "10.6.0.1", false, "static endpoint"},
+	{"eth1", 4003, "76:47:db:97:ba:4c", "fd00::6:1", false, "static v6"},
+	{"", 4003, "76:47:db:97:ba:4c", "10.6.0.1", true, "missing interface"},
+	{"eth1", 4003, "", "10.6.0.1", true, "missing mac"},
+	{"eth1", 4003, "76:47:db:97:ba:4c", "", true, "missing ip"},
+	{"eth1", 4003, "not-a-mac", "10.6.0.1", true, "invalid mac"},
+	{"eth1", 4003, "76:47:db:97:ba:4c", "10.6.0", true, "invalid ip"},
+}
+
+func TestValidateServiceConfig(t *testing.T) {
+	for _, ct := range serviceConfigTests {
+		config := &HostAgentConfig{ServiceVlan: ct.serviceVlan}
+		config.UplinkIface = ct.uplinkIface
+		config.ServiceIfaceMac = ct.mac
+		config.ServiceIfaceIp = ct.ip
+		err := config.ValidateServiceConfig()
+		if ct.err {
+			assert.NotNil(t, err, ct.desc)
+		} else {
+			assert.Nil(t, err, ct.desc)
+		}
+	}
+}
+
+func TestConfiguredServiceEp(t *testing.T) {
+	config := &HostAgentConfig{}
+	assert.Equal(t, metadata.ServiceEndpoint{},
+		config.configuredServiceEp(), "unset")
+
+	config.ServiceIfaceMac = "76:47:db:97:ba:4c"
+	config.ServiceIfaceIp = "10.6.0.1"
+	assert.Equal(t, testServiceEp, config.configuredServiceEp(), "v4")
+
+	config.ServiceIfaceIp = "fd00::6:1"
+	ep := config.configuredServiceEp()
+	assert.Nil(t, ep.Ipv4, "v6")
+	assert.Equal(t, "fd00::6:1", ep.Ipv6.String(), "v6")
+}
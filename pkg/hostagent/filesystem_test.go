@@ -0,0 +1,348 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostagent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	tu "github.com/noironetworks/aci-containers/pkg/testutil"
+)
+
+// A fileSystem that records the names of the files it flushes
+type syncRecorder struct {
+	fileSystem
+	synced []string
+}
+
+func (r *syncRecorder) Sync(name string) error {
+	r.synced = append(r.synced, filepath.Base(name))
+	return r.fileSystem.Sync(name)
+}
+
+// A fileSystem that records the names of the files it writes or
+// renames into place
+type writeRecorder struct {
+	fileSystem
+	mutex   sync.Mutex
+	written []string
+}
+
+func (r *writeRecorder) record(name string) {
+	r.mutex.Lock()
+	r.written = append(r.written, filepath.Base(name))
+	r.mutex.Unlock()
+}
+
+func (r *writeRecorder) WriteFile(filename string, data []byte,
+	perm os.FileMode) error {
+	r.record(filename)
+	return r.fileSystem.WriteFile(filename, data, perm)
+}
+
+func (r *writeRecorder) Rename(oldpath string, newpath string) error {
+	r.record(newpath)
+	return r.fileSystem.Rename(oldpath, newpath)
+}
+
+func (r *writeRecorder) take() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	written := r.written
+	r.written = nil
+	return written
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// An in-memory fileSystem.  Operations on a name in failNames fail.
+type memFileSystem struct {
+	mutex     sync.Mutex
+	files     map[string][]byte
+	dirs      map[string]bool
+	failNames map[string]error
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{
+		files:     make(map[string][]byte),
+		dirs:      make(map[string]bool),
+		failNames: make(map[string]error),
+	}
+}
+
+func (fs *memFileSystem) check(op string, name string) error {
+	if err, ok := fs.failNames[filepath.Base(name)]; ok {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs *memFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	dirname = filepath.Clean(dirname)
+	if !fs.dirs[dirname] {
+		return nil, &os.PathError{Op: "open", Path: dirname,
+			Err: os.ErrNotExist}
+	}
+	var result []os.FileInfo
+	for name, data := range fs.files {
+		if filepath.Dir(name) == dirname {
+			result = append(result, &memFileInfo{
+				name: filepath.Base(name),
+				size: int64(len(data)),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+func (fs *memFileSystem) ReadFile(filename string) ([]byte, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	data, ok := fs.files[filepath.Clean(filename)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filename,
+			Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (fs *memFileSystem) WriteFile(filename string, data []byte,
+	perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	filename = filepath.Clean(filename)
+	if err := fs.check("open", filename); err != nil {
+		return err
+	}
+	if !fs.dirs[filepath.Dir(filename)] {
+		return &os.PathError{Op: "open", Path: filename,
+			Err: os.ErrNotExist}
+	}
+	fs.files[filename] = append([]byte(nil), data...)
+	return nil
+}
+
+func (fs *memFileSystem) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("remove", name); err != nil {
+		return err
+	}
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFileSystem) Rename(oldpath string, newpath string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := fs.check("rename", newpath); err != nil {
+		return err
+	}
+	data, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath,
+			Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = data
+	return nil
+}
+
+func (fs *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	name = filepath.Clean(name)
+	if fs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(data))},
+		nil
+}
+
+func (fs *memFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for path = filepath.Clean(path); !fs.dirs[path]; path = filepath.Dir(path) {
+		fs.dirs[path] = true
+	}
+	return nil
+}
+
+func (fs *memFileSystem) Sync(name string) error {
+	return nil
+}
+
+func (fs *memFileSystem) names() []string {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var names []string
+	for name := range fs.files {
+		names = append(names, filepath.Base(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestServiceSyncMemFileSystem(t *testing.T) {
+	fs := newMemFileSystem()
+	agent := testAgent()
+	agent.fs = fs
+	agent.config.OpFlexServiceDir = "/services"
+	agent.config.OpFlexServiceDirRetries = 0
+	agent.syncEnabled = true
+
+	first, second := &serviceTests[0], &serviceTests[1]
+	for _, st := range []*serviceTest{first, second} {
+		agent.updateServiceDesc(false,
+			service(st.uuid, st.namespace, st.name,
+				st.clusterIp, st.externalIp, st.ports),
+			endpoints(st.namespace, st.name, st.nextHopIps, st.ports))
+	}
+
+	// service files are written and a stale file removed
+	fs.MkdirAll("/services", 0755)
+	fs.WriteFile("/services/stale.service", []byte("{}"), 0644)
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync")
+	assert.Equal(t, []string{
+		first.uuid + ".meta", first.uuid + ".service",
+		second.uuid + ".meta", second.uuid + ".service",
+	}, fs.names(), "sync")
+	raw, err := fs.ReadFile("/services/" + second.uuid + ".service")
+	if assert.Nil(t, err, "contents") {
+		expected, _ := marshalService(agent.opflexServices[second.uuid])
+		assert.Equal(t, string(expected), string(raw), "contents")
+	}
+
+	// a failed write is reported and retried by a full sync
+	fs.failNames[second.uuid+".service"] = os.ErrPermission
+	agent.updateServiceDesc(false,
+		service(second.uuid, second.namespace, second.name,
+			second.clusterIp, second.externalIp, second.ports),
+		endpoints(second.namespace, second.name, []string{"10.9.9.9"},
+			second.ports))
+	agent.syncServices()
+	assert.NotNil(t, agent.serviceSyncErr, "write error")
+	assert.Equal(t, []string{
+		first.uuid + ".meta", first.uuid + ".service",
+		second.uuid + ".meta", second.uuid + ".service",
+	}, fs.names(), "no temporary file left")
+
+	delete(fs.failNames, second.uuid+".service")
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "recovered")
+	raw, _ = fs.ReadFile("/services/" + second.uuid + ".service")
+	assert.Contains(t, string(raw), "10.9.9.9", "recovered")
+
+	// the directory is recreated if it disappears
+	fs = newMemFileSystem()
+	agent.fs = fs
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "recreated")
+	assert.Equal(t, 4, len(fs.names()), "recreated")
+}
+
+func TestServiceSyncRetry(t *testing.T) {
+	fs := newMemFileSystem()
+	agent := testAgent()
+	agent.fs = fs
+	agent.config.OpFlexServiceDir = "/services"
+	agent.config.OpFlexServiceDirRetries = 0
+	agent.syncEnabled = true
+
+	st := &serviceTests[1]
+	agent.updateServiceDesc(false, st.service(), st.endpoints())
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync")
+
+	// the first attempt fails and clears the fault for the retry
+	var mutex sync.Mutex
+	attempts := 0
+	agent.syncProcessors["services"] = func() bool {
+		requeue := agent.syncServices()
+		mutex.Lock()
+		attempts++
+		if attempts == 1 {
+			fs.mutex.Lock()
+			delete(fs.failNames, st.uuid+".service")
+			fs.mutex.Unlock()
+		}
+		mutex.Unlock()
+		return requeue
+	}
+	fs.failNames[st.uuid+".service"] = os.ErrPermission
+	agent.updateServiceDesc(false, st.service(),
+		endpoints(st.namespace, st.name, []string{"10.9.9.9"}, st.ports))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go agent.processSyncQueue(agent.syncQueue, stop)
+	agent.ScheduleSync("services")
+
+	tu.WaitFor(t, "retried", 500*time.Millisecond,
+		func(last bool) (bool, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return attempts >= 2, nil
+		})
+	tu.WaitFor(t, "recovered", 500*time.Millisecond,
+		func(last bool) (bool, error) {
+			raw, _ := fs.ReadFile("/services/" + st.uuid + ".service")
+			return strings.Contains(string(raw), "10.9.9.9"), nil
+		})
+}
@@ -18,7 +18,10 @@ package hostagent
 
 import (
 	"encoding/json"
+	"errors"
+	"net"
 	"reflect"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -71,6 +74,115 @@ func (agent *HostAgent) initNodeInformerBase(listWatch *cache.ListWatch) {
 	})
 }
 
+// Check that the service endpoint has both a MAC and an IP address
+// and that the MAC is valid
+func validateServiceEp(ep *metadata.ServiceEndpoint) error {
+	if ep.Mac == "" {
+		return errors.New("Missing service endpoint MAC address")
+	}
+	if _, err := net.ParseMAC(ep.Mac); err != nil {
+		return err
+	}
+	if ep.Ipv4 == nil && ep.Ipv6 == nil {
+		return errors.New("Missing service endpoint IP address")
+	}
+	return nil
+}
+
+// Get the IP address of this node in the given family, as resolved
+// by updateNodeIps.  Returns nil if there is no address of the family.
+//
+// must have index lock
+func (agent *HostAgent) nodeIp(v6 bool) net.IP {
+	if v6 {
+		return agent.nodeIpV6
+	}
+	return agent.nodeIpV4
+}
+
+// Resolve the IP addresses of this node used for NodePort service
+// mappings.  This is done once at startup, so that services do not
+// look up the node-ip-iface interface on every update.  Returns true
+// if either address changed.
+//
+// must have index lock
+func (agent *HostAgent) updateNodeIps() bool {
+	v4, v6 := agent.resolveNodeIp(false), agent.resolveNodeIp(true)
+	if v4.Equal(agent.nodeIpV4) && v6.Equal(agent.nodeIpV6) {
+		return false
+	}
+	agent.nodeIpV4, agent.nodeIpV6 = v4, v6
+	return true
+}
+
+// Find the IP address of this node in the given family.  The address
+// is taken from the node-ip setting, then from the addresses of the
+// node-ip-iface interface.  Returns nil if there is no address of the
+// family, so NodePort service mappings are only made when one of the
+// options is set.
+func (agent *HostAgent) resolveNodeIp(v6 bool) net.IP {
+	matches := func(ip net.IP) bool {
+		return ip != nil && (ip.To4() == nil) == v6
+	}
+
+	for _, s := range strings.Split(agent.config.NodeIp, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if matches(ip) {
+			return ip
+		}
+	}
+
+	if agent.config.NodeIpIface != "" {
+		iface, err := net.InterfaceByName(agent.config.NodeIpIface)
+		if err != nil {
+			agent.log.Warn("Could not get node IP interface: ", err)
+		} else {
+			addrs, _ := iface.Addrs()
+			for _, addr := range addrs {
+				ipnet, ok := addr.(*net.IPNet)
+				if ok && ipnet.IP.IsGlobalUnicast() && matches(ipnet.IP) {
+					return ipnet.IP
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Get the address families for which this node programs service
+// mappings, from the service-ip-families option.  Both families are
+// served if it is not set.
+func (agent *HostAgent) serviceIpFamilies() (v4 bool, v6 bool) {
+	if agent.config.ServiceIpFamilies == "" {
+		return true, true
+	}
+	for _, f := range strings.Split(agent.config.ServiceIpFamilies, ",") {
+		switch strings.ToLower(strings.TrimSpace(f)) {
+		case "ipv4":
+			v4 = true
+		case "ipv6":
+			v6 = true
+		default:
+			agent.log.Warn("Ignoring unknown service IP family: ", f)
+		}
+	}
+	return
+}
+
+// Check whether this node programs service mappings for the address
+// family of the given IP address
+func (agent *HostAgent) serviceIpFamilyEnabled(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return true
+	}
+	v4, v6 := agent.serviceIpFamilies()
+	if parsed.To4() != nil {
+		return v4
+	}
+	return v6
+}
+
 func (agent *HostAgent) nodeChanged(obj interface{}) {
 	updateServices := false
 
@@ -92,12 +204,18 @@ func (agent *HostAgent) nodeChanged(obj interface{}) {
 		epval, ok := node.ObjectMeta.Annotations[metadata.ServiceEpAnnotation]
 		if ok {
 			err := json.Unmarshal([]byte(epval), &newServiceEp)
+			if err == nil {
+				err = validateServiceEp(&newServiceEp)
+			}
 			if err != nil {
 				agent.log.WithFields(logrus.Fields{
 					"epval": epval,
 				}).Warn("Could not parse node ",
 					"service endpoint annotation: ", err)
+				newServiceEp = metadata.ServiceEndpoint{}
 			}
+		} else {
+			newServiceEp = agent.config.configuredServiceEp()
 		}
 		if !reflect.DeepEqual(newServiceEp, agent.serviceEp) {
 			agent.log.WithFields(logrus.Fields{
@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -162,3 +163,20 @@ func TestBuildIpam(t *testing.T) {
 
 	agent.stop()
 }
+
+func TestValidateServiceEp(t *testing.T) {
+	assert.Nil(t, validateServiceEp(&metadata.ServiceEndpoint{
+		Mac:  "76:47:db:97:ba:4c",
+		Ipv4: net.ParseIP("10.6.0.1"),
+	}), "valid")
+	assert.NotNil(t, validateServiceEp(&metadata.ServiceEndpoint{
+		Ipv4: net.ParseIP("10.6.0.1"),
+	}), "missing mac")
+	assert.NotNil(t, validateServiceEp(&metadata.ServiceEndpoint{
+		Mac:  "76:47:db:97:ba",
+		Ipv4: net.ParseIP("10.6.0.1"),
+	}), "invalid mac")
+	assert.NotNil(t, validateServiceEp(&metadata.ServiceEndpoint{
+		Mac: "76:47:db:97:ba:4c",
+	}), "missing ip")
+}
@@ -131,7 +131,7 @@ var opflexConfigBase = initTempl("opflex-config-base", `{
         "filesystem": ["{{.OpFlexEndpointDir | js}}"]
     },
     "service-sources": {
-        "filesystem": ["{{.OpFlexServiceDir | js}}"]
+        "filesystem": [{{range $i, $dir := .ServiceDirs}}{{if $i}}, {{end}}"{{$dir | js}}"{{end}}]
     }
 }
 `)
@@ -174,6 +174,14 @@ var opflexConfigVlan = initTempl("opflex-config-vlan", `{
 }
 `)
 
+// Values for the OpFlex agent configuration templates
+type opflexConfigData struct {
+	*HostAgentConfig
+
+	// Directories the agent reads service files from
+	ServiceDirs []string
+}
+
 func initTempl(name string, templ string) *template.Template {
 	return template.Must(template.New(name).Parse(templ))
 }
@@ -182,7 +190,10 @@ func (agent *HostAgent) writeConfigFile(name string,
 	templ *template.Template) error {
 
 	var buffer bytes.Buffer
-	templ.Execute(&buffer, agent.config)
+	templ.Execute(&buffer, &opflexConfigData{
+		HostAgentConfig: agent.config,
+		ServiceDirs:     agent.serviceDirs(),
+	})
 
 	path := filepath.Join(agent.config.OpFlexConfigPath, name)
 
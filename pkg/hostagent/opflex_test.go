@@ -15,6 +15,7 @@
 package hostagent
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -39,6 +40,31 @@ func doTestOpflex(t *testing.T, agent *testHostAgent) {
 	assert.Nil(t, err, "renderer")
 }
 
+func TestOpflexConfigServiceDirs(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "hostagent_test_")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	agent := testAgent()
+	agent.config.OpFlexConfigPath = tempdir
+	agent.config.OpFlexServiceDirs = []string{"/shard0", "/shard1/", "/shard0"}
+	agent.writeConfigFile("01-base.conf", opflexConfigBase)
+
+	raw, err := ioutil.ReadFile(filepath.Join(tempdir, "01-base.conf"))
+	if assert.Nil(t, err, "base") {
+		var conf struct {
+			ServiceSources struct {
+				Filesystem []string `json:"filesystem"`
+			} `json:"service-sources"`
+		}
+		assert.Nil(t, json.Unmarshal(raw, &conf), "parse")
+		assert.Equal(t, []string{"/shard0", "/shard1"},
+			conf.ServiceSources.Filesystem, "service sources")
+	}
+}
+
 func TestOpflexConfigVxlan(t *testing.T) {
 	agent := testAgent()
 	agent.config = &HostAgentConfig{
@@ -77,6 +77,7 @@ func (agent *HostAgent) namespaceAdded(obj interface{}) {
 	agent.log.Infof("###Namespace %+v added", ns)
 	agent.netPolPods.UpdateNamespace(ns)
 	agent.updatePodsForNamespace(ns.ObjectMeta.Name)
+	agent.updateServicesForNamespace(ns.ObjectMeta.Name)
 }
 
 func (agent *HostAgent) namespaceChanged(oldobj interface{},
@@ -88,6 +89,7 @@ func (agent *HostAgent) namespaceChanged(oldobj interface{},
 
 	if !reflect.DeepEqual(oldns.ObjectMeta.Labels, newns.ObjectMeta.Labels) {
 		agent.netPolPods.UpdateNamespace(newns)
+		agent.updateServicesForNamespace(newns.ObjectMeta.Name)
 	}
 	if !reflect.DeepEqual(oldns.ObjectMeta.Annotations,
 		newns.ObjectMeta.Annotations) {
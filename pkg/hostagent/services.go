@@ -15,24 +15,35 @@
 package hostagent
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 
 	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/noironetworks/aci-containers/pkg/metadata"
 )
 
 type opflexServiceMapping struct {
@@ -43,10 +54,40 @@ type opflexServiceMapping struct {
 	NextHopIps  []string `json:"next-hop-ips"`
 	NextHopPort uint16   `json:"next-hop-port,omitempty"`
 
-	Conntrack bool `json:"conntrack-enabled"`
+	// Port of each next hop keyed by next hop IP, set only when the
+	// next hops do not all use the same port.  NextHopPort is then the
+	// lowest of the ports.
+	NextHopPorts map[string]uint16 `json:"next-hop-ports,omitempty"`
+
+	// Hostnames of the next hop endpoints that have one, keyed by
+	// next hop IP
+	NextHopHostnames map[string]string `json:"next-hop-hostnames,omitempty"`
+
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Omitted when disabled, which is also the default for opflex
+	Conntrack bool `json:"conntrack-enabled,omitempty"`
+
+	// Synchronize the connection tracking state of the mapping, set
+	// only when requested for the service
+	ConntrackStateSync bool `json:"conntrack-state-sync,omitempty"`
+}
+
+// Version of the service file format written by the agent
+const serviceFileVersion = 1
+
+// Upgrades of the JSON of a service file from older versions of the
+// format; entry i upgrades version i to version i+1
+var serviceFileMigrations = []func(map[string]interface{}){
+	// version 1 only added the version field
+	func(map[string]interface{}) {},
 }
 
 type opflexService struct {
+	// Version of the file format, set when the file is written.  Files
+	// written before the format was versioned have no version.
+	Version int `json:"version,omitempty"`
+
 	Uuid string `json:"uuid"`
 
 	DomainPolicySpace string `json:"domain-policy-space,omitempty"`
@@ -60,7 +101,160 @@ type opflexService struct {
 
 	ServiceMappings []opflexServiceMapping `json:"service-mapping"`
 
+	PreserveSourceIp bool `json:"preserve-source-ip,omitempty"`
+
+	// External traffic policy of the service, Local or Cluster
+	ExternalTrafficPolicy string `json:"external-traffic-policy,omitempty"`
+
+	// Node port on which the backends of a LoadBalancer service with
+	// the Local external traffic policy answer health checks
+	HealthCheckPort uint16 `json:"health-check-port,omitempty"`
+
 	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Set in the tombstone written in place of the file of a removed
+	// service when tombstones are enabled
+	Withdrawn bool `json:"withdrawn,omitempty"`
+
+	// Source object of the service, written to the companion .meta
+	// file
+	meta opflexServiceMeta
+
+	// Log level requested for the service by annotation
+	logLevel string
+}
+
+// Contents of the .meta file written alongside each service file to
+// identify the Kubernetes object it was derived from
+type opflexServiceMeta struct {
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Uid             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resource-version,omitempty"`
+}
+
+// Service mappings sorted by protocol, service port and service IP,
+// so that the same service always produces the same mapping order
+type serviceMappingSlice []opflexServiceMapping
+
+func (s serviceMappingSlice) Len() int {
+	return len(s)
+}
+
+func (s serviceMappingSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s serviceMappingSlice) Less(i, j int) bool {
+	if s[i].ServiceProto != s[j].ServiceProto {
+		return s[i].ServiceProto < s[j].ServiceProto
+	}
+	if s[i].ServicePort != s[j].ServicePort {
+		return s[i].ServicePort < s[j].ServicePort
+	}
+	if s[i].ServiceIp != s[j].ServiceIp {
+		return s[i].ServiceIp < s[j].ServiceIp
+	}
+	return s[i].NextHopPort < s[j].NextHopPort
+}
+
+// Remove service mappings that collide with an earlier mapping for the
+// same service IP, protocol and port, which the datapath cannot
+// program unambiguously.  The mappings must be sorted, so the mapping
+// kept is always the one with the lowest next hop port.
+func dedupServiceMappings(logger *logrus.Entry,
+	mappings []opflexServiceMapping) []opflexServiceMapping {
+	result := mappings[:0]
+	for _, sm := range mappings {
+		if len(result) > 0 {
+			prev := &result[len(result)-1]
+			if prev.ServiceIp == sm.ServiceIp &&
+				prev.ServiceProto == sm.ServiceProto &&
+				prev.ServicePort == sm.ServicePort {
+				logger.WithFields(logrus.Fields{
+					"service-ip":    sm.ServiceIp,
+					"service-proto": sm.ServiceProto,
+					"service-port":  sm.ServicePort,
+					"next-hop-port": sm.NextHopPort,
+				}).Warn("Ignoring colliding service mapping")
+				continue
+			}
+		}
+		result = append(result, sm)
+	}
+	return result
+}
+
+// Suffixes appended to the UID of a Kubernetes service to form the
+// UUID of each opflex service derived from it.  Each kind maps
+// addresses of a single family, so the UUID does not name the family.
+const (
+	serviceUuidExternal = "-external"
+	serviceUuidNodePort = "-nodeport"
+)
+
+// All the UUID suffixes that can be derived from a single Kubernetes
+// service, apart from the indexes of additional ingress IPs
+var serviceUuidSuffixes = []string{
+	"",
+	serviceUuidExternal,
+	serviceUuidNodePort,
+}
+
+// Kinds of opflex service derived from a Kubernetes service
+type serviceKind int
+
+const (
+	// maps the cluster IP
+	serviceKindCluster serviceKind = iota
+	// maps a LoadBalancer ingress IP
+	serviceKindExternal
+	// maps the NodePorts on the IP address of this node
+	serviceKindNodePort
+)
+
+// Compute the UUID for an opflex service of the given kind derived
+// from the Kubernetes service with the given UID.  UUIDs never depend
+// on the labels or other map-valued fields of the service, so the
+// result is stable.
+func serviceUuid(uid string, kind serviceKind) string {
+	uuid := uid
+	switch kind {
+	case serviceKindExternal:
+		uuid += serviceUuidExternal
+	case serviceKindNodePort:
+		uuid += serviceUuidNodePort
+	}
+	return uuid
+}
+
+// Compute the UUID for the external opflex service for the
+// LoadBalancer ingress IP at the given index.  The first ingress IP
+// uses the plain external UUID, so services with a single ingress IP
+// keep the same UUID.
+func serviceIngressUuid(uid string, index int) string {
+	uuid := serviceUuid(uid, serviceKindExternal)
+	if index > 0 {
+		uuid += "-" + strconv.Itoa(index)
+	}
+	return uuid
+}
+
+// Get the ingress IP index of an external opflex service UUID derived
+// from the given Kubernetes service UID
+func serviceIngressIndex(uid string, uuid string) (int, bool) {
+	external := serviceUuid(uid, serviceKindExternal)
+	if uuid == external {
+		return 0, true
+	}
+	if !strings.HasPrefix(uuid, external+"-") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(uuid[len(external)+1:])
+	if err != nil || index <= 0 {
+		return 0, false
+	}
+	return index, true
 }
 
 func (agent *HostAgent) initEndpointsInformerFromClient(
@@ -96,235 +290,1546 @@ func (agent *HostAgent) initEndpointsInformerBase(listWatch *cache.ListWatch) {
 	})
 }
 
-func (agent *HostAgent) initServiceInformerFromClient(
-	kubeClient *kubernetes.Clientset) {
-	agent.initServiceInformerBase(
-		&cache.ListWatch{
-			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-				return kubeClient.Core().Services(metav1.NamespaceAll).List(options)
-			},
-			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-				return kubeClient.Core().Services(metav1.NamespaceAll).Watch(options)
-			},
-		})
+func (agent *HostAgent) initServiceInformerFromClient(
+	kubeClient *kubernetes.Clientset) {
+	agent.initServiceInformerBase(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return kubeClient.Core().Services(metav1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return kubeClient.Core().Services(metav1.NamespaceAll).Watch(options)
+			},
+		})
+}
+
+func (agent *HostAgent) initServiceInformerBase(listWatch *cache.ListWatch) {
+	agent.serviceInformer = cache.NewSharedIndexInformer(
+		listWatch,
+		&v1.Service{},
+		controller.NoResyncPeriodFunc(),
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	agent.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			agent.serviceChanged(obj)
+		},
+		UpdateFunc: func(_ interface{}, obj interface{}) {
+			agent.serviceChanged(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			agent.serviceDeleted(obj)
+		},
+	})
+}
+
+// Read a service file, upgrading it to the current version of the
+// format if it is older.  Also returns whether it was upgraded.
+func getAs(fs fileSystem, asfile string) (*opflexService, bool, error) {
+	raw, err := fs.ReadFile(asfile)
+	if err != nil {
+		return nil, false, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, false, err
+	}
+	version := 0
+	if v, ok := fields["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > serviceFileVersion {
+		return nil, false,
+			fmt.Errorf("Unsupported service file version %d", version)
+	}
+	for v := version; v < serviceFileVersion; v++ {
+		serviceFileMigrations[v](fields)
+	}
+	fields["version"] = serviceFileVersion
+	if raw, err = json.Marshal(fields); err != nil {
+		return nil, false, err
+	}
+	as := &opflexService{}
+	if err := json.Unmarshal(raw, as); err != nil {
+		return nil, false, err
+	}
+	return as, version < serviceFileVersion, nil
+}
+
+// Get the contents of the service file for a service, in the current
+// version of the format
+func marshalService(as *opflexService) ([]byte, error) {
+	versioned := *as
+	versioned.Version = serviceFileVersion
+	return json.MarshalIndent(&versioned, "", "  ")
+}
+
+// Write a file by writing a temporary file and renaming it into
+// place, so readers never see a partial file.  If sync is set the
+// temporary file is flushed before the rename and the directory after
+// it, so the new contents survive an unclean shutdown.
+func writeFileAtomic(fs fileSystem, file string, data []byte,
+	sync bool) error {
+	tmpfile := filepath.Join(filepath.Dir(file),
+		"."+filepath.Base(file)+".tmp")
+	err := fs.WriteFile(tmpfile, data, 0644)
+	if err == nil && sync {
+		err = fs.Sync(tmpfile)
+	}
+	if err == nil {
+		err = fs.Rename(tmpfile, file)
+	}
+	if err != nil {
+		fs.Remove(tmpfile)
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	return fs.Sync(filepath.Dir(file))
+}
+
+// Write the service file unless it already has the expected contents.
+// If force is set the file is written regardless.  Also returns the
+// fields that differ from the existing file, if there was one.
+func writeAs(fs fileSystem, asfile string, as *opflexService, force bool,
+	sync bool) (bool, []string, error) {
+	newdata, err := marshalService(as)
+	if err != nil {
+		return true, nil, err
+	}
+	var changes []string
+	existingdata, err := fs.ReadFile(asfile)
+	if err == nil {
+		if !force && reflect.DeepEqual(existingdata, newdata) {
+			return false, nil, nil
+		}
+		changes = serviceFileChanges(existingdata, newdata)
+	}
+
+	return true, changes, writeFileAtomic(fs, asfile, newdata, sync)
+}
+
+// Get the paths of the JSON fields that differ between two versions of
+// a service file, such as service-mapping[0].next-hop-ips.  Lists
+// of objects are compared element by element; other values are
+// reported as a whole.  Returns nil if either version cannot be
+// parsed.
+func serviceFileChanges(olddata []byte, newdata []byte) []string {
+	var oldobj, newobj interface{}
+	if json.Unmarshal(olddata, &oldobj) != nil ||
+		json.Unmarshal(newdata, &newobj) != nil {
+		return nil
+	}
+	changes := make([]string, 0)
+	jsonChanges("", oldobj, newobj, &changes)
+	return changes
+}
+
+func jsonChanges(path string, a interface{}, b interface{},
+	changes *[]string) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			kpath := k
+			if path != "" {
+				kpath = path + "." + k
+			}
+			jsonChanges(kpath, av[k], bv[k], changes)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || !jsonObjects(av) || !jsonObjects(bv) {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			var ai, bi interface{}
+			if i < len(av) {
+				ai = av[i]
+			}
+			if i < len(bv) {
+				bi = bv[i]
+			}
+			jsonChanges(fmt.Sprintf("%s[%d]", path, i), ai, bi, changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, path)
+	}
+}
+
+// Check whether the elements of a JSON list are all objects
+func jsonObjects(list []interface{}) bool {
+	for _, v := range list {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the .meta file for a service unless it already has the
+// expected contents
+func writeServiceMeta(fs fileSystem, metafile string,
+	meta *opflexServiceMeta, force bool, sync bool) (bool, error) {
+	newdata, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return true, err
+	}
+	if !force {
+		existingdata, err := fs.ReadFile(metafile)
+		if err == nil && reflect.DeepEqual(existingdata, newdata) {
+			return false, nil
+		}
+	}
+
+	return true, writeFileAtomic(fs, metafile, newdata, sync)
+}
+
+// Write the .service file for a service along with its .meta file.
+// Also returns the fields of the service file that changed.
+func (agent *HostAgent) writeServiceFiles(asfile string,
+	as *opflexService, force bool) (bool, []string, error) {
+	if agent.config.CompactServiceFiles {
+		as = compactService(as)
+	}
+	sync := agent.config.Fsync
+	var wrote bool
+	var changes []string
+	err := agent.retryServiceDirOp(func() (err error) {
+		wrote, changes, err = writeAs(agent.fs, asfile, as, force, sync)
+		return
+	})
+	if err != nil || as.meta.Name == "" {
+		return wrote, changes, err
+	}
+	metafile := filepath.Join(filepath.Dir(asfile), as.Uuid+".meta")
+	err = agent.retryServiceDirOp(func() error {
+		_, err := writeServiceMeta(agent.fs, metafile, &as.meta, force, sync)
+		return err
+	})
+	return wrote, changes, err
+}
+
+// Get a copy of the service with the fields that have the value opflex
+// uses by default cleared, so that they are omitted from the service
+// file
+func compactService(as *opflexService) *opflexService {
+	compact := *as
+	if compact.ServiceMode == defaultServiceMode {
+		compact.ServiceMode = ""
+	}
+	if compact.ExternalTrafficPolicy ==
+		string(v1.ServiceExternalTrafficPolicyTypeCluster) {
+		compact.ExternalTrafficPolicy = ""
+	}
+	return &compact
+}
+
+// Run a filesystem operation on the service directory, retrying with
+// exponential backoff up to the configured number of retries
+func (agent *HostAgent) retryServiceDirOp(op func() error) error {
+	delay := time.Duration(agent.config.OpFlexServiceDirRetryDelay) *
+		time.Millisecond
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i >= agent.config.OpFlexServiceDirRetries {
+			return err
+		}
+		agent.log.Debug("Retrying service directory operation: ", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Remove a file from the service directory, retrying on failure.
+// Files that are already gone are not an error.
+func (agent *HostAgent) removeServiceFile(asfile string) error {
+	return agent.retryServiceDirOp(func() error {
+		err := agent.fs.Remove(asfile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// A writer that serializes writes from several loggers to the same
+// output
+type lockedWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.Write(p)
+}
+
+// Get a logger for a service with the given log level annotation.  If
+// the annotation is a valid level more verbose than the level of the
+// agent logger, the result logs at that level to the same output;
+// otherwise the agent logger is returned.  There is one logger per
+// level, and they all write through the same locked writer.
+func (agent *HostAgent) serviceLevelLogger(level string) *logrus.Logger {
+	if level == "" {
+		return agent.log
+	}
+	l, err := logrus.ParseLevel(level)
+	if err != nil || l <= agent.log.Level {
+		return agent.log
+	}
+
+	agent.serviceLoggersMutex.Lock()
+	defer agent.serviceLoggersMutex.Unlock()
+	if log, ok := agent.serviceLoggers[l]; ok {
+		return log
+	}
+	if agent.serviceLoggers == nil {
+		agent.serviceLoggers = make(map[logrus.Level]*logrus.Logger)
+		agent.serviceLogOut = &lockedWriter{out: agent.log.Out}
+	}
+	log := &logrus.Logger{
+		Out:       agent.serviceLogOut,
+		Hooks:     agent.log.Hooks,
+		Formatter: agent.log.Formatter,
+		Level:     l,
+	}
+	agent.serviceLoggers[l] = log
+	return log
+}
+
+func (agent *HostAgent) serviceLogger(as *v1.Service) *logrus.Entry {
+	log := agent.serviceLevelLogger(
+		as.ObjectMeta.Annotations[metadata.ServiceLogLevelAnnotation])
+	return log.WithFields(logrus.Fields{
+		"namespace":       as.ObjectMeta.Namespace,
+		"name":            as.ObjectMeta.Name,
+		"type":            as.Spec.Type,
+		"uid":             as.ObjectMeta.UID,
+		"resourceVersion": as.ObjectMeta.ResourceVersion,
+	})
+}
+
+func (agent *HostAgent) opflexServiceLogger(as *opflexService) *logrus.Entry {
+	return agent.serviceLevelLogger(as.logLevel).WithFields(logrus.Fields{
+		"namespace":       as.Attributes["namespace"],
+		"name":            as.Attributes["name"],
+		"uuid":            as.Uuid,
+		"tenant":          as.DomainPolicySpace,
+		"vrf":             as.DomainName,
+		"uid":             as.meta.Uid,
+		"resourceVersion": as.meta.ResourceVersion,
+	})
+}
+
+// Get the directories that service files are written to.  A directory
+// listed more than once is only returned once, since a sync would
+// otherwise both write and remove its files.
+func (agent *HostAgent) serviceDirs() []string {
+	if len(agent.config.OpFlexServiceDirs) == 0 {
+		return []string{agent.config.OpFlexServiceDir}
+	}
+	dirs := make([]string, 0, len(agent.config.OpFlexServiceDirs))
+	seen := make(map[string]bool)
+	for _, dir := range agent.config.OpFlexServiceDirs {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Get the directory for the files of the service with the given UUID.
+// With several service directories, the directory is chosen by a hash
+// of the UUID, so a service is always written to the same one.
+func (agent *HostAgent) serviceDir(uuid string) string {
+	dirs := agent.serviceDirs()
+	if len(dirs) == 1 {
+		return dirs[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	return dirs[h.Sum32()%uint32(len(dirs))]
+}
+
+// Get the service UUID from the name of a file in a service
+// directory.  Returns false if the file is not a service or meta file.
+func serviceFileUuid(name string) (string, bool) {
+	for _, suffix := range []string{".as", ".service", ".meta"} {
+		if strings.HasSuffix(name, suffix) {
+			return name[:len(name)-len(suffix)], true
+		}
+	}
+	return "", false
+}
+
+// Check whether a file in a service directory is a temporary file
+// left by writeFileAtomic
+func serviceTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp")
+}
+
+// Read a service directory, creating it if it is missing
+func (agent *HostAgent) readServiceDir(dir string) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	missing := false
+	err := agent.retryServiceDirOp(func() (err error) {
+		files, err = agent.fs.ReadDir(dir)
+		missing = os.IsNotExist(err)
+		if missing {
+			err = agent.createServiceDir(dir)
+		}
+		return
+	})
+	if err != nil {
+		logger := agent.log.WithFields(logrus.Fields{"serviceDir": dir})
+		if missing {
+			logger.Error("Could not create directory " + err.Error())
+		} else {
+			logger.Error("Could not read directory " + err.Error())
+		}
+	}
+	return files, err
+}
+
+// Create a service directory with the configured permissions
+func (agent *HostAgent) createServiceDir(dir string) error {
+	perms := uint64(0755)
+	if agent.config.OpFlexServiceDirPerms != "" {
+		p, err := strconv.ParseUint(agent.config.OpFlexServiceDirPerms, 8, 32)
+		if err != nil {
+			agent.log.Warning("Could not parse service directory permissions: ",
+				err)
+		} else {
+			perms = p
+		}
+	}
+
+	agent.log.WithFields(
+		logrus.Fields{"serviceDir": dir},
+	).Info("Creating missing service directory")
+	return agent.fs.MkdirAll(dir, os.FileMode(perms))
+}
+
+// Record the result of a service sync for the readiness probe
+func (agent *HostAgent) setServiceSyncStatus(err error) {
+	agent.indexMutex.Lock()
+	agent.serviceSyncTime = time.Now()
+	agent.serviceSyncErr = err
+	agent.indexMutex.Unlock()
+}
+
+// Write the service files for the services marked dirty since the
+// last sync, or rescan the whole service directory if a full sync was
+// requested
+func (agent *HostAgent) syncServices() bool {
+	if !agent.syncEnabled {
+		return false
+	}
+	agent.serviceSyncMutex.Lock()
+	defer agent.serviceSyncMutex.Unlock()
+
+	dirty, all := agent.takeDirtyServices()
+	if !all {
+		return agent.syncDirtyServices(dirty)
+	}
+	var errs []error
+	var ops []func() error
+
+	agent.log.Debug("Syncing services")
+	agent.indexMutex.Lock()
+	opflexServices := make(map[string]*opflexService)
+	for k, v := range agent.opflexServices {
+		opflexServices[k] = v
+	}
+	force := agent.forceServiceRewrite
+	agent.forceServiceRewrite = false
+	agent.indexMutex.Unlock()
+	if force {
+		agent.log.Info("Rewriting all service files")
+	}
+
+	seen := make(map[string]bool)
+	failedDirs := make(map[string]bool)
+	keptFiles := make(map[string]int)
+	for _, dir := range agent.serviceDirs() {
+		files, err := agent.readServiceDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+			failedDirs[dir] = true
+			continue
+		}
+		seenFiles := make(map[string]string)
+		for _, f := range files {
+			if serviceTempFile(f.Name()) {
+				// left over from a write interrupted by a crash;
+				// all writes are done under the sync lock
+				tmpfile := filepath.Join(dir, f.Name())
+				ops = append(ops, func() error {
+					err := agent.removeServiceFile(tmpfile)
+					if err != nil {
+						agent.log.Error("Error removing temporary service file: ", err)
+					}
+					return err
+				})
+				continue
+			}
+			uuid, ok := serviceFileUuid(f.Name())
+			if !ok {
+				continue
+			}
+			if agent.serviceDir(uuid) != dir {
+				// left over from a different set of service
+				// directories
+				stale := filepath.Join(dir, f.Name())
+				ops = append(ops, func() error {
+					err := agent.removeServiceFile(stale)
+					if err != nil {
+						agent.log.Error("Error removing service file: ", err)
+					}
+					return err
+				})
+				continue
+			}
+			if strings.HasSuffix(f.Name(), ".meta") {
+				if _, ok := opflexServices[uuid]; !ok &&
+					agent.serviceRemovalStage(uuid) == serviceRemovalDelete {
+					metafile := filepath.Join(dir, f.Name())
+					ops = append(ops, func() error {
+						err := agent.removeServiceFile(metafile)
+						if err != nil {
+							agent.log.Error("Error removing service meta file: ", err)
+						}
+						return err
+					})
+				}
+				continue
+			}
+
+			asfile := filepath.Join(dir, f.Name())
+			logger := agent.log.WithFields(
+				logrus.Fields{"Uuid": uuid},
+			)
+
+			if prev, ok := seenFiles[uuid]; ok {
+				// Keep the file we would have written ourselves and
+				// remove the other one
+				remove := f.Name()
+				if f.Name() == uuid+".service" {
+					remove = prev
+					seenFiles[uuid] = f.Name()
+				}
+				logger.WithFields(logrus.Fields{
+					"file":      prev,
+					"duplicate": f.Name(),
+				}).Warn("Duplicate service files for UUID; removing ", remove)
+				removefile := filepath.Join(dir, remove)
+				ops = append(ops, func() error {
+					err := agent.removeServiceFile(removefile)
+					if err != nil {
+						logger.Error("Error removing service file: ", err)
+					}
+					return err
+				})
+				if remove == f.Name() {
+					continue
+				}
+			} else {
+				seenFiles[uuid] = f.Name()
+			}
+
+			existing, ok := opflexServices[uuid]
+			if ok {
+				delete(agent.pendingServiceRemovals, uuid)
+				ops = append(ops, func() error {
+					wrote, changes, err :=
+						agent.writeServiceFiles(asfile, existing, force)
+					if err != nil {
+						agent.opflexServiceLogger(existing).
+							Error("Error writing service file: ", err)
+					} else if wrote {
+						agent.opflexServiceLogger(existing).
+							WithField("changes", changes).Info("Updated service")
+					}
+					return err
+				})
+				seen[uuid] = true
+			} else {
+				switch agent.serviceRemovalStage(uuid) {
+				case serviceRemovalDelete:
+					logger.Info("Removing service")
+					ops = append(ops, func() error {
+						err := agent.removeServiceFile(asfile)
+						if err != nil {
+							logger.Error("Error removing service file: ", err)
+						}
+						return err
+					})
+				case serviceRemovalKeep:
+					keptFiles[dir]++
+					// Bring the kept file up to date with the current
+					// format
+					ops = append(ops, func() error {
+						kept, migrated, err := getAs(agent.fs, asfile)
+						if err != nil || !migrated {
+							return nil
+						}
+						logger.Info("Upgrading service file to version ",
+							serviceFileVersion)
+						_, _, err = agent.writeServiceFiles(asfile, kept, false)
+						if err != nil {
+							logger.Error("Error writing service file: ", err)
+						}
+						return err
+					})
+				case serviceRemovalTombstone:
+					keptFiles[dir]++
+					tombstone := newServiceTombstone(uuid)
+					ops = append(ops, func() error {
+						_, _, err :=
+							agent.writeServiceFiles(asfile, tombstone, false)
+						if err != nil {
+							logger.Error("Error writing service tombstone: ", err)
+						}
+						return err
+					})
+				}
+			}
+		}
+	}
+	if len(failedDirs) > 0 {
+		if force {
+			agent.indexMutex.Lock()
+			agent.forceServiceRewrite = true
+			agent.indexMutex.Unlock()
+		}
+		agent.markAllServicesDirty()
+	}
+
+	agent.prunePendingServiceRemovals()
+
+	fileCounts := make(map[string]int)
+	for uuid := range seen {
+		fileCounts[agent.serviceDir(uuid)]++
+	}
+	for _, as := range opflexServices {
+		as := as
+		dir := agent.serviceDir(as.Uuid)
+		if seen[as.Uuid] || failedDirs[dir] {
+			continue
+		}
+		delete(agent.pendingServiceRemovals, as.Uuid)
+
+		if err := agent.checkServiceFileLimit(fileCounts[dir]); err != nil {
+			agent.opflexServiceLogger(as).
+				Error("Not adding service: ", err)
+			errs = append(errs, err)
+			continue
+		}
+		fileCounts[dir]++
+
+		agent.opflexServiceLogger(as).Info("Adding service")
+		asfile := filepath.Join(dir, as.Uuid+".service")
+		ops = append(ops, func() error {
+			_, _, err := agent.writeServiceFiles(asfile, as, force)
+			if err != nil {
+				agent.opflexServiceLogger(as).
+					Error("Error writing service file: ", err)
+			}
+			return err
+		})
+	}
+
+	// the files each directory has once the operations are done, for
+	// checking the limit on later changed-service syncs
+	agent.serviceFileCounts = make(map[string]int)
+	for _, dir := range agent.serviceDirs() {
+		if !failedDirs[dir] {
+			agent.serviceFileCounts[dir] = fileCounts[dir] + keptFiles[dir]
+		}
+	}
+
+	errs = append(errs, agent.runServiceFileOps(ops)...)
+	agent.setServiceSyncStatus(aggregateServiceErrors(errs))
+	agent.log.Debug("Finished service sync")
+	return len(failedDirs) > 0
+}
+
+// What to do with the files of a removed service
+const (
+	// keep the existing files
+	serviceRemovalKeep = iota
+	// replace the service file with a withdrawn tombstone
+	serviceRemovalTombstone
+	// delete the files
+	serviceRemovalDelete
+)
+
+// Get what to do with the files of a removed service now.  With a
+// removal grace period, the files are kept until the service has been
+// gone for the whole period, so a service whose endpoints briefly
+// disappear is not withdrawn and re-added.  With tombstones enabled, a
+// withdrawn tombstone then replaces the service file for the tombstone
+// time before the files are deleted.  The first call for a service
+// starts the periods and schedules syncs for when they end.
+//
+// Must have service sync lock
+func (agent *HostAgent) serviceRemovalStage(uuid string) int {
+	grace := time.Duration(agent.config.ServiceRemovalGracePeriod) *
+		time.Second
+	tombstone := time.Duration(agent.config.ServiceTombstoneTime) *
+		time.Second
+	if grace <= 0 && tombstone <= 0 {
+		return serviceRemovalDelete
+	}
+	if grace < 0 {
+		grace = 0
+	}
+	if tombstone < 0 {
+		tombstone = 0
+	}
+	if agent.pendingServiceRemovals == nil {
+		agent.pendingServiceRemovals = make(map[string]time.Time)
+	}
+	removed, ok := agent.pendingServiceRemovals[uuid]
+	if !ok {
+		logger := agent.log.WithFields(logrus.Fields{"Uuid": uuid})
+		if grace > 0 {
+			logger.Info("Keeping removed service for ", grace)
+			time.AfterFunc(grace, agent.scheduleSyncServices)
+		}
+		if tombstone > 0 {
+			logger.Info("Withdrawing removed service for ", tombstone)
+			time.AfterFunc(grace+tombstone, agent.scheduleSyncServices)
+		}
+		removed = time.Now()
+		agent.pendingServiceRemovals[uuid] = removed
+	}
+
+	elapsed := time.Since(removed)
+	switch {
+	case elapsed < grace:
+		return serviceRemovalKeep
+	case elapsed < grace+tombstone:
+		return serviceRemovalTombstone
+	default:
+		return serviceRemovalDelete
+	}
+}
+
+// Forget the removed services whose files are due to be deleted, once
+// they have been.  Must have service sync lock.
+func (agent *HostAgent) prunePendingServiceRemovals() {
+	for uuid := range agent.pendingServiceRemovals {
+		if agent.serviceRemovalStage(uuid) == serviceRemovalDelete {
+			delete(agent.pendingServiceRemovals, uuid)
+		}
+	}
+}
+
+// Create the tombstone written in place of the file of a removed
+// service, with no mappings and the withdrawn flag set
+func newServiceTombstone(uuid string) *opflexService {
+	return &opflexService{
+		Uuid:            uuid,
+		ServiceMappings: make([]opflexServiceMapping, 0),
+		Withdrawn:       true,
+	}
+}
+
+// Return an error if adding a service file to a directory that already
+// has count service files would exceed the configured limit
+func (agent *HostAgent) checkServiceFileLimit(count int) error {
+	max := agent.config.OpFlexServiceMaxFiles
+	if max > 0 && count >= max {
+		return fmt.Errorf("Service directory already has the maximum "+
+			"of %d service files", max)
+	}
+	return nil
+}
+
+// Check the service file limit before writing the given service file,
+// if the file does not already exist, and count the file as written.
+//
+// Must have service sync lock
+func (agent *HostAgent) checkNewServiceFile(asfile string) error {
+	if agent.config.OpFlexServiceMaxFiles <= 0 {
+		return nil
+	}
+	if _, err := agent.fs.Stat(asfile); !os.IsNotExist(err) {
+		return nil
+	}
+	dir := filepath.Dir(asfile)
+	count, err := agent.serviceFileCount(dir)
+	if err != nil {
+		return err
+	}
+	if err := agent.checkServiceFileLimit(count); err != nil {
+		return err
+	}
+	agent.serviceFileCounts[dir] = count + 1
+	return nil
+}
+
+// Get the number of service files in a service directory, as counted
+// by the last full sync and kept up to date since, or by reading the
+// directory if it has not been counted.
+//
+// Must have service sync lock
+func (agent *HostAgent) serviceFileCount(dir string) (int, error) {
+	if count, ok := agent.serviceFileCounts[dir]; ok {
+		return count, nil
+	}
+	files, err := agent.fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".service") ||
+			strings.HasSuffix(f.Name(), ".as") {
+			count++
+		}
+	}
+	if agent.serviceFileCounts == nil {
+		agent.serviceFileCounts = make(map[string]int)
+	}
+	agent.serviceFileCounts[dir] = count
+	return count, nil
+}
+
+// Update the service file count of a directory for the removal of the
+// files of the service with the given UUID, when a limit is
+// configured.
+//
+// Must have service sync lock
+func (agent *HostAgent) serviceFileRemoved(dir string, uuid string) {
+	count, ok := agent.serviceFileCounts[dir]
+	if !ok || agent.config.OpFlexServiceMaxFiles <= 0 {
+		return
+	}
+	for _, name := range []string{uuid + ".service", uuid + ".as"} {
+		if _, err := agent.fs.Stat(filepath.Join(dir, name)); err == nil &&
+			count > 0 {
+			count--
+		}
+	}
+	agent.serviceFileCounts[dir] = count
+}
+
+// Run service file operations on up to the configured number of
+// workers at once and return the errors of the operations that
+// failed, in the order of the operations
+func (agent *HostAgent) runServiceFileOps(ops []func() error) []error {
+	results := make([]error, len(ops))
+	workers := agent.config.OpFlexServiceSyncWorkers
+	if workers > len(ops) {
+		workers = len(ops)
+	}
+	if workers <= 1 {
+		for i, op := range ops {
+			results[i] = op()
+		}
+	} else {
+		next := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					results[i] = ops[i]()
+				}
+			}()
+		}
+		for i := range ops {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+	}
+
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Combine the errors from a service sync into the error reported as
+// the sync status, or nil if there were none
+func aggregateServiceErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%v (and %d more errors)", errs[0], len(errs)-1)
+	}
+}
+
+// Write or remove the files for only the given service UUIDs.  Any
+// error falls back to a full sync, and returns true so that the sync
+// is retried.
+func (agent *HostAgent) syncDirtyServices(dirty map[string]bool) bool {
+	if len(dirty) == 0 {
+		return false
+	}
+	var errs []error
+	var ops []func() error
+
+	agent.log.Debug("Syncing changed services: ", len(dirty))
+	agent.indexMutex.Lock()
+	opflexServices := make(map[string]*opflexService)
+	for uuid := range dirty {
+		opflexServices[uuid] = agent.opflexServices[uuid]
+	}
+	agent.indexMutex.Unlock()
+
+	for uuid, as := range opflexServices {
+		logger := agent.log.WithFields(
+			logrus.Fields{"Uuid": uuid},
+		)
+		dir := agent.serviceDir(uuid)
+		asfile := filepath.Join(dir, uuid+".service")
+
+		write := as
+		remove := []string{uuid + ".as"}
+		if as == nil {
+			switch agent.serviceRemovalStage(uuid) {
+			case serviceRemovalDelete:
+				logger.Info("Removing service")
+				remove = append(remove, uuid+".service", uuid+".meta")
+				delete(agent.pendingServiceRemovals, uuid)
+				agent.serviceFileRemoved(dir, uuid)
+			case serviceRemovalTombstone:
+				write = newServiceTombstone(uuid)
+			}
+		} else if err := agent.checkNewServiceFile(asfile); err != nil {
+			agent.opflexServiceLogger(as).
+				Error("Not adding service: ", err)
+			errs = append(errs, err)
+			write = nil
+		} else {
+			delete(agent.pendingServiceRemovals, uuid)
+		}
+
+		ops = append(ops, func() error {
+			var syncErr error
+			if write != nil {
+				wrote, changes, err :=
+					agent.writeServiceFiles(asfile, write, false)
+				if err != nil {
+					agent.opflexServiceLogger(write).
+						Error("Error writing service file: ", err)
+					syncErr = err
+				} else if wrote {
+					agent.opflexServiceLogger(write).
+						WithField("changes", changes).Info("Updated service")
+				}
+			}
+			for _, name := range remove {
+				err := agent.removeServiceFile(filepath.Join(dir, name))
+				if err != nil {
+					logger.Error("Error removing service file: ", err)
+					syncErr = err
+				}
+			}
+			return syncErr
+		})
+	}
+
+	errs = append(errs, agent.runServiceFileOps(ops)...)
+	syncErr := aggregateServiceErrors(errs)
+	if syncErr != nil {
+		agent.markAllServicesDirty()
+	}
+	agent.setServiceSyncStatus(syncErr)
+	agent.log.Debug("Finished service sync")
+	return syncErr != nil
+}
+
+// Apply any per-service overrides of the external service interface
+// settings from the service annotations
+func applyServiceIfaceOverrides(ofas *opflexService, as *v1.Service) error {
+	annot := as.ObjectMeta.Annotations
+	if mac, ok := annot[metadata.ServiceMacAnnotation]; ok {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("Invalid service MAC %q: %v", mac, err)
+		}
+		ofas.ServiceMac = hw.String()
+	}
+	if ip, ok := annot[metadata.ServiceIfaceIpAnnotation]; ok {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return fmt.Errorf("Invalid service interface IP %q", ip)
+		}
+		ofas.InterfaceIp = parsed.String()
+	}
+	if name, ok := annot[metadata.ServiceIfaceNameAnnotation]; ok {
+		if name == "" {
+			return fmt.Errorf("Empty service interface name")
+		}
+		ofas.InterfaceName = name
+	}
+	if vlan, ok := annot[metadata.ServiceIfaceVlanAnnotation]; ok {
+		v, err := strconv.ParseUint(vlan, 10, 12)
+		if err != nil {
+			return fmt.Errorf("Invalid service VLAN %q: %v", vlan, err)
+		}
+		ofas.InterfaceVlan = uint16(v)
+	}
+	return nil
+}
+
+// Parse the service conntrack annotation into a map from lower-case
+// protocol name to conntrack setting.  A service-wide setting is
+// stored with an empty protocol.  Malformed entries are logged and
+// ignored so the default applies.
+func parseServiceConntrack(logger *logrus.Entry,
+	value string) map[string]bool {
+	result := make(map[string]bool)
+	if value == "" {
+		return result
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		proto := ""
+		setting := entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			proto = strings.ToLower(strings.TrimSpace(entry[:i]))
+			setting = strings.TrimSpace(entry[i+1:])
+			if proto == "" {
+				logger.Warn("Ignoring malformed conntrack setting: ", entry)
+				continue
+			}
+		}
+		enabled, err := strconv.ParseBool(setting)
+		if err != nil {
+			logger.Warn("Ignoring malformed conntrack setting: ", entry)
+			continue
+		}
+		result[proto] = enabled
+	}
+	return result
 }
 
-func (agent *HostAgent) initServiceInformerBase(listWatch *cache.ListWatch) {
-	agent.serviceInformer = cache.NewSharedIndexInformer(
-		listWatch,
-		&v1.Service{},
-		controller.NoResyncPeriodFunc(),
-		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
-	)
-	agent.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			agent.serviceChanged(obj)
-		},
-		UpdateFunc: func(_ interface{}, obj interface{}) {
-			agent.serviceChanged(obj)
-		},
-		DeleteFunc: func(obj interface{}) {
-			agent.serviceDeleted(obj)
-		},
+// Limit the next hops of a service mapping to at most max addresses.
+// The addresses kept are those with the lowest hash of the service
+// UUID and address, so the same subset is chosen on every sync while
+// different services spread their load across different backends.
+func limitNextHops(sm *opflexServiceMapping, uuid string, max int) {
+	if max <= 0 || len(sm.NextHopIps) <= max {
+		return
+	}
+
+	hashes := make(map[string]uint64, len(sm.NextHopIps))
+	for _, ip := range sm.NextHopIps {
+		h := fnv.New64a()
+		h.Write([]byte(uuid))
+		h.Write([]byte(ip))
+		hashes[ip] = h.Sum64()
+	}
+	sort.Slice(sm.NextHopIps, func(i, j int) bool {
+		hi, hj := hashes[sm.NextHopIps[i]], hashes[sm.NextHopIps[j]]
+		if hi != hj {
+			return hi < hj
+		}
+		return sm.NextHopIps[i] < sm.NextHopIps[j]
 	})
+	for _, ip := range sm.NextHopIps[max:] {
+		delete(sm.NextHopHostnames, ip)
+		delete(sm.NextHopPorts, ip)
+	}
+	sm.NextHopIps = sm.NextHopIps[:max]
+	collapseNextHopPorts(sm)
 }
 
-func getAs(asfile string) (string, error) {
-	raw, err := ioutil.ReadFile(asfile)
-	if err != nil {
-		return "", err
+// Combine mappings for the same service port whose next hops listen
+// on different ports into a single mapping with a port for each next
+// hop.  A next hop listed with more than one port keeps the first.
+func mergeNextHopPorts(mappings []*opflexServiceMapping) *opflexServiceMapping {
+	merged := *mappings[0]
+	merged.NextHopIps = make([]string, 0)
+	merged.NextHopPorts = make(map[string]uint16)
+	merged.NextHopHostnames = nil
+	for _, sm := range mappings {
+		if sm.NextHopPort < merged.NextHopPort {
+			merged.NextHopPort = sm.NextHopPort
+		}
+		for _, ip := range sm.NextHopIps {
+			if _, ok := merged.NextHopPorts[ip]; ok {
+				continue
+			}
+			merged.NextHopIps = append(merged.NextHopIps, ip)
+			merged.NextHopPorts[ip] = sm.NextHopPort
+			if hostname, ok := sm.NextHopHostnames[ip]; ok {
+				if merged.NextHopHostnames == nil {
+					merged.NextHopHostnames = make(map[string]string)
+				}
+				merged.NextHopHostnames[ip] = hostname
+			}
+		}
 	}
-	return string(raw), err
+	collapseNextHopPorts(&merged)
+	return &merged
 }
 
-func writeAs(asfile string, as *opflexService) (bool, error) {
-	newdata, err := json.MarshalIndent(as, "", "  ")
-	if err != nil {
-		return true, err
+// Drop the per next hop ports of a mapping if the remaining next hops
+// all use the same port, which becomes the next hop port
+func collapseNextHopPorts(sm *opflexServiceMapping) {
+	if sm.NextHopPorts == nil {
+		return
 	}
-	existingdata, err := ioutil.ReadFile(asfile)
-	if err == nil && reflect.DeepEqual(existingdata, newdata) {
-		return false, nil
+	first := true
+	var port uint16
+	for _, ip := range sm.NextHopIps {
+		if p := sm.NextHopPorts[ip]; first {
+			port, first = p, false
+		} else if p != port {
+			return
+		}
 	}
-
-	err = ioutil.WriteFile(asfile, newdata, 0644)
-	return true, err
+	if !first {
+		sm.NextHopPort = port
+	}
+	sm.NextHopPorts = nil
 }
 
-func serviceLogger(log *logrus.Logger, as *v1.Service) *logrus.Entry {
-	return log.WithFields(logrus.Fields{
-		"namespace": as.ObjectMeta.Namespace,
-		"name":      as.ObjectMeta.Name,
-		"type":      as.Spec.Type,
+// Sort next hop addresses numerically, IPv4 before IPv6, so that the
+// same set of endpoints always produces the same service file however
+// the endpoints list them.  Strings that are not valid addresses sort
+// last.
+func sortNextHops(ips []string) {
+	key := func(s string) (int, net.IP) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return 2, nil
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return 0, v4
+		}
+		return 1, ip
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		fi, ipi := key(ips[i])
+		fj, ipj := key(ips[j])
+		if fi != fj {
+			return fi < fj
+		}
+		if c := bytes.Compare(ipi, ipj); c != 0 {
+			return c < 0
+		}
+		return ips[i] < ips[j]
 	})
 }
 
-func opflexServiceLogger(log *logrus.Logger, as *opflexService) *logrus.Entry {
-	return log.WithFields(logrus.Fields{
-		"namespace": as.Attributes["namespace"],
-		"name":      as.Attributes["name"],
-		"uuid":      as.Uuid,
-		"tenant":    as.DomainPolicySpace,
-		"vrf":       as.DomainName,
-	})
+// Service ports of well-known connectionless UDP services
+var connectionlessUdpPorts = map[int32]bool{
+	53:  true, // DNS
+	123: true, // NTP
 }
 
-func (agent *HostAgent) syncServices() bool {
-	if !agent.syncEnabled {
+// Get the conntrack setting for a service mapping with the given
+// protocol and service port, defaulting to enabled.  With autoDisable,
+// conntrack defaults to disabled for well-known connectionless UDP
+// services.
+func serviceConntrack(settings map[string]bool, proto string,
+	port int32, autoDisable bool) bool {
+	if enabled, ok := settings[proto]; ok {
+		return enabled
+	}
+	if enabled, ok := settings[""]; ok {
+		return enabled
+	}
+	if autoDisable && proto == "udp" && connectionlessUdpPorts[port] {
 		return false
 	}
+	return true
+}
 
-	agent.log.Debug("Syncing services")
-	agent.indexMutex.Lock()
-	opflexServices := make(map[string]*opflexService)
-	for k, v := range agent.opflexServices {
-		opflexServices[k] = v
+// Get the protocol of a service or endpoint port, applying the
+// Kubernetes default of TCP when it is unspecified
+func portProtocol(proto v1.Protocol) v1.Protocol {
+	if proto == "" {
+		return v1.ProtocolTCP
 	}
-	agent.indexMutex.Unlock()
+	return proto
+}
 
-	files, err := ioutil.ReadDir(agent.config.OpFlexServiceDir)
-	if err != nil {
-		agent.log.WithFields(
-			logrus.Fields{"serviceDir": agent.config.OpFlexServiceDir},
-		).Error("Could not read directory " + err.Error())
+// Check whether the endpoint port is a target of the service port.
+// Endpoint ports are normally named after the service port they
+// serve, but an unnamed endpoint port can also be matched by number
+// against a numeric target port.
+func endpointPortMatches(sp *v1.ServicePort, p *v1.EndpointPort) bool {
+	if portProtocol(p.Protocol) != portProtocol(sp.Protocol) {
+		return false
+	}
+	if p.Name == sp.Name {
 		return true
 	}
-	seen := make(map[string]bool)
-	for _, f := range files {
-		uuid := f.Name()
-		if strings.HasSuffix(uuid, ".as") {
-			uuid = uuid[:len(uuid)-3]
-		} else if strings.HasSuffix(f.Name(), ".service") {
-			uuid = uuid[:len(uuid)-8]
-		} else {
-			continue
+	return p.Name == "" &&
+		sp.TargetPort.Type == intstr.Int &&
+		sp.TargetPort.IntVal != 0 &&
+		sp.TargetPort.IntVal == p.Port
+}
+
+// Get the external IPs of a LoadBalancer service.  All the ingress IPs
+// in the service status are used, falling back to the requested
+// LoadBalancerIP until the status is populated.
+func serviceIngressIps(as *v1.Service) []string {
+	if as.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+	var ips []string
+	for _, ingress := range as.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
 		}
+	}
+	if len(ips) == 0 && as.Spec.LoadBalancerIP != "" {
+		ips = append(ips, as.Spec.LoadBalancerIP)
+	}
 
-		asfile := filepath.Join(agent.config.OpFlexServiceDir, f.Name())
-		logger := agent.log.WithFields(
-			logrus.Fields{"Uuid": uuid},
-		)
+	// The ingress index is part of the UUID of each external service,
+	// so order the addresses canonically to give the same address the
+	// same UUID however the status lists them
+	sort.Strings(ips)
+	unique := ips[:0]
+	for i, ip := range ips {
+		if i == 0 || ip != ips[i-1] {
+			unique = append(unique, ip)
+		}
+	}
+	return unique
+}
 
-		existing, ok := opflexServices[uuid]
-		if ok {
-			wrote, err := writeAs(asfile, existing)
-			if err != nil {
-				opflexServiceLogger(agent.log, existing).
-					Error("Error writing service file: ", err)
-			} else if wrote {
-				opflexServiceLogger(agent.log, existing).Info("Updated service")
-			}
-			seen[uuid] = true
-		} else {
-			logger.Info("Removing service")
-			os.Remove(asfile)
+// Update the opflex services for a Kubernetes service.  The internal
+// service maps the cluster IP, and there is an external service for
+// each LoadBalancer ingress IP.
+//
+// Must have index lock
+func (agent *HostAgent) updateServiceDesc(external bool, as *v1.Service,
+	endpoints *v1.Endpoints) bool {
+	uid := string(as.ObjectMeta.UID)
+	if !external {
+		clusterIp := as.Spec.ClusterIP
+		if !agent.serviceIpFamilyEnabled(clusterIp) {
+			clusterIp = ""
 		}
+		return agent.updateServiceIpDesc(false, false, uid, clusterIp, as,
+			endpoints)
 	}
 
-	for _, as := range opflexServices {
-		if seen[as.Uuid] {
-			continue
+	ips := serviceIngressIps(as)
+	if len(ips) == 0 {
+		// no external IP; this withdraws any existing external
+		// service
+		ips = []string{""}
+	}
+	changed := false
+	for i, ip := range ips {
+		if !agent.serviceIpFamilyEnabled(ip) {
+			ip = ""
 		}
+		changed = agent.updateServiceIpDesc(true, false,
+			serviceIngressUuid(uid, i), ip, as, endpoints) || changed
+	}
 
-		opflexServiceLogger(agent.log, as).Info("Adding service")
-		asfile :=
-			filepath.Join(agent.config.OpFlexServiceDir, as.Uuid+".service")
-		_, err = writeAs(asfile, as)
-		if err != nil {
-			opflexServiceLogger(agent.log, as).
-				Error("Error writing service file: ", err)
+	// remove the services for ingress IPs that are gone
+	for i := len(ips); i < agent.serviceIngressCounts[uid]; i++ {
+		uuid := serviceIngressUuid(uid, i)
+		if _, ok := agent.opflexServices[uuid]; ok {
+			delete(agent.opflexServices, uuid)
+			agent.markServiceDirty(uuid)
+			changed = true
 		}
 	}
+	agent.serviceIngressCounts[uid] = len(ips)
+	return changed
+}
 
-	agent.log.Debug("Finished service sync")
-	return false
+// Check whether a next hop address is in the address family of a
+// service IP.  Addresses that do not parse are not filtered.
+func sameIpFamily(serviceIp string, ip string) bool {
+	sip, nip := net.ParseIP(serviceIp), net.ParseIP(ip)
+	if sip == nil || nip == nil {
+		return true
+	}
+	return (sip.To4() == nil) == (nip.To4() == nil)
+}
+
+// The opflex service mode used when none is configured for the type of
+// a service
+const defaultServiceMode = "loadbalancer"
+
+// Get the opflex service mode for a Kubernetes service from the
+// configured mode for its type
+func (agent *HostAgent) serviceMode(as *v1.Service) string {
+	serviceType := as.Spec.Type
+	if serviceType == "" {
+		serviceType = v1.ServiceTypeClusterIP
+	}
+	if mode, ok := agent.config.ServiceModes[string(serviceType)]; ok &&
+		mode != "" {
+		return mode
+	}
+	return defaultServiceMode
+}
+
+// Update the opflex service that maps the NodePorts of a Kubernetes
+// service on the IP address of this node in the family of the
+// service's cluster IP.
+//
+// Must have index lock
+func (agent *HostAgent) updateNodePortServiceDesc(as *v1.Service,
+	endpoints *v1.Endpoints) bool {
+	nodeIp := ""
+	if as.Spec.Type == v1.ServiceTypeNodePort ||
+		as.Spec.Type == v1.ServiceTypeLoadBalancer {
+		clusterIp := net.ParseIP(as.Spec.ClusterIP)
+		v6 := clusterIp != nil && clusterIp.To4() == nil
+		if ip := agent.nodeIp(v6); ip != nil {
+			nodeIp = ip.String()
+		}
+	}
+	return agent.updateServiceIpDesc(false, true,
+		serviceUuid(string(as.ObjectMeta.UID), serviceKindNodePort),
+		nodeIp, as, endpoints)
 }
 
+// Update the opflex service with the given UUID that maps the given
+// service IP to the endpoints of the Kubernetes service.
+//
 // Must have index lock
-func (agent *HostAgent) updateServiceDesc(external bool, as *v1.Service,
+func (agent *HostAgent) updateServiceIpDesc(external bool, nodePort bool,
+	uuid string, serviceIp string, as *v1.Service,
 	endpoints *v1.Endpoints) bool {
 	ofas := &opflexService{
-		Uuid:              string(as.ObjectMeta.UID),
+		Uuid:              uuid,
 		DomainPolicySpace: agent.config.AciVrfTenant,
 		DomainName:        agent.config.AciVrf,
-		ServiceMode:       "loadbalancer",
+		ServiceMode:       agent.serviceMode(as),
 		ServiceMappings:   make([]opflexServiceMapping, 0),
+		meta: opflexServiceMeta{
+			Namespace:       as.ObjectMeta.Namespace,
+			Name:            as.ObjectMeta.Name,
+			Uid:             string(as.ObjectMeta.UID),
+			ResourceVersion: as.ObjectMeta.ResourceVersion,
+		},
+		logLevel: as.ObjectMeta.Annotations[metadata.ServiceLogLevelAnnotation],
+
+		ExternalTrafficPolicy: string(as.Spec.ExternalTrafficPolicy),
+	}
+	if as.Spec.Type == v1.ServiceTypeLoadBalancer &&
+		as.Spec.ExternalTrafficPolicy ==
+			v1.ServiceExternalTrafficPolicyTypeLocal {
+		ofas.HealthCheckPort = uint16(as.Spec.HealthCheckNodePort)
 	}
 
 	if external {
-		if agent.config.UplinkIface == "" ||
-			agent.serviceEp.Ipv4 == nil ||
-			agent.serviceEp.Mac == "" {
-			return false
-		}
-
 		ofas.InterfaceName = agent.config.UplinkIface
 		ofas.InterfaceVlan = uint16(agent.config.ServiceVlan)
 		ofas.ServiceMac = agent.serviceEp.Mac
-		ofas.InterfaceIp = agent.serviceEp.Ipv4.String()
-		ofas.Uuid = ofas.Uuid + "-external"
+		if agent.serviceEp.Ipv4 != nil {
+			ofas.InterfaceIp = agent.serviceEp.Ipv4.String()
+		}
+
+		err := applyServiceIfaceOverrides(ofas, as)
+		if err != nil {
+			agent.serviceLogger(as).
+				Warn("Skipping external service mapping: ", err)
+			if _, ok := agent.opflexServices[ofas.Uuid]; ok {
+				delete(agent.opflexServices, ofas.Uuid)
+				agent.markServiceDirty(ofas.Uuid)
+				return true
+			}
+			return false
+		}
+
+		if ofas.InterfaceName == "" ||
+			ofas.InterfaceIp == "" ||
+			ofas.ServiceMac == "" {
+			return false
+		}
+	}
+
+	if v, ok :=
+		as.ObjectMeta.Annotations[metadata.ServicePreserveSourceIpAnnotation]; ok {
+		preserve, err := strconv.ParseBool(v)
+		if err != nil {
+			agent.serviceLogger(as).
+				Warn("Ignoring malformed preserve source IP setting: ", v)
+		}
+		ofas.PreserveSourceIp = preserve
+	}
+
+	minNextHops := agent.config.MinNextHops
+	if minNextHops < 1 {
+		minNextHops = 1
+	}
+
+	conntrack := parseServiceConntrack(agent.serviceLogger(as),
+		as.ObjectMeta.Annotations[metadata.ServiceConntrackAnnotation])
+	stateSync := false
+	if v, ok :=
+		as.ObjectMeta.Annotations[metadata.ServiceConntrackStateSyncAnnotation]; ok {
+		var err error
+		stateSync, err = strconv.ParseBool(v)
+		if err != nil {
+			agent.serviceLogger(as).
+				Warn("Ignoring malformed conntrack state sync setting: ", v)
+		}
 	}
+	id := fmt.Sprintf("%s_%s", as.ObjectMeta.Namespace, as.ObjectMeta.Name)
 
 	hasValidMapping := false
 	for _, sp := range as.Spec.Ports {
+		servicePort := sp.Port
+		if nodePort {
+			if sp.NodePort == 0 {
+				continue
+			}
+			servicePort = sp.NodePort
+		}
+
+		// Endpoints may be split across subsets; combine all the
+		// next hops for each target port into a single mapping, and
+		// mappings for different target ports into one mapping with
+		// per next hop ports
+		var mappings []*opflexServiceMapping
+		byPort := make(map[int32]*opflexServiceMapping)
+		seen := make(map[int32]map[string]bool)
 		for _, e := range endpoints.Subsets {
 			for _, p := range e.Ports {
-				if p.Protocol != sp.Protocol {
-					continue
-				}
-				if p.Name != sp.Name {
+				if !endpointPortMatches(&sp, &p) {
 					continue
 				}
 
-				sm := &opflexServiceMapping{
-					ServicePort:  uint16(sp.Port),
-					ServiceProto: strings.ToLower(string(sp.Protocol)),
-					NextHopIps:   make([]string, 0),
-					NextHopPort:  uint16(p.Port),
-					Conntrack:    true,
-				}
-
-				if external {
-					if as.Spec.Type == v1.ServiceTypeLoadBalancer &&
-						len(as.Status.LoadBalancer.Ingress) > 0 {
-						sm.ServiceIp = as.Status.LoadBalancer.Ingress[0].IP
+				sm, ok := byPort[p.Port]
+				if !ok {
+					proto :=
+						strings.ToLower(string(portProtocol(sp.Protocol)))
+					sm = &opflexServiceMapping{
+						ServicePort:  uint16(servicePort),
+						ServiceProto: proto,
+						NextHopIps:   make([]string, 0),
+						NextHopPort:  uint16(p.Port),
+						Conntrack: serviceConntrack(conntrack, proto,
+							sp.Port, agent.config.AutoDisableUdpConntrack),
+						ConntrackStateSync: stateSync,
+					}
+					if sp.Name != "" {
+						sm.Attributes = map[string]string{
+							"service-name": id + "_" + sp.Name,
+						}
 					}
-				} else {
-					sm.ServiceIp = as.Spec.ClusterIP
+
+					sm.ServiceIp = serviceIp
+
+					byPort[p.Port] = sm
+					seen[p.Port] = make(map[string]bool)
+					mappings = append(mappings, sm)
 				}
 
 				for _, a := range e.Addresses {
+					if seen[p.Port][a.IP] {
+						continue
+					}
+					if agent.config.ServiceIpFamilies != "" &&
+						!sameIpFamily(serviceIp, a.IP) {
+						continue
+					}
 					if !external ||
 						(a.NodeName != nil && *a.NodeName == agent.config.NodeName) {
+						seen[p.Port][a.IP] = true
 						sm.NextHopIps = append(sm.NextHopIps, a.IP)
+						if a.Hostname != "" {
+							if sm.NextHopHostnames == nil {
+								sm.NextHopHostnames = make(map[string]string)
+							}
+							sm.NextHopHostnames[a.IP] = a.Hostname
+						}
 					}
 				}
-				if sm.ServiceIp != "" && len(sm.NextHopIps) > 0 {
-					hasValidMapping = true
-				}
-				ofas.ServiceMappings = append(ofas.ServiceMappings, *sm)
 			}
 		}
+
+		if len(mappings) > 1 {
+			mappings = []*opflexServiceMapping{mergeNextHopPorts(mappings)}
+		}
+		for _, sm := range mappings {
+			limitNextHops(sm, ofas.Uuid, agent.config.MaxNextHops)
+			sortNextHops(sm.NextHopIps)
+			ofas.ServiceMappings = append(ofas.ServiceMappings, *sm)
+		}
+	}
+	sort.Sort(serviceMappingSlice(ofas.ServiceMappings))
+	ofas.ServiceMappings = dedupServiceMappings(agent.serviceLogger(as),
+		ofas.ServiceMappings)
+	for _, sm := range ofas.ServiceMappings {
+		if sm.ServiceIp != "" && len(sm.NextHopIps) >= minNextHops {
+			hasValidMapping = true
+		}
 	}
 
-	id := fmt.Sprintf("%s_%s", as.ObjectMeta.Namespace, as.ObjectMeta.Name)
-	ofas.Attributes = as.ObjectMeta.Labels
-	if ofas.Attributes == nil {
-		ofas.Attributes = make(map[string]string)
+	// Copy the labels, since the attributes added below must not
+	// end up in the cached service object
+	ofas.Attributes = make(map[string]string, len(as.ObjectMeta.Labels))
+	for k, v := range as.ObjectMeta.Labels {
+		ofas.Attributes[k] = v
 	}
 	ofas.Attributes["namespace"] = as.ObjectMeta.Namespace
 	ofas.Attributes["name"] = as.ObjectMeta.Name
 	ofas.Attributes["service-name"] = id
+	agent.addNamespaceAttributes(ofas.Attributes, as.ObjectMeta.Namespace)
 
 	existing, ok := agent.opflexServices[ofas.Uuid]
 	if hasValidMapping {
-		if (ok && !reflect.DeepEqual(existing, ofas)) || !ok {
+		if !ok || !sameServiceFile(existing, ofas) {
 			agent.opflexServices[ofas.Uuid] = ofas
+			agent.markServiceDirty(ofas.Uuid)
 			return true
 		}
+		// only the source object metadata or the log level changed;
+		// the meta file catches up at the next write or full sync
+		agent.opflexServices[ofas.Uuid] = ofas
 	} else {
 		if ok {
 			delete(agent.opflexServices, ofas.Uuid)
+			agent.markServiceDirty(ofas.Uuid)
+			if agent.serviceInvalidHook != nil {
+				agent.invalidServices = append(agent.invalidServices,
+					invalidService{
+						uuid: ofas.Uuid,
+						name: as.ObjectMeta.Namespace + "/" +
+							as.ObjectMeta.Name,
+					})
+			}
 			return true
 		}
 	}
@@ -332,6 +1837,43 @@ func (agent *HostAgent) updateServiceDesc(external bool, as *v1.Service,
 	return false
 }
 
+// Check whether two opflex services have the same service file,
+// ignoring the source object metadata and the log level
+func sameServiceFile(a *opflexService, b *opflexService) bool {
+	ac, bc := *a, *b
+	ac.meta, bc.meta = opflexServiceMeta{}, opflexServiceMeta{}
+	ac.logLevel, bc.logLevel = "", ""
+	return reflect.DeepEqual(&ac, &bc)
+}
+
+// An opflex service whose mapping was withdrawn
+type invalidService struct {
+	uuid string
+	name string
+}
+
+// Report the opflex services withdrawn since the last call to the
+// service invalid hook.  Must not have index lock.
+func (agent *HostAgent) notifyInvalidServices() {
+	agent.indexMutex.Lock()
+	hook := agent.serviceInvalidHook
+	invalid := agent.invalidServices
+	agent.invalidServices = nil
+	agent.indexMutex.Unlock()
+
+	if hook == nil {
+		return
+	}
+	for _, s := range invalid {
+		hook(s.uuid, s.name)
+	}
+}
+
+// Next hops come only from the Endpoints object for the service.  The
+// vendored Kubernetes API (release-1.10) predates EndpointSlice, so
+// there is no slice source to consult until the client libraries are
+// updated.
+//
 // must have index lock
 func (agent *HostAgent) doUpdateService(key string) {
 	endpointsobj, exists, err :=
@@ -360,13 +1902,16 @@ func (agent *HostAgent) doUpdateService(key string) {
 	doSync := false
 	doSync = agent.updateServiceDesc(false, as, endpoints) || doSync
 	doSync = agent.updateServiceDesc(true, as, endpoints) || doSync
+	doSync = agent.updateNodePortServiceDesc(as, endpoints) || doSync
 	if doSync {
-		agent.scheduleSyncServices()
+		agent.serviceChanges[key]++
+		agent.scheduleSyncDirtyServices()
 	}
 }
 
 func (agent *HostAgent) endpointsChanged(obj interface{}) {
 	agent.indexMutex.Lock()
+	defer agent.notifyInvalidServices()
 	defer agent.indexMutex.Unlock()
 
 	endpoints := obj.(*v1.Endpoints)
@@ -381,13 +1926,14 @@ func (agent *HostAgent) endpointsChanged(obj interface{}) {
 
 func (agent *HostAgent) serviceChanged(obj interface{}) {
 	agent.indexMutex.Lock()
+	defer agent.notifyInvalidServices()
 	defer agent.indexMutex.Unlock()
 
 	as := obj.(*v1.Service)
 
 	key, err := cache.MetaNamespaceKeyFunc(as)
 	if err != nil {
-		serviceLogger(agent.log, as).
+		agent.serviceLogger(as).
 			Error("Could not create key:" + err.Error())
 		return
 	}
@@ -395,20 +1941,178 @@ func (agent *HostAgent) serviceChanged(obj interface{}) {
 	agent.doUpdateService(key)
 }
 
+// Remove the opflex services derived from the Kubernetes service with
+// the given namespace and name.  Used when the service UID is not
+// known.  Must have index lock.
+func (agent *HostAgent) deleteServicesByName(namespace string,
+	name string) bool {
+	deleted := false
+	for uuid, as := range agent.opflexServices {
+		if as.Attributes["namespace"] == namespace &&
+			as.Attributes["name"] == name {
+			delete(agent.opflexServices, uuid)
+			delete(agent.serviceIngressCounts, as.meta.Uid)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
 func (agent *HostAgent) serviceDeleted(obj interface{}) {
 	agent.indexMutex.Lock()
 	defer agent.indexMutex.Unlock()
 
-	as := obj.(*v1.Service)
+	as, ok := obj.(*v1.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			agent.log.Error("Received unexpected object: ", obj)
+			return
+		}
+		as, ok = tombstone.Obj.(*v1.Service)
+		if !ok {
+			namespace, name, err :=
+				cache.SplitMetaNamespaceKey(tombstone.Key)
+			if err != nil {
+				agent.log.Error("Could not parse key: ", err)
+				return
+			}
+			delete(agent.serviceChanges, tombstone.Key)
+			if agent.deleteServicesByName(namespace, name) {
+				agent.scheduleSyncServices()
+			}
+			return
+		}
+	}
+
+	if key, err := cache.MetaNamespaceKeyFunc(as); err == nil {
+		delete(agent.serviceChanges, key)
+	}
 
-	u := string(as.ObjectMeta.UID)
-	if _, ok := agent.opflexServices[u]; ok {
-		delete(agent.opflexServices, u)
-		delete(agent.opflexServices, u+"-external")
+	delete(agent.serviceIngressCounts, string(as.ObjectMeta.UID))
+	uids := map[string]bool{string(as.ObjectMeta.UID): true}
+	deleted := false
+	for uuid := range agent.opflexServices {
+		if serviceUuidKnown(uids, uuid) {
+			delete(agent.opflexServices, uuid)
+			deleted = true
+		}
+	}
+	if !deleted {
+		deleted = agent.deleteServicesByName(as.ObjectMeta.Namespace,
+			as.ObjectMeta.Name)
+	}
+	if deleted {
 		agent.scheduleSyncServices()
 	}
 }
 
+// Check whether the opflex service UUID was derived from one of the
+// given Kubernetes service UIDs
+func serviceUuidKnown(uids map[string]bool, uuid string) bool {
+	if i := strings.LastIndex(uuid, serviceUuidExternal+"-"); i > 0 {
+		if _, ok := serviceIngressIndex(uuid[:i], uuid); ok && uids[uuid[:i]] {
+			return true
+		}
+	}
+	for _, suffix := range serviceUuidSuffixes {
+		if strings.HasSuffix(uuid, suffix) &&
+			uids[strings.TrimSuffix(uuid, suffix)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Re-derive all services from the informer caches, dropping any that
+// no longer exist, and rewrite the service directory to correct any
+// drift
+func (agent *HostAgent) resyncServices() {
+	if agent.serviceInformer == nil {
+		return
+	}
+
+	agent.log.Debug("Resyncing all services")
+	agent.indexMutex.Lock()
+	uids := make(map[string]bool)
+	for _, obj := range agent.serviceInformer.GetStore().List() {
+		as := obj.(*v1.Service)
+		uids[string(as.ObjectMeta.UID)] = true
+
+		key, err := cache.MetaNamespaceKeyFunc(as)
+		if err != nil {
+			agent.serviceLogger(as).
+				Error("Could not create key:" + err.Error())
+			continue
+		}
+		agent.doUpdateService(key)
+	}
+	for uuid := range agent.opflexServices {
+		if !serviceUuidKnown(uids, uuid) {
+			delete(agent.opflexServices, uuid)
+		}
+	}
+	for uid := range agent.serviceIngressCounts {
+		if !uids[uid] {
+			delete(agent.serviceIngressCounts, uid)
+		}
+	}
+	agent.indexMutex.Unlock()
+
+	agent.notifyInvalidServices()
+	agent.scheduleSyncServices()
+}
+
+// Prefix of the service attributes copied from namespace labels
+const namespaceLabelAttributePrefix = "namespace-label:"
+
+// Add the configured labels of the namespace to service attributes
+func (agent *HostAgent) addNamespaceAttributes(attributes map[string]string,
+	namespace string) {
+	if agent.config.ServiceNamespaceLabels == "" || agent.nsInformer == nil {
+		return
+	}
+	nsobj, exists, err := agent.nsInformer.GetIndexer().GetByKey(namespace)
+	if err != nil {
+		agent.log.Error("Could not lookup namespace " +
+			namespace + ": " + err.Error())
+		return
+	}
+	if !exists || nsobj == nil {
+		return
+	}
+	ns := nsobj.(*v1.Namespace)
+	for _, key := range strings.Split(agent.config.ServiceNamespaceLabels, ",") {
+		key = strings.TrimSpace(key)
+		if value, ok := ns.ObjectMeta.Labels[key]; ok && key != "" {
+			attributes[namespaceLabelAttributePrefix+key] = value
+		}
+	}
+}
+
+// Update the services in the namespace after a change to the labels
+// of the namespace that the service attributes may include
+func (agent *HostAgent) updateServicesForNamespace(namespace string) {
+	if agent.config.ServiceNamespaceLabels == "" ||
+		agent.serviceInformer == nil {
+		return
+	}
+	var keys []string
+	cache.ListAllByNamespace(agent.serviceInformer.GetIndexer(), namespace,
+		labels.Everything(), func(obj interface{}) {
+			if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+				keys = append(keys, key)
+			}
+		})
+
+	agent.indexMutex.Lock()
+	defer agent.notifyInvalidServices()
+	defer agent.indexMutex.Unlock()
+	for _, key := range keys {
+		agent.doUpdateService(key)
+	}
+}
+
 func (agent *HostAgent) updateAllServices() {
 	if agent.serviceInformer == nil {
 		return
@@ -423,6 +2127,7 @@ func (agent *HostAgent) updateAllServices() {
 	}
 
 	agent.indexMutex.Lock()
+	defer agent.notifyInvalidServices()
 	defer agent.indexMutex.Unlock()
 	for _, key := range keys {
 		agent.doUpdateService(key)
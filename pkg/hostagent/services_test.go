@@ -16,16 +16,26 @@ package hostagent
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/noironetworks/aci-containers/pkg/metadata"
 	tu "github.com/noironetworks/aci-containers/pkg/testutil"
@@ -131,6 +141,36 @@ var serviceTests = []serviceTest{
 	},
 }
 
+// The service endpoint used by tests that check external service
+// files
+var testServiceEp = metadata.ServiceEndpoint{
+	Mac:  "76:47:db:97:ba:4c",
+	Ipv4: net.ParseIP("10.6.0.1"),
+}
+
+func (st *serviceTest) service() *v1.Service {
+	return service(st.uuid, st.namespace, st.name,
+		st.clusterIp, st.externalIp, st.ports)
+}
+
+func (st *serviceTest) endpoints() *v1.Endpoints {
+	return endpoints(st.namespace, st.name, st.nextHopIps, st.ports)
+}
+
+// newSyncTestAgent returns a test agent that syncs services into a new
+// temporary directory, which the caller is responsible for removing
+func newSyncTestAgent(t *testing.T) (*testHostAgent, string) {
+	tempdir, err := ioutil.TempDir("", "hostagent_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := testAgent()
+	agent.config.OpFlexServiceDir = tempdir
+	agent.syncEnabled = true
+	return agent, tempdir
+}
+
 func (agent *testHostAgent) checkAs(t *testing.T, st *serviceTest,
 	as *opflexService, desc string) {
 	assert.Equal(t, agent.config.AciVrfTenant, as.DomainPolicySpace,
@@ -236,17 +276,15 @@ func TestServiceSync(t *testing.T) {
 				[]byte("random gibberish"), 0644)
 		}
 
-		service := service(st.uuid, st.namespace, st.name,
-			st.clusterIp, st.externalIp, st.ports)
-		endpoints := endpoints(st.namespace, st.name, st.nextHopIps, st.ports)
+		service := st.service()
+		endpoints := st.endpoints()
 		agent.fakeServiceSource.Add(service)
 		agent.fakeEndpointsSource.Add(endpoints)
 		agent.doTestService(t, tempdir, &st, "create")
 	}
 
 	for _, st := range serviceTests {
-		service := service(st.uuid, st.namespace, st.name,
-			st.clusterIp, st.externalIp, st.ports)
+		service := st.service()
 		agent.fakeServiceSource.Delete(service)
 
 		tu.WaitFor(t, st.name, 100*time.Millisecond,
@@ -274,3 +312,2107 @@ func TestServiceSync(t *testing.T) {
 
 	agent.stop()
 }
+
+func TestServiceIfaceOverride(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "hostagent_test_")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	agent := testAgent()
+	agent.config.NodeName = "test-node"
+	agent.config.OpFlexEndpointDir = tempdir
+	agent.config.OpFlexServiceDir = tempdir
+	agent.config.UplinkIface = "eth42"
+	agent.config.ServiceVlan = 4003
+	agent.config.AciVrf = "kubernetes-vrf"
+	agent.config.AciVrfTenant = "common"
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-node",
+			Annotations: map[string]string{
+				metadata.ServiceEpAnnotation: "{\"mac\": \"76:47:db:97:ba:4c\", \"ipv4\": \"10.6.0.1\"}",
+			},
+		},
+	}
+	agent.fakeNodeSource.Add(node)
+
+	agent.run()
+
+	st := &serviceTests[0]
+	s := st.service()
+	s.ObjectMeta.Annotations[metadata.ServiceMacAnnotation] =
+		"0a:58:0a:07:00:01"
+	s.ObjectMeta.Annotations[metadata.ServiceIfaceIpAnnotation] = "10.7.0.1"
+	s.ObjectMeta.Annotations[metadata.ServiceIfaceNameAnnotation] = "eth43"
+	s.ObjectMeta.Annotations[metadata.ServiceIfaceVlanAnnotation] = "4004"
+	agent.fakeServiceSource.Add(s)
+	agent.fakeEndpointsSource.Add(st.endpoints())
+
+	asfile := filepath.Join(tempdir, st.uuid+"-external.service")
+	asexternal := &opflexService{}
+	tu.WaitFor(t, "override", 500*time.Millisecond,
+		func(last bool) (bool, error) {
+			raw, err := ioutil.ReadFile(asfile)
+			if !tu.WaitNil(t, last, err, "read service") {
+				return false, nil
+			}
+			err = json.Unmarshal(raw, asexternal)
+			if !tu.WaitNil(t, last, err, "unmarshal service") {
+				return false, nil
+			}
+			return tu.WaitEqual(t, last, "eth43", asexternal.InterfaceName,
+				"interface-name"), nil
+		})
+	assert.Equal(t, "0a:58:0a:07:00:01", asexternal.ServiceMac, "service-mac")
+	assert.Equal(t, "10.7.0.1", asexternal.InterfaceIp, "interface-ip")
+	assert.Equal(t, uint16(4004), asexternal.InterfaceVlan, "interface-vlan")
+
+	s = st.service()
+	s.ObjectMeta.Annotations[metadata.ServiceMacAnnotation] = "not-a-mac"
+	agent.fakeServiceSource.Modify(s)
+
+	tu.WaitFor(t, "invalid override", 500*time.Millisecond,
+		func(last bool) (bool, error) {
+			_, err := ioutil.ReadFile(asfile)
+			return tu.WaitNotNil(t, last, err, "read external service"), nil
+		})
+	_, err = ioutil.ReadFile(filepath.Join(tempdir, st.uuid+".service"))
+	assert.Nil(t, err, "read service")
+
+	agent.stop()
+}
+
+func TestRetryServiceDirOp(t *testing.T) {
+	agent := testAgent()
+	agent.config.OpFlexServiceDirRetries = 3
+	agent.config.OpFlexServiceDirRetryDelay = 1
+
+	// fake filesystem operation that fails transiently before
+	// succeeding
+	failing := func(failures int) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= failures {
+				return errors.New("resource temporarily unavailable")
+			}
+			return nil
+		}, &calls
+	}
+
+	op, calls := failing(2)
+	assert.Nil(t, agent.retryServiceDirOp(op), "transient")
+	assert.Equal(t, 3, *calls, "transient calls")
+
+	op, calls = failing(10)
+	assert.NotNil(t, agent.retryServiceDirOp(op), "persistent")
+	assert.Equal(t, 4, *calls, "persistent calls")
+
+	agent.config.OpFlexServiceDirRetries = 0
+	op, calls = failing(1)
+	assert.NotNil(t, agent.retryServiceDirOp(op), "no retries")
+	assert.Equal(t, 1, *calls, "no retries calls")
+}
+
+func TestServiceDeleteDerived(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	st := &serviceTests[0]
+	uuids := []string{
+		serviceUuid(st.uuid, serviceKindCluster),
+		serviceUuid(st.uuid, serviceKindExternal),
+		serviceUuid(st.uuid, serviceKindNodePort),
+		serviceIngressUuid(st.uuid, 1),
+	}
+	for _, uuid := range uuids {
+		agent.opflexServices[uuid] = &opflexService{
+			Uuid:            uuid,
+			ServiceMappings: make([]opflexServiceMapping, 0),
+		}
+	}
+	agent.syncServices()
+	for _, uuid := range uuids {
+		_, err := os.Stat(filepath.Join(tempdir, uuid+".service"))
+		assert.Nil(t, err, "create", uuid)
+	}
+
+	agent.serviceDeleted(st.service())
+	assert.Equal(t, 0, len(agent.opflexServices), "opflex services")
+
+	agent.syncServices()
+	for _, uuid := range uuids {
+		_, err := os.Stat(filepath.Join(tempdir, uuid+".service"))
+		assert.True(t, os.IsNotExist(err), "delete", uuid)
+	}
+}
+
+func TestServiceMetaFile(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.ObjectMeta.ResourceVersion = "42"
+	agent.updateServiceDesc(false, s, st.endpoints())
+	agent.syncServices()
+
+	asfile := filepath.Join(tempdir, st.uuid+".service")
+	metafile := filepath.Join(tempdir, st.uuid+".meta")
+	_, err := os.Stat(asfile)
+	assert.Nil(t, err, "create service")
+	raw, err := ioutil.ReadFile(metafile)
+	if assert.Nil(t, err, "create meta") {
+		meta := &opflexServiceMeta{}
+		assert.Nil(t, json.Unmarshal(raw, meta), "unmarshal meta")
+		assert.Equal(t, &opflexServiceMeta{
+			Namespace:       st.namespace,
+			Name:            st.name,
+			Uid:             st.uuid,
+			ResourceVersion: "42",
+		}, meta, "meta")
+	}
+	_, err = os.Stat(filepath.Join(tempdir, "."+st.uuid+".meta.tmp"))
+	assert.True(t, os.IsNotExist(err), "temporary meta")
+
+	// a new resource version alone does not change the service
+	s.ObjectMeta.ResourceVersion = "43"
+	assert.False(t, agent.updateServiceDesc(false, s, st.endpoints()),
+		"resource version")
+	dirty, _ := agent.takeDirtyServices()
+	assert.Empty(t, dirty, "resource version")
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	raw, err = ioutil.ReadFile(metafile)
+	if assert.Nil(t, err, "update meta") {
+		assert.Contains(t, string(raw), `"43"`, "update meta")
+	}
+
+	agent.serviceDeleted(s)
+	agent.syncServices()
+	_, err = os.Stat(asfile)
+	assert.True(t, os.IsNotExist(err), "delete service")
+	_, err = os.Stat(metafile)
+	assert.True(t, os.IsNotExist(err), "delete meta")
+}
+
+func TestServiceFsync(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	recorder := &syncRecorder{fileSystem: agent.fs}
+	agent.fs = recorder
+
+	st := &serviceTests[1]
+	s := st.service()
+	agent.updateServiceDesc(false, s, st.endpoints())
+	agent.syncServices()
+	assert.Empty(t, recorder.synced, "disabled")
+
+	agent.config.Fsync = true
+	agent.ForceServiceRewrite()
+	agent.syncServices()
+	assert.Equal(t, []string{
+		"." + st.uuid + ".service.tmp", filepath.Base(tempdir),
+		"." + st.uuid + ".meta.tmp", filepath.Base(tempdir),
+	}, recorder.synced, "enabled")
+
+	raw, err := ioutil.ReadFile(filepath.Join(tempdir, st.uuid+".service"))
+	if assert.Nil(t, err, "read") {
+		expected, _ := marshalService(agent.opflexServices[st.uuid])
+		assert.Equal(t, string(expected), string(raw), "contents")
+	}
+
+	// a temporary file left by a crash is removed by a full sync
+	leftover := filepath.Join(tempdir, "."+st.uuid+".service.tmp")
+	assert.Nil(t, ioutil.WriteFile(leftover, []byte("{"), 0644), "leftover")
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err), "leftover removed")
+}
+
+func TestServiceChangeWritesOnlyItsFile(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	st := &serviceTests[1]
+	update := func(uuid string, name string, nextHopIps []string) {
+		s := service(uuid, st.namespace, name, st.clusterIp, "", st.ports)
+		s.Spec.Type = v1.ServiceTypeClusterIP
+		agent.serviceInformer.GetStore().Add(s)
+		agent.endpointsInformer.GetStore().Add(
+			endpoints(st.namespace, name, nextHopIps, st.ports))
+		agent.serviceChanged(s)
+	}
+	var uuids []string
+	for i := 0; i < 10; i++ {
+		uuid := fmt.Sprintf("683c333d-a594-4f00-baa6-0d578a13d8%02d", i)
+		uuids = append(uuids, uuid)
+		update(uuid, fmt.Sprintf("service%d", i), st.nextHopIps)
+	}
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync")
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, uuid := range uuids {
+		for _, suffix := range []string{".service", ".meta"} {
+			os.Chtimes(filepath.Join(tempdir, uuid+suffix), old, old)
+		}
+	}
+
+	recorder := &writeRecorder{fileSystem: agent.fs}
+	agent.fs = recorder
+
+	// an update with no change writes nothing
+	update(uuids[3], "service3", st.nextHopIps)
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync unchanged")
+	assert.Empty(t, recorder.take(), "unchanged")
+
+	// a change writes only its own service file
+	update(uuids[5], "service5", []string{"10.9.9.9"})
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync change")
+	written := recorder.take()
+	assert.Contains(t, written, uuids[5]+".service", "changed")
+	for _, name := range written {
+		assert.Contains(t, name, uuids[5]+".service", "changed")
+	}
+
+	for _, uuid := range uuids {
+		info, err := os.Stat(filepath.Join(tempdir, uuid+".service"))
+		if !assert.Nil(t, err, uuid) {
+			continue
+		}
+		assert.Equal(t, uuid != uuids[5], info.ModTime().Equal(old),
+			"mtime", uuid)
+		info, err = os.Stat(filepath.Join(tempdir, uuid+".meta"))
+		if assert.Nil(t, err, uuid) {
+			assert.True(t, info.ModTime().Equal(old), "meta mtime", uuid)
+		}
+	}
+
+	// nor does a full sync touch the unchanged files
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	for _, uuid := range uuids[:5] {
+		info, err := os.Stat(filepath.Join(tempdir, uuid+".service"))
+		if assert.Nil(t, err, uuid) {
+			assert.True(t, info.ModTime().Equal(old), "full sync", uuid)
+		}
+	}
+}
+
+func TestServiceForceRewrite(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	for _, st := range serviceTests {
+		agent.updateServiceDesc(false, st.service(), st.endpoints())
+	}
+	agent.syncServices()
+
+	// one file has an outdated format and the other is current but
+	// old
+	stale := filepath.Join(tempdir, serviceTests[0].uuid+".service")
+	current := filepath.Join(tempdir, serviceTests[1].uuid+".service")
+	ioutil.WriteFile(stale, []byte(`{"uuid": "old-format"}`), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(current, old, old)
+
+	agent.ForceServiceRewrite()
+	assert.True(t, agent.forceServiceRewrite, "pending")
+	agent.syncServices()
+	assert.False(t, agent.forceServiceRewrite, "one-shot")
+
+	for _, st := range serviceTests {
+		asfile := filepath.Join(tempdir, st.uuid+".service")
+		raw, err := ioutil.ReadFile(asfile)
+		if !assert.Nil(t, err, "read", st.name) {
+			continue
+		}
+		expected, _ := marshalService(agent.opflexServices[st.uuid])
+		assert.Equal(t, string(expected), string(raw), "contents", st.name)
+	}
+	info, err := os.Stat(current)
+	if assert.Nil(t, err, "stat") {
+		assert.True(t, info.ModTime().After(old), "rewritten")
+	}
+}
+
+func TestServiceConcurrentSync(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				agent.syncServices()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			for _, st := range serviceTests {
+				agent.indexMutex.Lock()
+				agent.updateServiceDesc(false, st.service(),
+					endpoints(st.namespace, st.name,
+						[]string{fmt.Sprintf("10.7.0.%d", j+1)}, st.ports))
+				agent.indexMutex.Unlock()
+			}
+		}
+	}()
+	wg.Wait()
+	agent.syncServices()
+
+	files, err := ioutil.ReadDir(tempdir)
+	if !assert.Nil(t, err, "read dir") {
+		return
+	}
+	// a service file and a meta file for each service
+	assert.Equal(t, 2*len(serviceTests), len(files), "files")
+	for _, st := range serviceTests {
+		raw, err := ioutil.ReadFile(filepath.Join(tempdir,
+			st.uuid+".service"))
+		if !assert.Nil(t, err, "read", st.name) {
+			continue
+		}
+		expected, _ := marshalService(agent.opflexServices[st.uuid])
+		assert.Equal(t, string(expected), string(raw), "contents", st.name)
+	}
+}
+
+func TestServiceMaxFiles(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	agent.config.OpFlexServiceMaxFiles = 1
+
+	first, second := &serviceTests[0], &serviceTests[1]
+	agent.updateServiceDesc(false, first.service(), first.endpoints())
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "under limit")
+
+	// the changed-service path refuses the new file
+	agent.updateServiceDesc(false, second.service(), second.endpoints())
+	agent.syncServices()
+	if assert.NotNil(t, agent.serviceSyncErr, "over limit") {
+		assert.Contains(t, agent.serviceSyncErr.Error(),
+			"maximum of 1 service files", "over limit")
+	}
+	_, err := os.Stat(filepath.Join(tempdir, second.uuid+".service"))
+	assert.True(t, os.IsNotExist(err), "not created")
+	_, ok := agent.opflexServices[second.uuid]
+	assert.True(t, ok, "in memory")
+
+	// so does the full sync it falls back to
+	agent.syncServices()
+	assert.NotNil(t, agent.serviceSyncErr, "full sync")
+	_, err = os.Stat(filepath.Join(tempdir, second.uuid+".service"))
+	assert.True(t, os.IsNotExist(err), "full sync")
+
+	// existing files are still updated
+	agent.updateServiceDesc(false, first.service(),
+		endpoints(first.namespace, first.name, []string{"10.9.9.9"},
+			first.ports))
+	agent.syncServices()
+	raw, err := ioutil.ReadFile(filepath.Join(tempdir, first.uuid+".service"))
+	if assert.Nil(t, err, "update") {
+		assert.Contains(t, string(raw), "10.9.9.9", "update")
+	}
+
+	agent.config.OpFlexServiceMaxFiles = 0
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "no limit")
+	_, err = os.Stat(filepath.Join(tempdir, second.uuid+".service"))
+	assert.Nil(t, err, "no limit")
+
+	// removing a service makes room on the changed-service path
+	agent.config.OpFlexServiceMaxFiles = 2
+	agent.serviceDeleted(first.service())
+	agent.syncServices()
+	third := "683c333d-a594-4f00-baa6-0d578a13d83c"
+	agent.updateServiceDesc(false,
+		service(third, second.namespace, "third", second.clusterIp, "",
+			second.ports),
+		endpoints(second.namespace, "third", second.nextHopIps,
+			second.ports))
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "room")
+	_, err = os.Stat(filepath.Join(tempdir, third+".service"))
+	assert.Nil(t, err, "room")
+}
+
+func TestServiceRemovalGracePeriod(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	agent.config.ServiceRemovalGracePeriod = 60
+
+	st := &serviceTests[1]
+	asfile := filepath.Join(tempdir, st.uuid+".service")
+	update := func(nextHopIps []string) {
+		agent.updateServiceDesc(false, st.service(),
+			endpoints(st.namespace, st.name, nextHopIps, st.ports))
+		agent.syncServices()
+	}
+
+	update(st.nextHopIps)
+	_, err := os.Stat(asfile)
+	assert.Nil(t, err, "created")
+
+	// the endpoints drain, but the file is kept
+	update(nil)
+	_, ok := agent.opflexServices[st.uuid]
+	assert.False(t, ok, "removed from memory")
+	_, err = os.Stat(asfile)
+	assert.Nil(t, err, "kept")
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	_, err = os.Stat(asfile)
+	assert.Nil(t, err, "kept on full sync")
+
+	// the service comes back within the grace period
+	update([]string{"10.9.9.9"})
+	raw, err := ioutil.ReadFile(asfile)
+	if assert.Nil(t, err, "returned") {
+		assert.Contains(t, string(raw), "10.9.9.9", "returned")
+	}
+	_, ok = agent.pendingServiceRemovals[st.uuid]
+	assert.False(t, ok, "no longer pending")
+
+	// and is removed once the grace period ends
+	update(nil)
+	_, err = os.Stat(asfile)
+	assert.Nil(t, err, "kept again")
+	agent.pendingServiceRemovals[st.uuid] = time.Now().Add(-time.Hour)
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	_, err = os.Stat(asfile)
+	assert.True(t, os.IsNotExist(err), "removed")
+	_, err = os.Stat(filepath.Join(tempdir, st.uuid+".meta"))
+	assert.True(t, os.IsNotExist(err), "meta removed")
+	assert.Len(t, agent.pendingServiceRemovals, 0, "pruned")
+}
+
+func TestServiceFileVersion(t *testing.T) {
+	fs := newMemFileSystem()
+	fs.MkdirAll("/services", 0755)
+	agent := testAgent()
+	agent.fs = fs
+	agent.config.OpFlexServiceDir = "/services"
+	agent.config.ServiceRemovalGracePeriod = 60
+	agent.syncEnabled = true
+
+	current, removed := &serviceTests[1], &serviceTests[0]
+	agent.updateServiceDesc(false, current.service(), current.endpoints())
+	as := agent.opflexServices[current.uuid]
+
+	// files written before the format was versioned
+	v0, _ := json.MarshalIndent(as, "", "  ")
+	assert.NotContains(t, string(v0), "version", "v0")
+	asfile := "/services/" + current.uuid + ".service"
+	fs.WriteFile(asfile, v0, 0644)
+	removedfile := "/services/" + removed.uuid + ".service"
+	fs.WriteFile(removedfile,
+		[]byte(`{"uuid":"`+removed.uuid+`","service-mapping":[]}`), 0644)
+
+	loaded, migrated, err := getAs(fs, asfile)
+	if assert.Nil(t, err, "load v0") {
+		assert.True(t, migrated, "load v0")
+		assert.Equal(t, serviceFileVersion, loaded.Version, "load v0")
+		assert.Equal(t, as.ServiceMappings, loaded.ServiceMappings, "load v0")
+		assert.Equal(t, as.Attributes, loaded.Attributes, "load v0")
+	}
+
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync")
+	raw, _ := fs.ReadFile(asfile)
+	expected, _ := marshalService(as)
+	assert.Equal(t, string(expected), string(raw), "rewritten")
+	assert.Contains(t, string(raw), `"version": 1`, "rewritten")
+
+	// the file of the removed service is kept but upgraded
+	loaded, migrated, err = getAs(fs, removedfile)
+	if assert.Nil(t, err, "kept") {
+		assert.False(t, migrated, "kept")
+		assert.Equal(t, removed.uuid, loaded.Uuid, "kept")
+	}
+
+	_, migrated, err = getAs(fs, asfile)
+	assert.Nil(t, err, "current")
+	assert.False(t, migrated, "current")
+
+	fs.WriteFile(asfile, []byte(`{"version":99,"uuid":"a"}`), 0644)
+	_, _, err = getAs(fs, asfile)
+	assert.NotNil(t, err, "future version")
+}
+
+func TestServiceDirShards(t *testing.T) {
+	fs := newMemFileSystem()
+	agent := testAgent()
+	agent.fs = fs
+	agent.config.OpFlexServiceDirs = []string{"/shard0", "/shard1"}
+	agent.syncEnabled = true
+
+	st := &serviceTests[1]
+	var uuids []string
+	for i := 0; i < 10; i++ {
+		uuid := fmt.Sprintf("683c333d-a594-4f00-baa6-0d578a13d8%02d", i)
+		uuids = append(uuids, uuid)
+		agent.updateServiceDesc(false,
+			service(uuid, st.namespace, fmt.Sprintf("service%d", i),
+				st.clusterIp, "", st.ports),
+			endpoints(st.namespace, fmt.Sprintf("service%d", i),
+				st.nextHopIps, st.ports))
+	}
+
+	// a file left in the wrong directory by an earlier configuration
+	fs.MkdirAll("/shard0", 0755)
+	fs.MkdirAll("/shard1", 0755)
+	wrong := "/shard0/" + uuids[0] + ".service"
+	if agent.serviceDir(uuids[0]) == "/shard0" {
+		wrong = "/shard1/" + uuids[0] + ".service"
+	}
+	fs.WriteFile(wrong, []byte("{}"), 0644)
+
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "sync")
+	_, err := fs.Stat(wrong)
+	assert.True(t, os.IsNotExist(err), "wrong directory")
+
+	counts := make(map[string]int)
+	for _, uuid := range uuids {
+		dir := agent.serviceDir(uuid)
+		counts[dir]++
+		for _, suffix := range []string{".service", ".meta"} {
+			_, err := fs.Stat(filepath.Join(dir, uuid+suffix))
+			assert.Nil(t, err, uuid+suffix)
+		}
+	}
+	assert.Len(t, counts, 2, "both directories used")
+	assert.Equal(t, 20, len(fs.names()), "one copy of each file")
+
+	// the directory only depends on the UUID
+	other := testAgent()
+	other.config.OpFlexServiceDirs = []string{"/shard0/", "/shard1", "/shard0"}
+	for _, uuid := range uuids {
+		assert.Equal(t, agent.serviceDir(uuid), other.serviceDir(uuid), uuid)
+	}
+
+	// removing a service removes its files from its directory only
+	removed := uuids[1]
+	agent.serviceDeleted(service(removed, st.namespace, "service1",
+		st.clusterIp, "", st.ports))
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "remove")
+	_, err = fs.Stat(filepath.Join(agent.serviceDir(removed),
+		removed+".service"))
+	assert.True(t, os.IsNotExist(err), "removed")
+	assert.Equal(t, 18, len(fs.names()), "others kept")
+
+	// a changed service is rewritten in its own directory
+	agent.updateServiceDesc(false,
+		service(uuids[2], st.namespace, "service2", st.clusterIp, "",
+			st.ports),
+		endpoints(st.namespace, "service2", []string{"10.9.9.9"}, st.ports))
+	agent.syncServices()
+	raw, err := fs.ReadFile(filepath.Join(agent.serviceDir(uuids[2]),
+		uuids[2]+".service"))
+	if assert.Nil(t, err, "changed") {
+		assert.Contains(t, string(raw), "10.9.9.9", "changed")
+	}
+	assert.Equal(t, 18, len(fs.names()), "changed")
+
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	assert.Nil(t, agent.serviceSyncErr, "full sync")
+	assert.Equal(t, 18, len(fs.names()), "full sync")
+}
+
+func TestServiceTombstone(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	agent.config.ServiceTombstoneTime = 60
+
+	st := &serviceTests[1]
+	asfile := filepath.Join(tempdir, st.uuid+".service")
+	metafile := filepath.Join(tempdir, st.uuid+".meta")
+	update := func(nextHopIps []string) {
+		agent.updateServiceDesc(false, st.service(),
+			endpoints(st.namespace, st.name, nextHopIps, st.ports))
+		agent.syncServices()
+	}
+	tombstone := func(desc string) {
+		raw, err := ioutil.ReadFile(asfile)
+		if !assert.Nil(t, err, desc) {
+			return
+		}
+		as := &opflexService{}
+		if assert.Nil(t, json.Unmarshal(raw, as), desc) {
+			assert.Equal(t, st.uuid, as.Uuid, desc)
+			assert.True(t, as.Withdrawn, desc)
+			assert.Equal(t, 0, len(as.ServiceMappings), desc)
+		}
+		assert.Contains(t, string(raw), `"withdrawn": true`, desc)
+	}
+
+	update(st.nextHopIps)
+	raw, err := ioutil.ReadFile(asfile)
+	if assert.Nil(t, err, "created") {
+		assert.NotContains(t, string(raw), "withdrawn", "created")
+	}
+
+	update(nil)
+	tombstone("withdrawn")
+	_, err = os.Stat(metafile)
+	assert.Nil(t, err, "meta kept")
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	tombstone("full sync")
+
+	// the service comes back and replaces the tombstone
+	update(st.nextHopIps)
+	raw, err = ioutil.ReadFile(asfile)
+	if assert.Nil(t, err, "returned") {
+		assert.NotContains(t, string(raw), "withdrawn", "returned")
+	}
+
+	// and the tombstone is deleted once its time is up
+	update(nil)
+	tombstone("withdrawn again")
+	agent.pendingServiceRemovals[st.uuid] = time.Now().Add(-time.Hour)
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	_, err = os.Stat(asfile)
+	assert.True(t, os.IsNotExist(err), "removed")
+	_, err = os.Stat(metafile)
+	assert.True(t, os.IsNotExist(err), "meta removed")
+}
+
+func TestServiceDirMissing(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	agent.config.OpFlexServiceDir = filepath.Join(tempdir, "a", "services")
+	agent.config.OpFlexServiceDirPerms = "0750"
+
+	st := &serviceTests[1]
+	agent.updateServiceDesc(false, st.service(), st.endpoints())
+	assert.False(t, agent.syncServices(), "sync")
+	assert.Nil(t, agent.serviceSyncErr, "sync error")
+
+	info, err := os.Stat(agent.config.OpFlexServiceDir)
+	if assert.Nil(t, err, "created") {
+		assert.True(t, info.IsDir(), "directory")
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), "perms")
+	}
+	_, err = os.Stat(filepath.Join(agent.config.OpFlexServiceDir,
+		st.uuid+".service"))
+	assert.Nil(t, err, "service file")
+}
+
+func TestServiceIngressIps(t *testing.T) {
+	agent := testAgent()
+	agent.config.NodeName = "test-node"
+	agent.config.UplinkIface = "eth1"
+	agent.serviceEp = testServiceEp
+
+	st := &serviceTests[0]
+	s := st.service()
+	s.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{
+		{IP: "200.1.1.1"}, {IP: "200.1.1.2"},
+	}
+	e := st.endpoints()
+
+	checkIngress := func(expected map[string]string, desc string) {
+		for uuid, ip := range expected {
+			as, ok := agent.opflexServices[uuid]
+			if assert.True(t, ok, desc, uuid) &&
+				assert.Equal(t, 1, len(as.ServiceMappings), desc, uuid) {
+				assert.Equal(t, ip, as.ServiceMappings[0].ServiceIp,
+					desc, uuid)
+			}
+		}
+		external := 0
+		for uuid := range agent.opflexServices {
+			if _, ok := serviceIngressIndex(st.uuid, uuid); ok {
+				external++
+			}
+		}
+		assert.Equal(t, len(expected), external, desc, "count")
+	}
+
+	assert.True(t, agent.updateServiceDesc(true, s, e), "two ingress")
+	checkIngress(map[string]string{
+		st.uuid + "-external":   "200.1.1.1",
+		st.uuid + "-external-1": "200.1.1.2",
+	}, "two ingress")
+
+	s.Status.LoadBalancer.Ingress = s.Status.LoadBalancer.Ingress[1:]
+	assert.True(t, agent.updateServiceDesc(true, s, e), "one ingress")
+	checkIngress(map[string]string{
+		st.uuid + "-external": "200.1.1.2",
+	}, "one ingress")
+
+	s.Status.LoadBalancer.Ingress = nil
+	s.Spec.LoadBalancerIP = "200.1.1.3"
+	assert.True(t, agent.updateServiceDesc(true, s, e), "fallback")
+	checkIngress(map[string]string{
+		st.uuid + "-external": "200.1.1.3",
+	}, "fallback")
+
+	s.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{
+		{IP: "200.1.1.1"}, {IP: "200.1.1.2"},
+	}
+	agent.updateServiceDesc(true, s, e)
+	assert.Equal(t, 2, agent.serviceIngressCounts[st.uuid], "recorded")
+	agent.serviceDeleted(s)
+	checkIngress(map[string]string{}, "deleted")
+	assert.Empty(t, agent.serviceIngressCounts, "deleted")
+}
+
+func TestServiceUuidStable(t *testing.T) {
+	st := &serviceTests[0]
+	e := st.endpoints()
+
+	uuids := func(labels [][2]string, ingress []string) []string {
+		agent := testAgent()
+		agent.config.NodeName = "test-node"
+		agent.config.UplinkIface = "eth1"
+		agent.serviceEp = testServiceEp
+		s := st.service()
+		for _, l := range labels {
+			s.ObjectMeta.Labels[l[0]] = l[1]
+		}
+		s.Status.LoadBalancer.Ingress = nil
+		for _, ip := range ingress {
+			s.Status.LoadBalancer.Ingress =
+				append(s.Status.LoadBalancer.Ingress,
+					v1.LoadBalancerIngress{IP: ip})
+		}
+		agent.updateServiceDesc(false, s, e)
+		agent.updateServiceDesc(true, s, e)
+
+		var result []string
+		for uuid, as := range agent.opflexServices {
+			result = append(result,
+				uuid+"="+as.ServiceMappings[0].ServiceIp)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	expected := uuids([][2]string{{"app", "web"}, {"tier", "front"}},
+		[]string{"200.1.1.1", "200.1.1.2"})
+	assert.Equal(t, []string{
+		st.uuid + "=" + st.clusterIp,
+		st.uuid + "-external=200.1.1.1",
+		st.uuid + "-external-1=200.1.1.2",
+	}, expected, "uuids")
+	assert.Equal(t, expected,
+		uuids([][2]string{{"tier", "front"}, {"app", "web"}},
+			[]string{"200.1.1.2", "200.1.1.1", "200.1.1.2"}),
+		"reordered")
+}
+
+func TestServiceMinNextHops(t *testing.T) {
+	agent := testAgent()
+	agent.config.MinNextHops = 2
+
+	st := &serviceTests[1]
+	s := st.service()
+
+	e := endpoints(st.namespace, st.name, st.nextHopIps[:1], st.ports)
+	assert.False(t, agent.updateServiceDesc(false, s, e), "one next hop")
+	_, ok := agent.opflexServices[st.uuid]
+	assert.False(t, ok, "one next hop")
+
+	e = st.endpoints()
+	assert.True(t, agent.updateServiceDesc(false, s, e), "two next hops")
+	_, ok = agent.opflexServices[st.uuid]
+	assert.True(t, ok, "two next hops")
+
+	e = endpoints(st.namespace, st.name, st.nextHopIps[:1], st.ports)
+	assert.True(t, agent.updateServiceDesc(false, s, e), "withdraw")
+	_, ok = agent.opflexServices[st.uuid]
+	assert.False(t, ok, "withdraw")
+}
+
+func TestServiceMaxNextHops(t *testing.T) {
+	agent := testAgent()
+	agent.config.MaxNextHops = 3
+
+	st := &serviceTests[1]
+	s := st.service()
+
+	var ips []string
+	for i := 1; i <= 10; i++ {
+		ips = append(ips, fmt.Sprintf("10.5.1.%d", i))
+	}
+	agent.updateServiceDesc(false, s,
+		endpoints(st.namespace, st.name, ips, st.ports))
+	as, ok := agent.opflexServices[st.uuid]
+	if !assert.True(t, ok, "service") ||
+		!assert.Equal(t, 1, len(as.ServiceMappings), "mappings") {
+		return
+	}
+	selected := as.ServiceMappings[0].NextHopIps
+	assert.Equal(t, 3, len(selected), "capped")
+	for _, ip := range selected {
+		found := false
+		for _, candidate := range ips {
+			found = found || ip == candidate
+		}
+		assert.True(t, found, "selected from endpoints", ip)
+	}
+
+	// the same subset is chosen regardless of endpoint order
+	var reversed []string
+	for i := len(ips) - 1; i >= 0; i-- {
+		reversed = append(reversed, ips[i])
+	}
+	assert.False(t, agent.updateServiceDesc(false, s,
+		endpoints(st.namespace, st.name, reversed, st.ports)), "stable")
+	assert.Equal(t, selected,
+		agent.opflexServices[st.uuid].ServiceMappings[0].NextHopIps,
+		"stable")
+
+	agent.config.MaxNextHops = 0
+	agent.updateServiceDesc(false, s,
+		endpoints(st.namespace, st.name, ips, st.ports))
+	assert.Equal(t, ips,
+		agent.opflexServices[st.uuid].ServiceMappings[0].NextHopIps,
+		"unlimited")
+}
+
+func TestServiceNodePort(t *testing.T) {
+	agent := testAgent()
+	agent.config.NodeIp = "fd00::1,10.9.0.1"
+	assert.True(t, agent.updateNodeIps(), "resolve")
+	assert.False(t, agent.updateNodeIps(), "unchanged")
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.Spec.Type = v1.ServiceTypeNodePort
+	s.Spec.Ports[0].NodePort = 30080
+	eps := st.endpoints()
+	uuid := st.uuid + serviceUuidNodePort
+
+	assert.True(t, agent.updateNodePortServiceDesc(s, eps), "node-ip")
+	as, ok := agent.opflexServices[uuid]
+	if assert.True(t, ok, "node-ip") &&
+		assert.Equal(t, 1, len(as.ServiceMappings), "node-ip") {
+		sm := as.ServiceMappings[0]
+		assert.Equal(t, "10.9.0.1", sm.ServiceIp, "node-ip")
+		assert.Equal(t, uint16(30080), sm.ServicePort, "node-ip")
+		assert.Equal(t, uint16(42), sm.NextHopPort, "node-ip")
+	}
+
+	// no mapping unless a node IP is configured
+	agent.config.NodeIp = ""
+	agent.updateNodeIps()
+	assert.True(t, agent.updateNodePortServiceDesc(s, eps), "unconfigured")
+	_, ok = agent.opflexServices[uuid]
+	assert.False(t, ok, "unconfigured")
+	agent.config.NodeIp = "10.9.0.2"
+	agent.updateNodeIps()
+	assert.True(t, agent.updateNodePortServiceDesc(s, eps), "configured")
+	assert.Equal(t, "10.9.0.2",
+		agent.opflexServices[uuid].ServiceMappings[0].ServiceIp,
+		"configured")
+
+	// no address in the family of the service
+	agent.config.NodeIp = "fd00::1"
+	agent.updateNodeIps()
+	assert.True(t, agent.updateNodePortServiceDesc(s, eps), "family")
+	_, ok = agent.opflexServices[uuid]
+	assert.False(t, ok, "family")
+
+	// only NodePort and LoadBalancer services get node port mappings
+	agent.config.NodeIp = "10.9.0.1"
+	agent.updateNodeIps()
+	s.Spec.Type = v1.ServiceTypeClusterIP
+	assert.False(t, agent.updateNodePortServiceDesc(s, eps), "cluster IP")
+	_, ok = agent.opflexServices[uuid]
+	assert.False(t, ok, "cluster IP")
+}
+
+func TestServiceIpFamilies(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	eps := endpoints(st.namespace, st.name,
+		append([]string{"fd00::5:1"}, st.nextHopIps...), st.ports)
+
+	// by default every next hop is programmed
+	assert.True(t, agent.updateServiceDesc(false, s, eps), "default")
+	as, ok := agent.opflexServices[st.uuid]
+	if assert.True(t, ok, "default") &&
+		assert.Equal(t, 1, len(as.ServiceMappings), "default") {
+		assert.Equal(t, append([]string{"fd00::5:1"}, st.nextHopIps...),
+			as.ServiceMappings[0].NextHopIps, "default")
+	}
+
+	// next hops of the other family are left out once configured
+	agent.config.ServiceIpFamilies = "ipv4,ipv6"
+	assert.True(t, agent.updateServiceDesc(false, s, eps), "dual")
+	as, ok = agent.opflexServices[st.uuid]
+	if assert.True(t, ok, "dual") &&
+		assert.Equal(t, 1, len(as.ServiceMappings), "dual") {
+		sm := as.ServiceMappings[0]
+		assert.Equal(t, st.clusterIp, sm.ServiceIp, "dual")
+		assert.Equal(t, st.nextHopIps, sm.NextHopIps, "dual")
+	}
+
+	// and the mapping is withdrawn when its family is disabled
+	agent.config.ServiceIpFamilies = "ipv6"
+	assert.True(t, agent.updateServiceDesc(false, s, eps), "withdraw")
+	_, ok = agent.opflexServices[st.uuid]
+	assert.False(t, ok, "withdraw")
+}
+
+func TestServiceInvalidHook(t *testing.T) {
+	agent := testAgent()
+
+	var fired []string
+	agent.SetServiceInvalidHook(func(uuid, name string) {
+		// the hook runs without the index lock held
+		agent.indexMutex.Lock()
+		agent.indexMutex.Unlock()
+		fired = append(fired, uuid+" "+name)
+	})
+
+	st := &serviceTests[1]
+	s := st.service()
+	agent.updateServiceDesc(false, s, st.endpoints())
+	agent.notifyInvalidServices()
+	assert.Empty(t, fired, "valid")
+
+	// drain the endpoints
+	for i := 0; i < 2; i++ {
+		agent.updateServiceDesc(false, s,
+			endpoints(st.namespace, st.name, nil, st.ports))
+		agent.notifyInvalidServices()
+	}
+	assert.Equal(t, []string{st.uuid + " testns/service2"}, fired,
+		"drained")
+}
+
+// logrus hook recording the messages logged at warning level
+type warnHook struct {
+	messages []string
+}
+
+func (hook *warnHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+func (hook *warnHook) Fire(entry *logrus.Entry) error {
+	hook.messages = append(hook.messages, entry.Message)
+	return nil
+}
+
+// logrus hook recording the messages logged at debug level
+type debugHook struct {
+	messages []string
+}
+
+func (hook *debugHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.DebugLevel}
+}
+
+func (hook *debugHook) Fire(entry *logrus.Entry) error {
+	hook.messages = append(hook.messages, entry.Message)
+	return nil
+}
+
+// logrus hook recording the entries logged at info level
+type infoHook struct {
+	entries []*logrus.Entry
+}
+
+func (hook *infoHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel}
+}
+
+func (hook *infoHook) Fire(entry *logrus.Entry) error {
+	hook.entries = append(hook.entries, entry)
+	return nil
+}
+
+func TestServiceFileChanges(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	hook := &infoHook{}
+	agent.log.Hooks.Add(hook)
+
+	st := &serviceTests[1]
+	s := st.service()
+	agent.updateServiceDesc(false, s, st.endpoints())
+	agent.syncServices()
+
+	hook.entries = nil
+	agent.updateServiceDesc(false, s,
+		endpoints(st.namespace, st.name, []string{"10.5.1.9"}, st.ports))
+	agent.syncServices()
+
+	var changes interface{}
+	for _, entry := range hook.entries {
+		if entry.Message == "Updated service" {
+			changes = entry.Data["changes"]
+		}
+	}
+	assert.Equal(t, []string{"service-mapping[0].next-hop-ips"}, changes,
+		"changes")
+
+	assert.Equal(t, []string{
+		"attributes",
+		"service-mapping[0].next-hop-port",
+		"service-mapping[1]",
+		"uuid",
+	}, serviceFileChanges(
+		[]byte(`{"uuid":"a","service-mapping":[{"next-hop-port":80}]}`),
+		[]byte(`{"uuid":"b","attributes":{"app":"web"},`+
+			`"service-mapping":[{"next-hop-port":81},{}]}`)), "fields")
+}
+
+func TestServiceLogLevel(t *testing.T) {
+	agent := testAgent()
+	agent.log.Level = logrus.InfoLevel
+	agent.log.Out = ioutil.Discard
+	hook := &debugHook{}
+	agent.log.Hooks.Add(hook)
+
+	verbose := &serviceTests[0]
+	quiet := &serviceTests[1]
+	vs := service(verbose.uuid, verbose.namespace, verbose.name,
+		verbose.clusterIp, "", verbose.ports)
+	vs.ObjectMeta.Annotations[metadata.ServiceLogLevelAnnotation] = "debug"
+	qs := service(quiet.uuid, quiet.namespace, quiet.name,
+		quiet.clusterIp, "", quiet.ports)
+
+	agent.serviceLogger(vs).Debug("verbose service")
+	agent.serviceLogger(qs).Debug("quiet service")
+
+	agent.updateServiceDesc(false, vs, endpoints(verbose.namespace,
+		verbose.name, verbose.nextHopIps, verbose.ports))
+	agent.updateServiceDesc(false, qs, endpoints(quiet.namespace,
+		quiet.name, quiet.nextHopIps, quiet.ports))
+	agent.opflexServiceLogger(agent.opflexServices[verbose.uuid]).
+		Debug("verbose opflex service")
+	agent.opflexServiceLogger(agent.opflexServices[quiet.uuid]).
+		Debug("quiet opflex service")
+
+	assert.Equal(t, []string{"verbose service", "verbose opflex service"},
+		hook.messages, "debug messages")
+	assert.Equal(t, logrus.InfoLevel, agent.log.Level, "global level")
+	assert.True(t, agent.serviceLevelLogger("debug") ==
+		agent.serviceLevelLogger("debug"), "one logger per level")
+}
+
+func TestServiceLoggerFields(t *testing.T) {
+	agent := testAgent()
+	hook := &infoHook{}
+	agent.log.Hooks.Add(hook)
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.ObjectMeta.ResourceVersion = "42"
+	agent.updateServiceDesc(false, s, st.endpoints())
+
+	agent.serviceLogger(s).Info("service")
+	agent.opflexServiceLogger(agent.opflexServices[st.uuid]).
+		Info("opflex service")
+	if assert.Equal(t, 2, len(hook.entries), "entries") {
+		for _, entry := range hook.entries {
+			assert.Equal(t, st.uuid, fmt.Sprint(entry.Data["uid"]),
+				entry.Message)
+			assert.Equal(t, "42", entry.Data["resourceVersion"],
+				entry.Message)
+		}
+	}
+}
+
+func TestServicePortCollision(t *testing.T) {
+	agent := testAgent()
+	hook := &warnHook{}
+	agent.log.Hooks.Add(hook)
+
+	st := &serviceTests[1]
+	s := service(st.uuid, st.namespace, st.name,
+		st.clusterIp, st.externalIp, nil)
+	s.Spec.Ports = []v1.ServicePort{
+		{Name: "b", Protocol: "TCP", Port: 80},
+		{Name: "a", Protocol: "TCP", Port: 80},
+		{Name: "dns", Protocol: "UDP", Port: 80},
+	}
+	e := endpoints(st.namespace, st.name, st.nextHopIps, nil)
+	e.Subsets[0].Ports = []v1.EndpointPort{
+		{Name: "a", Protocol: "TCP", Port: 9090},
+		{Name: "b", Protocol: "TCP", Port: 8080},
+		{Name: "dns", Protocol: "UDP", Port: 5353},
+	}
+
+	agent.updateServiceDesc(false, s, e)
+	as, ok := agent.opflexServices[st.uuid]
+	if !assert.True(t, ok, "service") ||
+		!assert.Equal(t, 2, len(as.ServiceMappings), "mappings") {
+		return
+	}
+	assert.Equal(t, "tcp", as.ServiceMappings[0].ServiceProto, "tcp")
+	assert.Equal(t, uint16(8080), as.ServiceMappings[0].NextHopPort,
+		"kept lowest next hop port")
+	assert.Equal(t, "udp", as.ServiceMappings[1].ServiceProto, "udp")
+	assert.Equal(t, []string{"Ignoring colliding service mapping"},
+		hook.messages, "warning")
+}
+
+func TestServiceDuplicateFiles(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	hook := &warnHook{}
+	agent.log.Hooks.Add(hook)
+
+	st := &serviceTests[0]
+	for _, name := range []string{st.uuid + ".as", st.uuid + ".service"} {
+		ioutil.WriteFile(filepath.Join(tempdir, name),
+			[]byte("random gibberish"), 0644)
+	}
+	agent.opflexServices[st.uuid] = &opflexService{
+		Uuid:            st.uuid,
+		ServiceMappings: make([]opflexServiceMapping, 0),
+	}
+	agent.syncServices()
+
+	if assert.Equal(t, 1, len(hook.messages), "warnings") {
+		assert.Contains(t, hook.messages[0], st.uuid+".as", "warning")
+	}
+	_, err := os.Stat(filepath.Join(tempdir, st.uuid+".as"))
+	assert.True(t, os.IsNotExist(err), "duplicate removed")
+
+	as := &opflexService{}
+	raw, err := ioutil.ReadFile(filepath.Join(tempdir, st.uuid+".service"))
+	if assert.Nil(t, err, "read service") {
+		assert.Nil(t, json.Unmarshal(raw, as), "unmarshal service")
+		assert.Equal(t, st.uuid, as.Uuid, "uuid")
+	}
+}
+
+type conntrackTest struct {
+	annotation  string
+	autoDisable bool
+	tcp         bool
+	udp         bool
+	desc        string
+}
+
+var conntrackTests = []conntrackTest{
+	{"", false, true, true, "default"},
+	{"false", false, false, false, "service-wide"},
+	{"tcp=true,udp=false", false, true, false, "per-protocol"},
+	{"false,tcp=true", false, true, false, "override"},
+	{"UDP = false", false, true, false, "case and spaces"},
+	{"udp=maybe,=false", false, true, true, "malformed"},
+	{"", true, true, false, "auto-disable"},
+	{"udp=true", true, true, true, "auto-disable per-protocol override"},
+	{"true", true, true, true, "auto-disable service-wide override"},
+}
+
+func TestServiceConntrack(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := service(st.uuid, st.namespace, st.name,
+		st.clusterIp, st.externalIp, nil)
+	s.Spec.Ports = []v1.ServicePort{
+		{Name: "dns-tcp", Protocol: "TCP", Port: 53},
+		{Name: "dns-udp", Protocol: "UDP", Port: 53},
+	}
+	e := endpoints(st.namespace, st.name, st.nextHopIps, nil)
+	e.Subsets[0].Ports = []v1.EndpointPort{
+		{Name: "dns-tcp", Protocol: "TCP", Port: 5353},
+		{Name: "dns-udp", Protocol: "UDP", Port: 5353},
+	}
+
+	for _, ct := range conntrackTests {
+		agent.config.AutoDisableUdpConntrack = ct.autoDisable
+		s.ObjectMeta.Annotations[metadata.ServiceConntrackAnnotation] =
+			ct.annotation
+		agent.updateServiceDesc(false, s, e)
+		as, ok := agent.opflexServices[st.uuid]
+		if !assert.True(t, ok, ct.desc) ||
+			!assert.Equal(t, 2, len(as.ServiceMappings), ct.desc) {
+			continue
+		}
+		for _, sm := range as.ServiceMappings {
+			if sm.ServiceProto == "tcp" {
+				assert.Equal(t, ct.tcp, sm.Conntrack, ct.desc, "tcp")
+			} else {
+				assert.Equal(t, ct.udp, sm.Conntrack, ct.desc, "udp")
+			}
+		}
+	}
+
+	// only well-known connectionless UDP ports are affected
+	none := map[string]bool{}
+	assert.True(t, serviceConntrack(none, "udp", 5000, true), "other port")
+	assert.True(t, serviceConntrack(none, "tcp", 123, true), "tcp ntp")
+	assert.False(t, serviceConntrack(none, "udp", 123, true), "udp ntp")
+}
+
+func TestServicePreserveSourceIp(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	tests := []struct {
+		set        bool
+		annotation string
+		present    bool
+		desc       string
+	}{
+		{false, "", false, "unset"},
+		{true, "true", true, "true"},
+		{true, "false", false, "false"},
+		{true, "bogus", false, "malformed"},
+	}
+
+	for _, pt := range tests {
+		delete(s.ObjectMeta.Annotations,
+			metadata.ServicePreserveSourceIpAnnotation)
+		if pt.set {
+			s.ObjectMeta.Annotations[metadata.ServicePreserveSourceIpAnnotation] =
+				pt.annotation
+		}
+		agent.updateServiceDesc(false, s, e)
+		as, ok := agent.opflexServices[st.uuid]
+		if !assert.True(t, ok, pt.desc) {
+			continue
+		}
+
+		raw, err := json.Marshal(as)
+		assert.Nil(t, err, pt.desc)
+		fields := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(raw, &fields), pt.desc)
+		v, present := fields["preserve-source-ip"]
+		assert.Equal(t, pt.present, present, pt.desc)
+		if pt.present {
+			assert.Equal(t, true, v, pt.desc)
+		}
+	}
+}
+
+func TestServiceConntrackStateSync(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	tests := []struct {
+		set        bool
+		annotation string
+		present    bool
+		desc       string
+	}{
+		{false, "", false, "unset"},
+		{true, "true", true, "true"},
+		{true, "false", false, "false"},
+		{true, "bogus", false, "malformed"},
+	}
+
+	for _, pt := range tests {
+		delete(s.ObjectMeta.Annotations,
+			metadata.ServiceConntrackStateSyncAnnotation)
+		if pt.set {
+			s.ObjectMeta.Annotations[metadata.ServiceConntrackStateSyncAnnotation] =
+				pt.annotation
+		}
+		agent.updateServiceDesc(false, s, e)
+		as, ok := agent.opflexServices[st.uuid]
+		if !assert.True(t, ok, pt.desc) ||
+			!assert.Equal(t, 1, len(as.ServiceMappings), pt.desc) {
+			continue
+		}
+
+		raw, err := json.Marshal(&as.ServiceMappings[0])
+		assert.Nil(t, err, pt.desc)
+		fields := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(raw, &fields), pt.desc)
+		v, present := fields["conntrack-state-sync"]
+		assert.Equal(t, pt.present, present, pt.desc)
+		if pt.present {
+			assert.Equal(t, true, v, pt.desc)
+		}
+		// independent of the conntrack setting
+		assert.Equal(t, true, fields["conntrack-enabled"], pt.desc)
+	}
+}
+
+func TestServiceExternalTrafficPolicy(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	for _, policy := range []v1.ServiceExternalTrafficPolicyType{
+		v1.ServiceExternalTrafficPolicyTypeLocal,
+		v1.ServiceExternalTrafficPolicyTypeCluster,
+		"",
+	} {
+		s.Spec.ExternalTrafficPolicy = policy
+		agent.updateServiceDesc(false, s, e)
+		as, ok := agent.opflexServices[st.uuid]
+		if !assert.True(t, ok, "service", policy) {
+			continue
+		}
+		raw, _ := json.Marshal(as)
+		if policy == "" {
+			assert.NotContains(t, string(raw), "external-traffic-policy",
+				"unset")
+		} else {
+			assert.Contains(t, string(raw),
+				`"external-traffic-policy":"`+string(policy)+`"`, policy)
+		}
+	}
+}
+
+func TestServiceHealthCheckPort(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.Spec.HealthCheckNodePort = 30123
+	e := st.endpoints()
+
+	tests := []struct {
+		serviceType v1.ServiceType
+		policy      v1.ServiceExternalTrafficPolicyType
+		port        uint16
+		desc        string
+	}{
+		{v1.ServiceTypeLoadBalancer, v1.ServiceExternalTrafficPolicyTypeLocal,
+			30123, "local loadbalancer"},
+		{v1.ServiceTypeLoadBalancer, v1.ServiceExternalTrafficPolicyTypeCluster,
+			0, "cluster loadbalancer"},
+		{v1.ServiceTypeNodePort, v1.ServiceExternalTrafficPolicyTypeLocal,
+			0, "local nodeport"},
+	}
+
+	for _, ht := range tests {
+		s.Spec.Type = ht.serviceType
+		s.Spec.ExternalTrafficPolicy = ht.policy
+		agent.updateServiceDesc(false, s, e)
+		as, ok := agent.opflexServices[st.uuid]
+		if !assert.True(t, ok, ht.desc) {
+			continue
+		}
+		assert.Equal(t, ht.port, as.HealthCheckPort, ht.desc)
+		raw, _ := json.Marshal(as)
+		if ht.port != 0 {
+			assert.Contains(t, string(raw), `"health-check-port":30123`,
+				ht.desc)
+		} else {
+			assert.NotContains(t, string(raw), "health-check-port", ht.desc)
+		}
+	}
+}
+
+func TestServiceNamespaceLabels(t *testing.T) {
+	agent := testAgent()
+	agent.config.ServiceNamespaceLabels = "team, cost-center"
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.ObjectMeta.Labels["team"] = "service-team"
+	e := st.endpoints()
+	agent.nsInformer.GetStore().Add(namespaceLabel(st.namespace,
+		map[string]string{
+			"team":        "web",
+			"cost-center": "1234",
+			"other":       "ignored",
+		}))
+	agent.serviceInformer.GetStore().Add(s)
+	agent.endpointsInformer.GetStore().Add(e)
+
+	agent.updateServiceDesc(false, s, e)
+	as, ok := agent.opflexServices[st.uuid]
+	if assert.True(t, ok, "service") {
+		assert.Equal(t, map[string]string{
+			"team":                        "service-team",
+			"namespace-label:team":        "web",
+			"namespace-label:cost-center": "1234",
+			"namespace":                   st.namespace,
+			"name":                        st.name,
+			"service-name":                st.namespace + "_" + st.name,
+		}, as.Attributes, "attributes")
+	}
+	assert.Equal(t, map[string]string{"team": "service-team"},
+		s.ObjectMeta.Labels, "service labels unchanged")
+
+	// a change to the namespace labels updates the service
+	old := namespaceLabel(st.namespace, map[string]string{"team": "web"})
+	changed := namespaceLabel(st.namespace,
+		map[string]string{"team": "db"})
+	agent.nsInformer.GetStore().Update(changed)
+	agent.namespaceChanged(old, changed)
+	as = agent.opflexServices[st.uuid]
+	assert.Equal(t, "db", as.Attributes["namespace-label:team"], "changed")
+	_, ok = as.Attributes["namespace-label:cost-center"]
+	assert.False(t, ok, "removed")
+
+	agent.config.ServiceNamespaceLabels = ""
+	agent.updateServiceDesc(false, s, e)
+	for k := range agent.opflexServices[st.uuid].Attributes {
+		assert.False(t, strings.HasPrefix(k, "namespace-label:"),
+			"disabled", k)
+	}
+}
+
+func TestServiceMode(t *testing.T) {
+	agent := testAgent()
+	agent.config.ServiceModes = map[string]string{
+		"NodePort": "nodeport",
+	}
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	for _, mt := range []struct {
+		serviceType v1.ServiceType
+		mode        string
+	}{
+		{"", "loadbalancer"},
+		{v1.ServiceTypeClusterIP, "loadbalancer"},
+		{v1.ServiceTypeNodePort, "nodeport"},
+		{v1.ServiceTypeLoadBalancer, "loadbalancer"},
+	} {
+		s.Spec.Type = mt.serviceType
+		agent.updateServiceDesc(false, s, e)
+		if as, ok := agent.opflexServices[st.uuid]; assert.True(t, ok,
+			"service", mt.serviceType) {
+			assert.Equal(t, mt.mode, as.ServiceMode, mt.serviceType)
+		}
+	}
+}
+
+func TestServiceCompactFiles(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	agent.updateServiceDesc(false, s, st.endpoints())
+	asfile := filepath.Join(tempdir, st.uuid+".service")
+	read := func(desc string) string {
+		raw, err := ioutil.ReadFile(asfile)
+		assert.Nil(t, err, desc)
+		return string(raw)
+	}
+
+	agent.syncServices()
+	raw := read("full")
+	assert.Contains(t, raw, `"service-mode": "loadbalancer"`, "full")
+	assert.Contains(t, raw, `"external-traffic-policy": "Cluster"`, "full")
+
+	agent.config.CompactServiceFiles = true
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	raw = read("compact")
+	assert.NotContains(t, raw, "service-mode", "compact")
+	assert.NotContains(t, raw, "external-traffic-policy", "compact")
+	assert.Contains(t, raw, `"service-mapping"`, "compact")
+	assert.Equal(t, "loadbalancer",
+		agent.opflexServices[st.uuid].ServiceMode, "in memory")
+
+	// other values are still written
+	agent.config.ServiceModes = map[string]string{"ClusterIP": "nodeport"}
+	s.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	agent.updateServiceDesc(false, s, st.endpoints())
+	agent.syncServices()
+	raw = read("non-default")
+	assert.Contains(t, raw, `"service-mode": "nodeport"`, "non-default")
+	assert.Contains(t, raw, `"external-traffic-policy": "Local"`,
+		"non-default")
+}
+
+func TestServiceMappingOrder(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	ports := []v1.ServicePort{
+		{Name: "https", Protocol: "TCP", Port: 443},
+		{Name: "dns-udp", Protocol: "UDP", Port: 53},
+		{Name: "http", Protocol: "TCP", Port: 80},
+		{Name: "dns-tcp", Protocol: "TCP", Port: 53},
+	}
+	epPorts := []v1.EndpointPort{
+		{Name: "https", Protocol: "TCP", Port: 8443},
+		{Name: "dns-udp", Protocol: "UDP", Port: 5353},
+		{Name: "http", Protocol: "TCP", Port: 8080},
+		{Name: "dns-tcp", Protocol: "TCP", Port: 5353},
+	}
+	orders := [][]int{
+		{0, 1, 2, 3},
+		{3, 2, 1, 0},
+		{1, 3, 0, 2},
+	}
+
+	var expected []byte
+	for i, order := range orders {
+		s := service(st.uuid, st.namespace, st.name,
+			st.clusterIp, st.externalIp, nil)
+		e := endpoints(st.namespace, st.name, st.nextHopIps, nil)
+		s.Spec.Ports = nil
+		e.Subsets[0].Ports = nil
+		// endpoint ports are listed in the reverse order
+		for k, j := range order {
+			s.Spec.Ports = append(s.Spec.Ports, ports[j])
+			e.Subsets[0].Ports = append(e.Subsets[0].Ports,
+				epPorts[order[len(order)-1-k]])
+		}
+
+		agent.opflexServices = make(map[string]*opflexService)
+		agent.updateServiceDesc(false, s, e)
+		as, ok := agent.opflexServices[st.uuid]
+		if !assert.True(t, ok, "order", i) ||
+			!assert.Equal(t, 4, len(as.ServiceMappings), "order", i) {
+			continue
+		}
+
+		var keys []string
+		for _, sm := range as.ServiceMappings {
+			keys = append(keys,
+				fmt.Sprintf("%s/%d", sm.ServiceProto, sm.ServicePort))
+		}
+		assert.Equal(t, []string{"tcp/53", "tcp/80", "tcp/443", "udp/53"},
+			keys, "order", i)
+
+		raw, err := json.Marshal(as)
+		assert.Nil(t, err, "order", i)
+		if expected == nil {
+			expected = raw
+		} else {
+			assert.Equal(t, string(expected), string(raw), "order", i)
+		}
+	}
+}
+
+func jsonKeys(t *testing.T, obj interface{}, desc string) []string {
+	raw, err := json.Marshal(obj)
+	assert.Nil(t, err, desc)
+	fields := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(raw, &fields), desc)
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestServiceRelevantFields(t *testing.T) {
+	agent := testAgent()
+	agent.config.UplinkIface = "eth1"
+	agent.config.ServiceVlan = 4003
+	agent.serviceEp = testServiceEp
+
+	st := &serviceTests[0]
+	s := st.service()
+	s.ObjectMeta.Annotations[metadata.ServiceConntrackAnnotation] = "false"
+	e := st.endpoints()
+	agent.updateServiceDesc(false, s, e)
+	agent.updateServiceDesc(true, s, e)
+
+	internal, ok := agent.opflexServices[st.uuid]
+	if assert.True(t, ok, "internal") {
+		assert.Equal(t, []string{"attributes", "service-mapping",
+			"service-mode", "uuid"},
+			jsonKeys(t, internal, "internal"), "internal")
+		assert.Equal(t, []string{"next-hop-ips", "next-hop-port",
+			"service-ip", "service-port", "service-proto"},
+			jsonKeys(t, internal.ServiceMappings[0], "internal mapping"),
+			"internal mapping")
+	}
+
+	external, ok := agent.opflexServices[st.uuid+"-external"]
+	if assert.True(t, ok, "external") {
+		assert.Equal(t, []string{"attributes", "interface-ip",
+			"interface-name", "interface-vlan", "service-mac",
+			"service-mapping", "service-mode", "uuid"},
+			jsonKeys(t, external, "external"), "external")
+	}
+
+	delete(s.ObjectMeta.Annotations, metadata.ServiceConntrackAnnotation)
+	agent.updateServiceDesc(false, s, e)
+	assert.Equal(t, []string{"conntrack-enabled", "next-hop-ips",
+		"next-hop-port", "service-ip", "service-port", "service-proto"},
+		jsonKeys(t, agent.opflexServices[st.uuid].ServiceMappings[0],
+			"conntrack"), "conntrack")
+}
+
+func TestServiceResync(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "hostagent_test_")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	agent := testAgent()
+	agent.config.OpFlexEndpointDir = tempdir
+	agent.config.OpFlexServiceDir = tempdir
+	agent.config.OpFlexServiceResyncInterval = 1
+	agent.run()
+
+	st := &serviceTests[1]
+	agent.fakeServiceSource.Add(st.service())
+	agent.fakeEndpointsSource.Add(st.endpoints())
+	agent.doTestService(t, tempdir, st, "create")
+
+	// introduce drift both on disk and in memory
+	asfile := filepath.Join(tempdir, st.uuid+".service")
+	ioutil.WriteFile(asfile, []byte("random gibberish"), 0644)
+	agent.indexMutex.Lock()
+	agent.opflexServices["stale"] = &opflexService{
+		Uuid:            "stale",
+		ServiceMappings: make([]opflexServiceMapping, 0),
+	}
+	agent.indexMutex.Unlock()
+
+	tu.WaitFor(t, "resync", 3*time.Second,
+		func(last bool) (bool, error) {
+			as := &opflexService{}
+			raw, err := ioutil.ReadFile(asfile)
+			if !tu.WaitNil(t, last, err, "read service") ||
+				!tu.WaitNil(t, last, json.Unmarshal(raw, as),
+					"unmarshal service") {
+				return false, nil
+			}
+			agent.indexMutex.Lock()
+			_, stale := agent.opflexServices["stale"]
+			agent.indexMutex.Unlock()
+			return tu.WaitEqual(t, last, false, stale, "stale"), nil
+		})
+	agent.doTestService(t, tempdir, st, "resync")
+
+	agent.stop()
+}
+
+func TestServiceNextHopHostnames(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	agent.updateServiceDesc(false, s, e)
+	if as, ok := agent.opflexServices[st.uuid]; assert.True(t, ok, "plain") {
+		assert.Nil(t, as.ServiceMappings[0].NextHopHostnames, "plain")
+		raw, _ := json.Marshal(as)
+		assert.NotContains(t, string(raw), "next-hop-hostnames", "plain")
+	}
+
+	e.Subsets[0].Addresses[0].Hostname = "web-0"
+	agent.updateServiceDesc(false, s, e)
+	if as, ok := agent.opflexServices[st.uuid]; assert.True(t, ok, "hostname") {
+		sm := &as.ServiceMappings[0]
+		assert.Equal(t, st.nextHopIps, sm.NextHopIps, "hostname next-hop")
+		assert.Equal(t, map[string]string{st.nextHopIps[0]: "web-0"},
+			sm.NextHopHostnames, "hostname")
+	}
+}
+
+func TestServiceDeleteByName(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	agent.updateServiceDesc(false, s, e)
+	assert.Equal(t, 1, len(agent.opflexServices), "created")
+	agent.serviceDeleted(service("", st.namespace, st.name,
+		st.clusterIp, st.externalIp, st.ports))
+	assert.Equal(t, 0, len(agent.opflexServices), "deleted without uid")
+
+	agent.updateServiceDesc(false, s, e)
+	assert.Equal(t, 1, len(agent.opflexServices), "recreated")
+	agent.serviceDeleted(cache.DeletedFinalStateUnknown{
+		Key: st.namespace + "/" + st.name,
+	})
+	assert.Equal(t, 0, len(agent.opflexServices), "deleted by key")
+}
+
+func TestServiceMappingName(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := st.endpoints()
+
+	agent.updateServiceDesc(false, s, e)
+	if as, ok := agent.opflexServices[st.uuid]; assert.True(t, ok, "unnamed") {
+		assert.Nil(t, as.ServiceMappings[0].Attributes, "unnamed")
+	}
+
+	s.Spec.Ports[0].Name = "http"
+	e.Subsets[0].Ports[0].Name = "http"
+	agent.updateServiceDesc(false, s, e)
+	if as, ok := agent.opflexServices[st.uuid]; assert.True(t, ok, "named") {
+		assert.Equal(t, "testns_service2", as.Attributes["service-name"],
+			"service-name")
+		assert.Equal(t, "testns_service2_http",
+			as.ServiceMappings[0].Attributes["service-name"],
+			"mapping service-name")
+	}
+}
+
+func TestServiceTargetPorts(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := service(st.uuid, st.namespace, st.name,
+		st.clusterIp, st.externalIp, nil)
+	s.Spec.Ports = []v1.ServicePort{
+		{
+			Name:       "http",
+			Protocol:   "TCP",
+			Port:       80,
+			TargetPort: intstr.FromString("web"),
+		},
+		{
+			Name:       "metrics",
+			Protocol:   "TCP",
+			Port:       9090,
+			TargetPort: intstr.FromInt(9100),
+		},
+	}
+	e := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: st.namespace,
+			Name:      st.name,
+		},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.5.1.1"}, {IP: "10.5.1.2"},
+				},
+				Ports: []v1.EndpointPort{
+					{Name: "http", Protocol: "TCP", Port: 8080},
+					{Protocol: "TCP", Port: 9100},
+				},
+			},
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.5.1.2"}, {IP: "10.5.1.3"},
+				},
+				Ports: []v1.EndpointPort{
+					{Name: "http", Protocol: "TCP", Port: 8080},
+					{Protocol: "TCP", Port: 9200},
+				},
+			},
+		},
+	}
+
+	agent.updateServiceDesc(false, s, e)
+	as, ok := agent.opflexServices[st.uuid]
+	if !assert.True(t, ok, "service") ||
+		!assert.Equal(t, 2, len(as.ServiceMappings), "mappings") {
+		return
+	}
+	http := &as.ServiceMappings[0]
+	assert.Equal(t, uint16(80), http.ServicePort, "http service-port")
+	assert.Equal(t, uint16(8080), http.NextHopPort, "http next-hop-port")
+	assert.Equal(t, []string{"10.5.1.1", "10.5.1.2", "10.5.1.3"},
+		http.NextHopIps, "http next-hop")
+	metrics := &as.ServiceMappings[1]
+	assert.Equal(t, uint16(9090), metrics.ServicePort, "metrics service-port")
+	assert.Equal(t, uint16(9100), metrics.NextHopPort,
+		"metrics next-hop-port")
+	assert.Equal(t, []string{"10.5.1.1", "10.5.1.2"},
+		metrics.NextHopIps, "metrics next-hop")
+}
+
+func TestServiceDuplicateNextHops(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	e := endpoints(st.namespace, st.name,
+		[]string{"10.5.1.2", "10.5.1.1", "10.5.1.2"}, st.ports)
+	e.Subsets[0].Addresses[0].Hostname = "web-1"
+	e.Subsets = append(e.Subsets,
+		endpoints(st.namespace, st.name,
+			[]string{"10.5.1.3", "10.5.1.1"}, st.ports).Subsets...)
+
+	agent.updateServiceDesc(false, s, e)
+	as, ok := agent.opflexServices[st.uuid]
+	if !assert.True(t, ok, "service") ||
+		!assert.Equal(t, 1, len(as.ServiceMappings), "mappings") {
+		return
+	}
+	sm := &as.ServiceMappings[0]
+	assert.Equal(t, []string{"10.5.1.1", "10.5.1.2", "10.5.1.3"},
+		sm.NextHopIps, "sorted")
+	assert.Equal(t, map[string]string{"10.5.1.2": "web-1"},
+		sm.NextHopHostnames, "hostnames")
+}
+
+func TestServiceNextHopOrder(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	sorted := []string{"10.5.1.2", "10.5.1.9", "10.5.1.10", "10.5.1.100",
+		"10.6.0.1"}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		shuffled := make([]string, len(sorted))
+		for j, k := range rnd.Perm(len(sorted)) {
+			shuffled[j] = sorted[k]
+		}
+		desc := fmt.Sprintf("shuffle %d: %v", i, shuffled)
+		changed := agent.updateServiceDesc(false, s,
+			endpoints(st.namespace, st.name, shuffled, st.ports))
+		assert.Equal(t, i == 0, changed, desc)
+		as, ok := agent.opflexServices[st.uuid]
+		if assert.True(t, ok, desc) &&
+			assert.Equal(t, 1, len(as.ServiceMappings), desc) {
+			assert.Equal(t, sorted, as.ServiceMappings[0].NextHopIps, desc)
+		}
+	}
+
+	mixed := []string{"fd00::10", "10.5.1.10", "bogus", "fd00::9", "10.5.1.9"}
+	sortNextHops(mixed)
+	assert.Equal(t, []string{"10.5.1.9", "10.5.1.10", "fd00::9", "fd00::10",
+		"bogus"}, mixed, "families")
+}
+
+func TestServiceDefaultProtocol(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := st.service()
+	s.Spec.Ports[0].Protocol = ""
+	e := st.endpoints()
+
+	for _, desc := range []string{"service", "endpoints"} {
+		if desc == "endpoints" {
+			s.Spec.Ports[0].Protocol = v1.ProtocolTCP
+			e.Subsets[0].Ports[0].Protocol = ""
+		}
+		assert.True(t, agent.updateServiceDesc(false, s, e), desc)
+		as, ok := agent.opflexServices[st.uuid]
+		if assert.True(t, ok, desc) &&
+			assert.Equal(t, 1, len(as.ServiceMappings), desc) {
+			assert.Equal(t, "tcp", as.ServiceMappings[0].ServiceProto, desc)
+			assert.Equal(t, st.nextHopIps,
+				as.ServiceMappings[0].NextHopIps, desc)
+		}
+		delete(agent.opflexServices, st.uuid)
+	}
+}
+
+func TestServiceNextHopPorts(t *testing.T) {
+	agent := testAgent()
+
+	st := &serviceTests[1]
+	s := service(st.uuid, st.namespace, st.name,
+		st.clusterIp, st.externalIp, nil)
+	s.Spec.Ports = []v1.ServicePort{
+		{Name: "web", Protocol: "TCP", Port: 80},
+	}
+	e := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: st.namespace,
+			Name:      st.name,
+		},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.5.1.1"}, {IP: "10.5.1.2"},
+				},
+				Ports: []v1.EndpointPort{
+					{Name: "web", Protocol: "TCP", Port: 8081},
+				},
+			},
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.5.1.3", Hostname: "web-3"},
+				},
+				Ports: []v1.EndpointPort{
+					{Name: "web", Protocol: "TCP", Port: 8080},
+				},
+			},
+		},
+	}
+
+	agent.updateServiceDesc(false, s, e)
+	as, ok := agent.opflexServices[st.uuid]
+	if !assert.True(t, ok, "mixed") ||
+		!assert.Equal(t, 1, len(as.ServiceMappings), "mixed") {
+		return
+	}
+	sm := &as.ServiceMappings[0]
+	assert.Equal(t, []string{"10.5.1.1", "10.5.1.2", "10.5.1.3"},
+		sm.NextHopIps, "mixed next-hop")
+	assert.Equal(t, uint16(8080), sm.NextHopPort, "mixed next-hop-port")
+	assert.Equal(t, map[string]uint16{
+		"10.5.1.1": 8081,
+		"10.5.1.2": 8081,
+		"10.5.1.3": 8080,
+	}, sm.NextHopPorts, "mixed next-hop-ports")
+	assert.Equal(t, map[string]string{"10.5.1.3": "web-3"},
+		sm.NextHopHostnames, "mixed hostnames")
+	raw, _ := json.Marshal(sm)
+	assert.Contains(t, string(raw),
+		`"next-hop-ports":{"10.5.1.1":8081,"10.5.1.2":8081,"10.5.1.3":8080}`,
+		"mixed json")
+
+	// uniform ports use only the scalar next hop port
+	e.Subsets[1].Ports[0].Port = 8081
+	agent.updateServiceDesc(false, s, e)
+	sm = &agent.opflexServices[st.uuid].ServiceMappings[0]
+	assert.Equal(t, uint16(8081), sm.NextHopPort, "uniform next-hop-port")
+	assert.Nil(t, sm.NextHopPorts, "uniform next-hop-ports")
+	raw, _ = json.Marshal(sm)
+	assert.NotContains(t, string(raw), "next-hop-ports", "uniform json")
+}
+
+func BenchmarkSyncServices(b *testing.B) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	agent.log.Level = logrus.WarnLevel
+
+	var services []*v1.Service
+	for i := 0; i < 1000; i++ {
+		s := service(fmt.Sprintf("uuid-%d", i), "testns",
+			fmt.Sprintf("service%d", i),
+			fmt.Sprintf("100.1.%d.%d", i/256, i%256), "", []int32{80})
+		agent.updateServiceDesc(false, s, endpoints("testns", s.Name,
+			[]string{"10.1.1.1", "10.1.1.2"}, []int32{80}))
+		services = append(services, s)
+	}
+	agent.syncServices()
+
+	// update the backends of a single service before each sync
+	update := func(i int) {
+		nextHopIps := []string{"10.1.1.1", "10.1.1.2"}
+		if i%2 == 0 {
+			nextHopIps = nextHopIps[:1]
+		}
+		agent.updateServiceDesc(false, services[0],
+			endpoints("testns", services[0].Name, nextHopIps, []int32{80}))
+	}
+
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			update(i)
+			agent.markAllServicesDirty()
+			agent.syncServices()
+		}
+	})
+	b.Run("changed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			update(i)
+			agent.syncServices()
+		}
+	})
+
+	// rewrite and flush every file, where the file IO dominates
+	agent.config.Fsync = true
+	for _, workers := range []int{1, 8} {
+		agent.config.OpFlexServiceSyncWorkers = workers
+		b.Run(fmt.Sprintf("rewrite-workers-%d", workers),
+			func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					agent.ForceServiceRewrite()
+					agent.syncServices()
+				}
+			})
+	}
+}
+
+func TestServiceSyncWorkers(t *testing.T) {
+	agent, tempdir := newSyncTestAgent(t)
+	defer os.RemoveAll(tempdir)
+	agent.config.OpFlexServiceSyncWorkers = 4
+
+	var services []*v1.Service
+	for i := 0; i < 50; i++ {
+		s := service(fmt.Sprintf("uuid-%d", i), "testns",
+			fmt.Sprintf("service%d", i),
+			fmt.Sprintf("100.1.1.%d", i), "", []int32{80})
+		agent.updateServiceDesc(false, s, endpoints("testns", s.Name,
+			[]string{"10.1.1.1"}, []int32{80}))
+		services = append(services, s)
+	}
+	// a stale file to remove
+	stale := filepath.Join(tempdir, "stale.service")
+	ioutil.WriteFile(stale, []byte("{}"), 0644)
+
+	check := func(desc string) {
+		assert.Nil(t, agent.serviceSyncErr, desc)
+		for _, s := range services {
+			uuid := string(s.ObjectMeta.UID)
+			expected := &opflexService{}
+			raw, err := ioutil.ReadFile(filepath.Join(tempdir, uuid+".service"))
+			if assert.Nil(t, err, desc) &&
+				assert.Nil(t, json.Unmarshal(raw, expected), desc) {
+				as := agent.opflexServices[uuid]
+				assert.Equal(t, as.ServiceMappings, expected.ServiceMappings,
+					desc)
+			}
+			_, err = os.Stat(filepath.Join(tempdir, uuid+".meta"))
+			assert.Nil(t, err, desc)
+		}
+		_, err := os.Stat(stale)
+		assert.True(t, os.IsNotExist(err), desc)
+	}
+
+	agent.markAllServicesDirty()
+	agent.syncServices()
+	check("full")
+
+	for i, s := range services {
+		if i%2 == 0 {
+			agent.updateServiceDesc(false, s, endpoints("testns", s.Name,
+				[]string{"10.1.1.2", "10.1.1.3"}, []int32{80}))
+		}
+	}
+	agent.syncServices()
+	check("changed")
+
+	// errors from every worker are collected
+	agent.config.OpFlexServiceDirRetries = 0
+	for _, s := range services[:3] {
+		uuid := string(s.ObjectMeta.UID)
+		os.Remove(filepath.Join(tempdir, uuid+".service"))
+		os.Mkdir(filepath.Join(tempdir, uuid+".service"), 0755)
+		ioutil.WriteFile(filepath.Join(tempdir, uuid+".service", "x"),
+			nil, 0644)
+	}
+	agent.ForceServiceRewrite()
+	agent.syncServices()
+	if assert.NotNil(t, agent.serviceSyncErr, "errors") {
+		assert.Contains(t, agent.serviceSyncErr.Error(), "and 2 more errors",
+			"errors")
+	}
+}
@@ -18,6 +18,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/noironetworks/aci-containers/pkg/metadata"
 )
@@ -28,6 +31,54 @@ type agentStatus struct {
 	PodIps    metadata.NetIps `json:"pod-ips,omitempty"`
 }
 
+type serviceReadyStatus struct {
+	Ready          bool      `json:"ready"`
+	InformerSynced bool      `json:"informer-synced"`
+	LastSync       time.Time `json:"last-sync"`
+	Error          string    `json:"error,omitempty"`
+}
+
+func informerSynced(informer cache.SharedIndexInformer) bool {
+	return informer == nil || informer.HasSynced()
+}
+
+// Report whether the service informers have synced and the last
+// service sync completed without errors.  An agent that does not sync
+// services because no service directory is configured is always
+// ready.
+func (agent *HostAgent) serviceReadyHandler(w http.ResponseWriter,
+	r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	agent.indexMutex.Lock()
+	status := &serviceReadyStatus{
+		InformerSynced: informerSynced(agent.serviceInformer) &&
+			informerSynced(agent.endpointsInformer),
+		LastSync: agent.serviceSyncTime,
+	}
+	if agent.serviceSyncErr != nil {
+		status.Error = agent.serviceSyncErr.Error()
+	}
+	agent.indexMutex.Unlock()
+
+	status.Ready = !agent.syncConfigured() || (status.InformerSynced &&
+		!status.LastSync.IsZero() && status.Error == "")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Report the number of updates that changed the opflex services for
+// each Kubernetes service, to help find services with flapping
+// backends
+func (agent *HostAgent) serviceChangesHandler(w http.ResponseWriter,
+	r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	agent.indexMutex.Lock()
+	json.NewEncoder(w).Encode(agent.serviceChanges)
+	agent.indexMutex.Unlock()
+}
+
 func (agent *HostAgent) RunStatus() {
 	if agent.config.StatusPort <= 0 {
 		return
@@ -73,6 +124,8 @@ func (agent *HostAgent) RunStatus() {
 		json.NewEncoder(w).Encode(status)
 		agent.indexMutex.Unlock()
 	})
+	http.HandleFunc("/ready", agent.serviceReadyHandler)
+	http.HandleFunc("/service-changes", agent.serviceChangesHandler)
 	agent.log.Info("Starting status server")
 	panic(http.ListenAndServe(fmt.Sprintf(":%d", agent.config.StatusPort), nil))
 }
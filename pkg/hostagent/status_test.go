@@ -0,0 +1,116 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostagent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	tu "github.com/noironetworks/aci-containers/pkg/testutil"
+)
+
+func getServiceReady(agent *testHostAgent) (int, *serviceReadyStatus) {
+	rec := httptest.NewRecorder()
+	agent.serviceReadyHandler(rec,
+		httptest.NewRequest("GET", "/ready", nil))
+	status := &serviceReadyStatus{}
+	json.Unmarshal(rec.Body.Bytes(), status)
+	return rec.Code, status
+}
+
+func TestServiceReady(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "hostagent_test_")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	agent := testAgent()
+	agent.config.OpFlexEndpointDir = tempdir
+	agent.config.OpFlexServiceDir = tempdir
+
+	code, _ := getServiceReady(agent)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "before sync")
+
+	agent.run()
+	tu.WaitFor(t, "ready", 500*time.Millisecond,
+		func(last bool) (bool, error) {
+			code, _ := getServiceReady(agent)
+			return tu.WaitEqual(t, last, http.StatusOK, code, "ready"), nil
+		})
+	agent.stop()
+
+	// the service directory cannot be created under a regular file
+	blocker := filepath.Join(tempdir, "blocker")
+	ioutil.WriteFile(blocker, []byte{}, 0644)
+	agent.config.OpFlexServiceDir = filepath.Join(blocker, "services")
+	agent.syncServices()
+	code, status := getServiceReady(agent)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "sync error")
+	assert.True(t, status.InformerSynced, "informer synced")
+	assert.False(t, status.LastSync.IsZero(), "last sync")
+	assert.NotEqual(t, "", status.Error, "error")
+
+	// an agent that does not sync services is ready without a sync
+	agent = testAgent()
+	code, _ = getServiceReady(agent)
+	assert.Equal(t, http.StatusOK, code, "sync not configured")
+}
+
+func TestServiceChanges(t *testing.T) {
+	agent := testAgent()
+
+	flapping := &serviceTests[0]
+	stable := &serviceTests[1]
+	for _, st := range []*serviceTest{flapping, stable} {
+		agent.serviceInformer.GetStore().Add(service(st.uuid,
+			st.namespace, st.name, st.clusterIp, "", st.ports))
+		agent.endpointsInformer.GetStore().Add(endpoints(st.namespace,
+			st.name, st.nextHopIps, st.ports))
+	}
+
+	for i := 0; i < 3; i++ {
+		// alternate the backends of one service
+		nextHopIps := flapping.nextHopIps
+		if i%2 == 1 {
+			nextHopIps = nextHopIps[:1]
+		}
+		agent.endpointsInformer.GetStore().Update(endpoints(
+			flapping.namespace, flapping.name, nextHopIps, flapping.ports))
+
+		agent.indexMutex.Lock()
+		agent.doUpdateService(flapping.namespace + "/" + flapping.name)
+		agent.doUpdateService(stable.namespace + "/" + stable.name)
+		agent.indexMutex.Unlock()
+	}
+
+	rec := httptest.NewRecorder()
+	agent.serviceChangesHandler(rec,
+		httptest.NewRequest("GET", "/service-changes", nil))
+	changes := make(map[string]uint64)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &changes), "unmarshal")
+	assert.Equal(t, uint64(3),
+		changes[flapping.namespace+"/"+flapping.name], "flapping")
+	assert.Equal(t, uint64(1),
+		changes[stable.namespace+"/"+stable.name], "stable")
+}
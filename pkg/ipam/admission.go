@@ -0,0 +1,111 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Why a pool cannot host a new service IP
+type AdmissionReason int
+
+const (
+	// The pool has no allocatable address
+	AdmissionExhausted AdmissionReason = iota
+	// The requested address is not of the address family of the pool
+	AdmissionFamilyMismatch
+	// The requested address is excluded from allocation
+	AdmissionExcluded
+	// The requested address is not free
+	AdmissionUnavailable
+)
+
+func (r AdmissionReason) String() string {
+	switch r {
+	case AdmissionExhausted:
+		return "exhausted"
+	case AdmissionFamilyMismatch:
+		return "family mismatch"
+	case AdmissionExcluded:
+		return "excluded"
+	case AdmissionUnavailable:
+		return "unavailable"
+	default:
+		return "unknown"
+	}
+}
+
+// The error returned by AdmitServiceIp when the pool cannot host the
+// service IP.  Ip is the requested address, or nil if none was
+// requested.
+type AdmissionError struct {
+	Reason AdmissionReason
+	Ip     net.IP
+}
+
+func (e *AdmissionError) Error() string {
+	if e.Ip == nil {
+		return fmt.Sprintf("Cannot allocate service IP: %s", e.Reason)
+	}
+	return fmt.Sprintf("Cannot allocate service IP %s: %s", e.Ip, e.Reason)
+}
+
+// Check whether the pool could host a new service IP without
+// allocating anything, so that a controller can reject a service
+// before creating it.  If ip is nil, any allocatable address will do;
+// otherwise that address must be free, of the family of the pool and
+// not excluded.  Returns nil if the service IP would be admitted, and
+// otherwise an *AdmissionError with the reason.
+func (ipa *IpAlloc) AdmitServiceIp(ip net.IP) error {
+	if ip == nil {
+		for free, ok := ipa.firstFree(); ok; free, ok = ipa.NextFree(free) {
+			if !ipa.isExcluded(free) {
+				return nil
+			}
+		}
+		return &AdmissionError{Reason: AdmissionExhausted}
+	}
+
+	if ref := familyRef(ipa); ref != nil &&
+		(ref.To4() != nil) != (ip.To4() != nil) {
+		return &AdmissionError{Reason: AdmissionFamilyMismatch, Ip: ip}
+	}
+	canonical := ipa.canonicalIp(ip)
+	if ipa.isExcluded(canonical) {
+		return &AdmissionError{Reason: AdmissionExcluded, Ip: ip}
+	}
+	i := sort.Search(len(ipa.FreeList), func(i int) bool {
+		return bytes.Compare(ipa.FreeList[i].End, canonical) >= 0
+	})
+	if i < len(ipa.FreeList) &&
+		bytes.Compare(ipa.FreeList[i].Start, canonical) <= 0 {
+		return nil
+	}
+	if ipa.Empty() {
+		return &AdmissionError{Reason: AdmissionExhausted, Ip: ip}
+	}
+	return &AdmissionError{Reason: AdmissionUnavailable, Ip: ip}
+}
+
+// Get the lowest free address without allocating it
+func (ipa *IpAlloc) firstFree() (net.IP, bool) {
+	if len(ipa.FreeList) == 0 {
+		return nil, false
+	}
+	return ipa.FreeList[0].Start, true
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func admissionReason(err error) (AdmissionReason, bool) {
+	aerr, ok := err.(*AdmissionError)
+	if !ok {
+		return 0, false
+	}
+	return aerr.Reason, true
+}
+
+func TestAdmitServiceIp(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3")},
+	})
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.1.3")})
+
+	assert.Nil(t, ipa.AdmitServiceIp(nil), "any")
+	assert.Nil(t, ipa.AdmitServiceIp(net.ParseIP("10.0.1.2")), "free")
+	assert.Nil(t, ipa.AdmitServiceIp(net.ParseIP("10.0.1.2").To4()),
+		"free 4-byte")
+
+	tests := []struct {
+		ip     string
+		reason AdmissionReason
+		desc   string
+	}{
+		{"fd00::1", AdmissionFamilyMismatch, "family"},
+		{"10.0.1.3", AdmissionExcluded, "excluded"},
+		{"10.0.2.1", AdmissionUnavailable, "outside pool"},
+	}
+	for _, at := range tests {
+		err := ipa.AdmitServiceIp(net.ParseIP(at.ip))
+		reason, ok := admissionReason(err)
+		if assert.True(t, ok, at.desc) {
+			assert.Equal(t, at.reason, reason, at.desc)
+			assert.Contains(t, err.Error(), at.ip, at.desc)
+		}
+	}
+
+	ip, err := ipa.GetIp()
+	assert.Nil(t, err, "allocate")
+	reason, _ := admissionReason(ipa.AdmitServiceIp(ip))
+	assert.Equal(t, AdmissionUnavailable, reason, "allocated")
+
+	// only the excluded address is left
+	ipa.GetIp()
+	reason, _ = admissionReason(ipa.AdmitServiceIp(nil))
+	assert.Equal(t, AdmissionExhausted, reason, "only excluded left")
+	assert.Equal(t, int64(1), ipa.GetSize(), "nothing allocated")
+
+	ipa.GetIpChunk(1)
+	reason, _ = admissionReason(ipa.AdmitServiceIp(nil))
+	assert.Equal(t, AdmissionExhausted, reason, "empty")
+	reason, _ = admissionReason(ipa.AdmitServiceIp(net.ParseIP("10.0.1.1")))
+	assert.Equal(t, AdmissionExhausted, reason, "empty with address")
+	assert.Equal(t, "exhausted", AdmissionExhausted.String(), "string")
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// The kind of an allocator event
+type AllocEventType int
+
+const (
+	// An address was handed out
+	AllocEventAllocated AllocEventType = iota
+	// An allocated address was returned to the free list
+	AllocEventReleased
+	// An allocation failed because the pool is empty
+	AllocEventExhausted
+)
+
+func (t AllocEventType) String() string {
+	switch t {
+	case AllocEventAllocated:
+		return "allocated"
+	case AllocEventReleased:
+		return "released"
+	case AllocEventExhausted:
+		return "exhausted"
+	default:
+		return "unknown"
+	}
+}
+
+// An event emitted by an IP pool.  Ip is nil for exhausted events.
+type AllocEvent struct {
+	Type AllocEventType
+	Ip   net.IP
+}
+
+// Number of events buffered for a slow consumer before the oldest
+// events are dropped
+const AllocEventBufferSize = 256
+
+type allocEvents struct {
+	// accessed atomically; first in the struct for alignment
+	dropped uint64
+
+	ch chan AllocEvent
+}
+
+// Get a channel of events for the addresses handed out by GetIp,
+// GetIpNear, GetIpPreferred and MarkAllocated and for their release
+// back to the free list, and for allocations that fail because the
+// pool is empty.  The channel is buffered so the allocator never
+// blocks on a slow consumer; when the buffer is full the oldest event
+// is dropped and counted in DroppedEvents.  All callers share the same
+// channel.
+func (ipa *IpAlloc) Events() <-chan AllocEvent {
+	if ipa.events == nil {
+		ipa.events = &allocEvents{
+			ch: make(chan AllocEvent, AllocEventBufferSize),
+		}
+	}
+	return ipa.events.ch
+}
+
+// Get the number of events dropped because the event channel was full
+func (ipa *IpAlloc) DroppedEvents() uint64 {
+	if ipa.events == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&ipa.events.dropped)
+}
+
+func (ipa *IpAlloc) emitEvent(t AllocEventType, ip net.IP) {
+	events := ipa.events
+	if events == nil {
+		return
+	}
+	event := AllocEvent{Type: t, Ip: ip}
+	for {
+		select {
+		case events.ch <- event:
+			return
+		default:
+		}
+		select {
+		case <-events.ch:
+			atomic.AddUint64(&events.dropped, 1)
+		default:
+		}
+	}
+}
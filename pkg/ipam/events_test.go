@@ -0,0 +1,78 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drainEvents(events <-chan AllocEvent) []AllocEvent {
+	var result []AllocEvent
+	for {
+		select {
+		case e := <-events:
+			result = append(result, e)
+		default:
+			return result
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+	})
+	events := ipa.Events()
+
+	ip1, _ := ipa.GetIp()
+	ipa.GetIp()
+	_, err := ipa.GetIp()
+	assert.NotNil(t, err, "exhausted")
+	ipa.AddIp(ip1)
+	ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2"))
+
+	assert.Equal(t, []AllocEvent{
+		{AllocEventAllocated, net.ParseIP("10.0.1.1")},
+		{AllocEventAllocated, net.ParseIP("10.0.1.2")},
+		{AllocEventExhausted, nil},
+		{AllocEventReleased, net.ParseIP("10.0.1.1")},
+		{AllocEventReleased, net.ParseIP("10.0.1.2")},
+	}, drainEvents(events), "events")
+	assert.Equal(t, uint64(0), ipa.DroppedEvents(), "dropped")
+	assert.Equal(t, "released", AllocEventReleased.String(), "string")
+}
+
+func TestEventsDropOldest(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/16")
+	ipa := New()
+	ipa.AddSubnet(subnet)
+	events := ipa.Events()
+
+	var last net.IP
+	for i := 0; i < AllocEventBufferSize+10; i++ {
+		last, _ = ipa.GetIp()
+	}
+	assert.Equal(t, uint64(10), ipa.DroppedEvents(), "dropped")
+
+	result := drainEvents(events)
+	if assert.Equal(t, AllocEventBufferSize, len(result), "buffered") {
+		assert.Equal(t, net.ParseIP("10.0.0.10").To4(), result[0].Ip,
+			"oldest")
+		assert.Equal(t, last, result[len(result)-1].Ip, "newest")
+	}
+}
@@ -17,16 +17,20 @@ package ipam
 
 import (
 	"bytes"
-
+	"context"
 	"errors"
+	"fmt"
 	"math"
 	"math/big"
 	"net"
 	"sort"
+	"strings"
+	"time"
 )
 
 // A range of IP addresses starting at Start and ending at End
-// (inclusive)
+// (inclusive).  Since net.IP marshals as text, a range serializes to
+// JSON as address strings, e.g. {"start":"10.0.0.1","end":"10.0.1.254"}.
 type IpRange struct {
 	Start net.IP `json:"start,omitempty"`
 	End   net.IP `json:"end,omitempty"`
@@ -36,6 +40,34 @@ type IpRange struct {
 // addresses can be either v4 or v6, but not both
 type IpAlloc struct {
 	FreeList []IpRange
+
+	reservations map[string]reservation
+	stats        *allocStats
+	events       *allocEvents
+
+	// Ranges set by ApplyConfig, merged, and as they were given
+	configured       *IpAlloc
+	configuredRanges []IpRange
+
+	// Ranges whose first addresses were reserved by ReserveRangeHeads
+	headRanges []IpRange
+
+	// Chooses the addresses handed out by GetIp, or nil for the
+	// lowest free address
+	policy AllocationPolicy
+
+	// Free addresses that GetIp must not hand out, keyed by the
+	// 16-byte form of the address
+	exclusions map[string]bool
+
+	// Addresses handed out by GetIp and GetIpNear that have not been
+	// returned to the free list
+	allocated map[string]net.IP
+
+	// How long addresses released by ReleaseIp and ReleaseRange are
+	// held out of the free list, and the ranges being held
+	quarantineTime time.Duration
+	quarantined    []quarantinedRange
 }
 
 // Create a new IpAlloc
@@ -106,20 +138,70 @@ func (ipa *IpAlloc) fixRange(index int) {
 		i = 0
 	}
 
-	// iterate until we hit a disjoint range or the freelist compresses
-	// to a single item at the current index.
-	for i+1 < len(ipa.FreeList) &&
-		isAdjOrGreater(ipa.FreeList[i].End, ipa.FreeList[i+1].Start) {
+	// merge the range at index into the range before it, then merge
+	// the following ranges into the result until we hit a disjoint
+	// range.  The range at index must be checked against the ranges
+	// after it even if it is disjoint from the range before it.
+	for i+1 < len(ipa.FreeList) {
+		if !isAdjOrGreater(ipa.FreeList[i].End, ipa.FreeList[i+1].Start) {
+			if i >= index {
+				break
+			}
+			i++
+			continue
+		}
 
 		if bytes.Compare(ipa.FreeList[i].End, ipa.FreeList[i+1].End) < 0 {
 			ipa.FreeList[i].End = ipa.FreeList[i+1].End
 		}
-		if len(ipa.FreeList) > i+1 {
-			ipa.FreeList = append(ipa.FreeList[:i+1], ipa.FreeList[i+2:]...)
-		} else {
-			ipa.FreeList = ipa.FreeList[:i+1]
+		ipa.FreeList = append(ipa.FreeList[:i+1], ipa.FreeList[i+2:]...)
+	}
+}
+
+// Get an address of the pool to compare address families with: the
+// first free address, or otherwise an allocated, quarantined or the
+// first configured address, so an exhausted pool keeps its family and
+// representation.  Returns nil if the pool has never held any
+// addresses.
+func familyRef(pool *IpAlloc) net.IP {
+	if len(pool.FreeList) > 0 {
+		return pool.FreeList[0].Start
+	}
+	for _, ip := range pool.allocated {
+		return ip
+	}
+	if len(pool.quarantined) > 0 {
+		return pool.quarantined[0].r.Start
+	}
+	if len(pool.configuredRanges) > 0 {
+		return pool.configuredRanges[0].Start
+	}
+	return nil
+}
+
+// Convert the IP address to the representation used in the free list,
+// so that an IPv4 address and its IPv4-mapped IPv6 form are treated as
+// the same address.  Returns nil if the address does not belong to the
+// same family as the addresses already in the pool.
+func (ipa *IpAlloc) canonicalIp(ip net.IP) net.IP {
+	ref := familyRef(ipa)
+	if ip == nil || ref == nil {
+		return ip
+	}
+	v4 := ip.To4()
+	if ref.To4() != nil {
+		if v4 == nil {
+			return nil
 		}
+		if len(ref) == net.IPv4len {
+			return v4
+		}
+		return v4.To16()
+	}
+	if v4 != nil {
+		return nil
 	}
+	return ip.To16()
 }
 
 // Add the range of IP addresses provides to the free list
@@ -127,9 +209,11 @@ func (ipa *IpAlloc) fixRange(index int) {
 //example: ipa.FreeList = [{10.2.1.2 10.2.1.129}]
 //After the following function the ipa.Freelist = [{10.2.1.1 10.2.1.129}]
 func (ipa *IpAlloc) AddRange(start net.IP, end net.IP) {
-	if bytes.Compare(start, end) > 0 {
+	start, end = ipa.canonicalIp(start), ipa.canonicalIp(end)
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
 		return
 	}
+	ipa.releaseAllocated(start, end)
 	i := sort.Search(len(ipa.FreeList), func(i int) bool {
 		if i >= len(ipa.FreeList) || i < 0 {
 			return true
@@ -142,6 +226,7 @@ func (ipa *IpAlloc) AddRange(start net.IP, end net.IP) {
 	item := IpRange{Start: start, End: end}
 	i = ipa.addToFree(item, i)
 	ipa.fixRange(i)
+	ipa.updateStats()
 }
 
 func (ipa *IpAlloc) addToFree(item IpRange, pos int) int {
@@ -171,60 +256,68 @@ func (ipa *IpAlloc) AddSubnet(subnet *net.IPNet) {
 	ipa.AddRange(subnetRange(subnet))
 }
 
-func cutRange(target IpRange, start net.IP, end net.IP) ([]IpRange, bool) {
-	result := make([]IpRange, 0)
-	changed := true
+// Remove all the IP addresses in the range from the free list
+func (ipa *IpAlloc) RemoveRange(start net.IP, end net.IP) bool {
+	return ipa.removeRange(start, end).Sign() > 0
+}
 
-	if bytes.Compare(target.Start, start) < 0 {
-		if bytes.Compare(target.End, start) >= 0 {
-			startdec, _ := carryDecrement(start)
-			result = append(result, IpRange{target.Start, startdec})
-		} else {
-			result = append(result, target)
-			changed = false
-		}
-	}
-	if bytes.Compare(target.End, end) > 0 {
-		if bytes.Compare(target.Start, end) <= 0 {
-			endinc, _ := carryIncrement(end)
-			result = append(result, IpRange{endinc, target.End})
-		} else {
-			result = append(result, target)
-			changed = false
-		}
-	}
-	return result, changed
+// Remove all the IP addresses in the range from the free list and
+// return the number of addresses actually removed, which is less than
+// the size of the range if part of it was not free
+func (ipa *IpAlloc) RemoveRangeCount(start net.IP, end net.IP) int64 {
+	return clampSize(ipa.removeRange(start, end))
 }
 
-// Remove all the IP addresses in the range from the free list
-func (ipa *IpAlloc) RemoveRange(start net.IP, end net.IP) bool {
-	changed := false
-	if bytes.Compare(start, end) > 0 {
-		return changed
+func (ipa *IpAlloc) removeRange(start net.IP, end net.IP) *big.Int {
+	removed := big.NewInt(0)
+	start, end = ipa.canonicalIp(start), ipa.canonicalIp(end)
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+		return removed
 	}
 
-	startind := sort.Search(len(ipa.FreeList), func(i int) bool {
-		return bytes.Compare(ipa.FreeList[i].Start, start) >= 0
+	// The free list is sorted and disjoint, so the fragments
+	// overlapping the range are exactly those in [lo, hi)
+	lo := sort.Search(len(ipa.FreeList), func(i int) bool {
+		return bytes.Compare(ipa.FreeList[i].End, start) >= 0
 	})
-	endind := sort.Search(len(ipa.FreeList), func(i int) bool {
-		return bytes.Compare(ipa.FreeList[i].End, end) >= 0
+	hi := sort.Search(len(ipa.FreeList), func(i int) bool {
+		return bytes.Compare(ipa.FreeList[i].Start, end) > 0
 	})
+	if lo >= hi {
+		return removed
+	}
+	for i := lo; i < hi; i++ {
+		removed.Add(removed, rangeSize(ipa.FreeList[i]))
+	}
 
-	i := startind
+	// Only the first and last overlapping fragments can have
+	// addresses left over outside the range
+	pieces := make([]IpRange, 0, 2)
+	if first := ipa.FreeList[lo]; bytes.Compare(first.Start, start) < 0 {
+		startdec, _ := carryDecrement(start)
+		pieces = append(pieces, IpRange{first.Start, startdec})
+	}
+	if last := ipa.FreeList[hi-1]; bytes.Compare(last.End, end) > 0 {
+		endinc, _ := carryIncrement(end)
+		pieces = append(pieces, IpRange{endinc, last.End})
+	}
 
-	for i > 0 &&
-		(i >= len(ipa.FreeList) ||
-			bytes.Compare(ipa.FreeList[i].End, start) >= 0) {
-		i--
+	for _, r := range pieces {
+		removed.Sub(removed, rangeSize(r))
 	}
 
-	for i < len(ipa.FreeList) && i <= endind {
-		r, rchanged := cutRange(ipa.FreeList[i], start, end)
-		changed = changed || rchanged
-		ipa.FreeList = append(ipa.FreeList[:i], append(r, ipa.FreeList[i+1:]...)...)
-		i += len(r)
+	// Replace the overlapping fragments with the leftover pieces in
+	// place
+	tail := len(ipa.FreeList) - hi
+	newHi := lo + len(pieces)
+	if newHi > hi {
+		ipa.FreeList = append(ipa.FreeList, make([]IpRange, newHi-hi)...)
 	}
-	return changed
+	copy(ipa.FreeList[newHi:], ipa.FreeList[hi:hi+tail])
+	copy(ipa.FreeList[lo:], pieces)
+	ipa.FreeList = ipa.FreeList[:newHi+tail]
+	ipa.updateStats()
+	return removed
 }
 
 // Remove the given subnet from the free list
@@ -237,11 +330,20 @@ func (ipa *IpAlloc) RemoveIp(ip net.IP) bool {
 	return ipa.RemoveRange(ip, ip)
 }
 
-// Return a free IP address and remove it from the free list
+// Return a free IP address and remove it from the free list.  The
+// address is chosen by the allocation policy of the pool, which by
+// default is the lowest free address.
 func (ipa *IpAlloc) GetIp() (net.IP, error) {
 	if len(ipa.FreeList) == 0 {
+		ipa.emitEvent(AllocEventExhausted, nil)
 		return nil, errors.New("No IP addresses are available")
 	}
+	if ipa.policy != nil {
+		return ipa.getIpWithPolicy()
+	}
+	if len(ipa.exclusions) > 0 {
+		return ipa.getIpExcluding()
+	}
 
 	result := ipa.FreeList[0].Start
 	if bytes.Compare(ipa.FreeList[0].Start, ipa.FreeList[0].End) == 0 {
@@ -250,13 +352,319 @@ func (ipa *IpAlloc) GetIp() (net.IP, error) {
 		news, _ := carryIncrement(ipa.FreeList[0].Start)
 		ipa.FreeList[0].Start = news
 	}
+	ipa.trackAllocated(result)
+	ipa.updateStats()
 	return result, nil
 }
 
+// Return a free IP address and remove it from the free list, or the
+// context error if the context is done before an address could be
+// allocated.  Allocation does not currently block, so this returns
+// immediately when the pool is exhausted.
+func (ipa *IpAlloc) GetIpContext(ctx context.Context) (net.IP, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ipa.GetIp()
+}
+
+// Return a free IP address and remove it from the free list.  Also
+// returns the free range containing the address as it was before the
+// address was removed.
+func (ipa *IpAlloc) GetIpWithRange() (net.IP, IpRange, error) {
+	if len(ipa.FreeList) == 0 {
+		ipa.emitEvent(AllocEventExhausted, nil)
+		return nil, IpRange{}, errors.New("No IP addresses are available")
+	}
+
+	free := append([]IpRange(nil), ipa.FreeList...)
+	ip, err := ipa.GetIp()
+	if err != nil {
+		return nil, IpRange{}, err
+	}
+	for _, r := range free {
+		if bytes.Compare(ip, r.Start) >= 0 && bytes.Compare(ip, r.End) <= 0 {
+			return ip, r, nil
+		}
+	}
+	return ip, IpRange{}, nil
+}
+
+// Return the free IP address numerically closest to the reference
+// address and remove it from the free list.  Ties are resolved toward
+// the lower address.  Dynamically excluded addresses are skipped as
+// they are by GetIp, but the reference address takes the place of the
+// allocation policy, as the preferred address does for GetIpPreferred.
+func (ipa *IpAlloc) GetIpNear(ref net.IP) (net.IP, error) {
+	free := ipa.allocatableRanges()
+	if len(free) == 0 {
+		ipa.emitEvent(AllocEventExhausted, nil)
+		return nil, errors.New("No IP addresses are available")
+	}
+	ref = ipa.canonicalIp(ref)
+	if ref == nil {
+		return nil, errors.New("Invalid reference IP address")
+	}
+
+	refInt := new(big.Int).SetBytes(ref)
+	var result net.IP
+	var best *big.Int
+	for _, r := range free {
+		var candidate net.IP
+		var dist *big.Int
+		if bytes.Compare(ref, r.Start) < 0 {
+			candidate = r.Start
+			dist = new(big.Int).Sub(new(big.Int).SetBytes(r.Start), refInt)
+		} else if bytes.Compare(ref, r.End) > 0 {
+			candidate = r.End
+			dist = new(big.Int).Sub(refInt, new(big.Int).SetBytes(r.End))
+		} else {
+			result = ref
+			break
+		}
+
+		if best == nil || dist.Cmp(best) < 0 {
+			result = candidate
+			best = dist
+		} else {
+			// the free list is sorted so the distance only
+			// increases from here
+			break
+		}
+	}
+
+	ipa.RemoveIp(result)
+	ipa.trackAllocated(result)
+	return result, nil
+}
+
+// Set the addresses that GetIp and GetIpPreferred must not hand out,
+// replacing any previous exclusions.  Excluded addresses stay in the
+// free list, so they count toward the size of the pool and become
+// allocatable again once they are no longer excluded.
+func (ipa *IpAlloc) SetDynamicExclusions(ips []net.IP) {
+	ipa.exclusions = make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if ip16 := ip.To16(); ip16 != nil {
+			ipa.exclusions[string(ip16)] = true
+		}
+	}
+}
+
+func (ipa *IpAlloc) isExcluded(ip net.IP) bool {
+	return ipa.exclusions[string(ip.To16())]
+}
+
+// Get the free ranges that addresses are allocated from: the free list
+// without the dynamically excluded addresses
+func (ipa *IpAlloc) allocatableRanges() []IpRange {
+	if len(ipa.exclusions) == 0 {
+		return ipa.FreeList
+	}
+	allowed := NewFromRanges(ipa.FreeList)
+	for key := range ipa.exclusions {
+		allowed.RemoveIp(net.IP(key))
+	}
+	return allowed.FreeList
+}
+
+// Allocate the lowest free address that is not excluded
+func (ipa *IpAlloc) getIpExcluding() (net.IP, error) {
+	for _, r := range ipa.FreeList {
+		ip := r.Start
+		for bytes.Compare(ip, r.End) <= 0 {
+			if !ipa.isExcluded(ip) {
+				result := append(net.IP(nil), ip...)
+				ipa.RemoveIp(result)
+				ipa.trackAllocated(result)
+				return result, nil
+			}
+			next, carry := carryIncrement(ip)
+			if carry {
+				break
+			}
+			ip = next
+		}
+	}
+	ipa.emitEvent(AllocEventExhausted, nil)
+	return nil, errors.New("No IP addresses are available")
+}
+
+// Return the preferred IP address if it is free, or any other free IP
+// address if it is not, and remove the returned address from the free
+// list.  Callers can compare the result with the preferred address to
+// tell which they got.  Returns an error only if the pool is empty.
+func (ipa *IpAlloc) GetIpPreferred(pref net.IP) (net.IP, error) {
+	if pref = ipa.canonicalIp(pref); pref != nil && !ipa.isExcluded(pref) &&
+		ipa.RemoveIp(pref) {
+		ipa.trackAllocated(pref)
+		return pref, nil
+	}
+	return ipa.GetIp()
+}
+
+// Return n free IP addresses and remove them from the free list.  The
+// lowest-addressed run of n consecutive allocatable addresses is
+// returned if there is one, and the second return value is then true.
+// Otherwise the addresses are chosen one at a time as by GetIp and
+// the second return value is false.  Returns an error and allocates
+// nothing if fewer than n addresses can be allocated.
+func (ipa *IpAlloc) GetIpBatch(n int) ([]net.IP, bool, error) {
+	if n <= 0 {
+		return []net.IP{}, true, nil
+	}
+
+	if start, ok := ipa.findAllocatableRun(big.NewInt(int64(n))); ok {
+		ips := make([]net.IP, 0, n)
+		for ip := start; len(ips) < n; ip, _ = carryIncrement(ip) {
+			ips = append(ips, net.IP(ip))
+		}
+		ipa.RemoveRange(ips[0], ips[n-1])
+		for _, ip := range ips {
+			ipa.trackAllocated(ip)
+		}
+		return ips, true, nil
+	}
+
+	ips := make([]net.IP, 0, n)
+	for len(ips) < n {
+		ip, err := ipa.GetIp()
+		if err != nil {
+			for _, ip := range ips {
+				ipa.AddIp(ip)
+			}
+			return nil, false, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, false, nil
+}
+
+// Find the first address of the lowest-addressed run of size free
+// addresses containing no dynamically excluded address
+func (ipa *IpAlloc) findAllocatableRun(size *big.Int) (net.IP, bool) {
+	var excluded []net.IP
+	for key := range ipa.exclusions {
+		if ip := ipa.canonicalIp(net.IP(key)); ip != nil {
+			excluded = append(excluded, ip)
+		}
+	}
+	sort.Slice(excluded, func(i, j int) bool {
+		return bytes.Compare(excluded[i], excluded[j]) < 0
+	})
+
+	for _, r := range ipa.FreeList {
+		// split the range at the excluded addresses it contains
+		start := r.Start
+		i := sort.Search(len(excluded), func(i int) bool {
+			return bytes.Compare(excluded[i], r.Start) >= 0
+		})
+		for ; ; i++ {
+			end := r.End
+			last := i >= len(excluded) || bytes.Compare(excluded[i], r.End) > 0
+			if !last {
+				end, _ = carryDecrement(excluded[i])
+			}
+			if bytes.Compare(start, end) <= 0 &&
+				rangeSize(IpRange{start, end}).Cmp(size) >= 0 {
+				return start, true
+			}
+			if last {
+				break
+			}
+			var carry bool
+			if start, carry = carryIncrement(excluded[i]); carry {
+				break
+			}
+		}
+	}
+	return nil, false
+}
+
+// Remove addresses that are already in use from the free list, for
+// example to rebuild the pool after a restart once the configured
+// ranges have been added.  The addresses are tracked as allocated.
+// Returns an error listing any addresses that are not in the free
+// list; the remaining addresses are still marked allocated.
+func (ipa *IpAlloc) MarkAllocated(ips []net.IP) error {
+	var missing []string
+	for _, ip := range ips {
+		canonical := ipa.canonicalIp(ip)
+		if canonical == nil || !ipa.RemoveIp(canonical) {
+			missing = append(missing, ip.String())
+			continue
+		}
+		ipa.trackAllocated(canonical)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("IP addresses are not free in the pool: %s",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Allocated addresses are keyed by their 16-byte form, so an IPv4
+// address is found whichever representation it is given in
+func (ipa *IpAlloc) trackAllocated(ip net.IP) {
+	if ipa.allocated == nil {
+		ipa.allocated = make(map[string]net.IP)
+	}
+	ipa.allocated[string(ip.To16())] = ip
+	ipa.emitEvent(AllocEventAllocated, ip)
+}
+
+// Forget any allocated addresses in the range, which is being returned
+// to the free list
+func (ipa *IpAlloc) releaseAllocated(start net.IP, end net.IP) {
+	start, end = start.To16(), end.To16()
+	if bytes.Equal(start, end) {
+		if ip, ok := ipa.allocated[string(start)]; ok {
+			delete(ipa.allocated, string(start))
+			ipa.emitEvent(AllocEventReleased, ip)
+		}
+		return
+	}
+	var released []net.IP
+	for key, ip := range ipa.allocated {
+		if bytes.Compare([]byte(key), start) >= 0 &&
+			bytes.Compare([]byte(key), end) <= 0 {
+			delete(ipa.allocated, key)
+			released = append(released, ip)
+		}
+	}
+	if ipa.events == nil {
+		return
+	}
+	sort.Slice(released, func(i, j int) bool {
+		return bytes.Compare(released[i], released[j]) < 0
+	})
+	for _, ip := range released {
+		ipa.emitEvent(AllocEventReleased, ip)
+	}
+}
+
+// Get the addresses handed out by GetIp, GetIpNear and GetIpPreferred
+// or marked with MarkAllocated that have not since been returned to
+// the free list, in ascending order.  Addresses removed from the free
+// list by other means, such as RemoveRange or GetIpChunk, are not
+// included.
+func (ipa *IpAlloc) AllocatedIps() []net.IP {
+	result := make([]net.IP, 0, len(ipa.allocated))
+	for _, ip := range ipa.allocated {
+		result = append(result, ip)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i], result[j]) < 0
+	})
+	return result
+}
+
 var one = big.NewInt(1)
 
 // Return a set of ranges containing at chunkSize IP addresses and
-// remove them from the free list.
+// remove them from the free list.  The chunk size is a count of
+// addresses regardless of family, so a chunk of 256 is a /24 for IPv4
+// but only a /120 for IPv6.
 func (ipa *IpAlloc) GetIpChunk(chunkSize int64) ([]IpRange, error) {
 	currentSize := int64(0)
 	result := New()
@@ -285,11 +693,9 @@ func (ipa *IpAlloc) GetIpChunk(chunkSize int64) ([]IpRange, error) {
 			currentSize += rangeSize.Int64()
 		} else {
 			// take as much as we need
-			newend :=
-				new(big.Int).Sub(new(big.Int).Add(start, needed), one).Bytes()
-			if len(newend) < len(r.End) {
-				newend = append(make([]byte, len(r.End)-len(newend)), newend...)
-			}
+			newend := bigToIp(
+				new(big.Int).Sub(new(big.Int).Add(start, needed), one),
+				len(r.End))
 
 			result.AddRange(r.Start, newend)
 			ipa.RemoveRange(r.Start, newend)
@@ -300,6 +706,216 @@ func (ipa *IpAlloc) GetIpChunk(chunkSize int64) ([]IpRange, error) {
 	return result.FreeList, nil
 }
 
+// Return a contiguous range of chunkSize IP addresses whose first
+// address is a multiple of align and remove it from the free list.
+// Free space before the first aligned address of each range is
+// skipped.  The lowest-addressed aligned block that fits is returned.
+func (ipa *IpAlloc) GetIpChunkAligned(chunkSize int64,
+	align int64) ([]IpRange, error) {
+	if chunkSize <= 0 {
+		return []IpRange{}, nil
+	}
+	if align < 1 {
+		align = 1
+	}
+
+	result, ok := ipa.takeAlignedBlock(big.NewInt(chunkSize),
+		big.NewInt(align))
+	if !ok {
+		return nil, errors.New("No aligned block of IP addresses is available")
+	}
+	return []IpRange{result}, nil
+}
+
+// Remove the lowest-addressed block of size addresses whose first
+// address is a multiple of alignment from the free list and return it
+func (ipa *IpAlloc) takeAlignedBlock(size *big.Int,
+	alignment *big.Int) (IpRange, bool) {
+	for _, r := range ipa.FreeList {
+		start := new(big.Int).SetBytes(r.Start)
+		end := new(big.Int).SetBytes(r.End)
+
+		// round the start up to the next multiple of the alignment
+		aligned := new(big.Int).Add(start, alignment)
+		aligned.Sub(aligned, one)
+		aligned.Sub(aligned, new(big.Int).Mod(aligned, alignment))
+
+		last := new(big.Int).Sub(new(big.Int).Add(aligned, size), one)
+		if last.Cmp(end) > 0 {
+			continue
+		}
+
+		result := IpRange{
+			Start: bigToIp(aligned, len(r.Start)),
+			End:   bigToIp(last, len(r.End)),
+		}
+		ipa.RemoveRange(result.Start, result.End)
+		return result, true
+	}
+	return IpRange{}, false
+}
+
+// The prefix length of IPv6 chunks when none is requested
+const DefaultIpv6ChunkPrefixLen = 64
+
+// Return an IPv6 prefix of at least the given prefix length and
+// remove it from the free list.  The prefix length is rounded down to
+// a nibble boundary, so the chunk is at least as large as requested
+// and both its size and its first address fall on a nibble boundary.
+// A prefix length of 0 requests a chunk of
+// DefaultIpv6ChunkPrefixLen.
+func (ipa *IpAlloc) GetIpv6Chunk(prefixLen int) (*net.IPNet, error) {
+	if prefixLen == 0 {
+		prefixLen = DefaultIpv6ChunkPrefixLen
+	}
+	if prefixLen < 0 || prefixLen > 128 {
+		return nil, errors.New("Invalid IPv6 prefix length")
+	}
+	for _, r := range ipa.FreeList {
+		if r.Start.To4() != nil {
+			return nil, errors.New("Not an IPv6 pool")
+		}
+	}
+	prefixLen -= prefixLen % 4
+
+	size := new(big.Int).Lsh(one, uint(128-prefixLen))
+	result, ok := ipa.takeAlignedBlock(size, size)
+	if !ok {
+		return nil, errors.New("No aligned IPv6 prefix is available")
+	}
+	return &net.IPNet{
+		IP:   result.Start.To16(),
+		Mask: net.CIDRMask(prefixLen, 128),
+	}, nil
+}
+
+// Remove the whole aligned block with the given prefix length that
+// contains the IP address from the free list and return it, for
+// example to reserve the /31 of a point-to-point link.  Returns an
+// error without changing the pool if any address in the block is not
+// free.  Like GetIpChunk, the block is not tracked as allocated.
+func (ipa *IpAlloc) AllocateSurrounding(ip net.IP,
+	prefixLen int) (*net.IPNet, error) {
+	bits := 8 * net.IPv6len
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 8*net.IPv4len
+	}
+	if ip == nil || prefixLen < 0 || prefixLen > bits {
+		return nil, errors.New("Invalid IP address or prefix length")
+	}
+	block := &net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(prefixLen, bits)),
+		Mask: net.CIDRMask(prefixLen, bits),
+	}
+
+	start, end := subnetRange(block)
+	start, end = ipa.canonicalIp(start), ipa.canonicalIp(end)
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("Block %s is not free", block)
+	}
+	free := big.NewInt(0)
+	i := sort.Search(len(ipa.FreeList), func(i int) bool {
+		return bytes.Compare(ipa.FreeList[i].End, start) >= 0
+	})
+	for ; i < len(ipa.FreeList) &&
+		bytes.Compare(ipa.FreeList[i].Start, end) <= 0; i++ {
+		r := ipa.FreeList[i]
+		if bytes.Compare(r.Start, start) < 0 {
+			r.Start = start
+		}
+		if bytes.Compare(r.End, end) > 0 {
+			r.End = end
+		}
+		free.Add(free, rangeSize(r))
+	}
+	if free.Cmp(rangeSize(IpRange{start, end})) != 0 {
+		return nil, fmt.Errorf("Block %s is not free", block)
+	}
+
+	ipa.RemoveRange(start, end)
+	return block, nil
+}
+
+// Convert an integer to an IP address of the given length
+func bigToIp(n *big.Int, length int) net.IP {
+	b := n.Bytes()
+	if len(b) < length {
+		b = append(make([]byte, length-len(b)), b...)
+	}
+	return net.IP(b)
+}
+
+func rangeSize(r IpRange) *big.Int {
+	start := new(big.Int).SetBytes(r.Start)
+	end := new(big.Int).SetBytes(r.End)
+	return new(big.Int).Add(one, new(big.Int).Sub(end, start))
+}
+
+func (ipa *IpAlloc) takeFragment(index int) IpRange {
+	r := ipa.FreeList[index]
+	ipa.FreeList = append(ipa.FreeList[:index], ipa.FreeList[index+1:]...)
+	ipa.updateStats()
+	return r
+}
+
+// Return the lowest-addressed contiguous free range and remove it from
+// the free list
+func (ipa *IpAlloc) GetFirstFragment() (IpRange, error) {
+	if len(ipa.FreeList) == 0 {
+		return IpRange{}, errors.New("No IP addresses are available")
+	}
+	return ipa.takeFragment(0), nil
+}
+
+// Return the largest contiguous free range and remove it from the
+// free list.  If several ranges have the same size, the lowest-addressed
+// one is returned.
+func (ipa *IpAlloc) GetLargestFragment() (IpRange, error) {
+	if len(ipa.FreeList) == 0 {
+		return IpRange{}, errors.New("No IP addresses are available")
+	}
+
+	largest := 0
+	largestSize := rangeSize(ipa.FreeList[0])
+	for i := 1; i < len(ipa.FreeList); i++ {
+		size := rangeSize(ipa.FreeList[i])
+		if size.Cmp(largestSize) > 0 {
+			largest = i
+			largestSize = size
+		}
+	}
+	return ipa.takeFragment(largest), nil
+}
+
+// Remove free addresses from the high end of the pool until at most
+// max addresses are free, and return the ranges removed in ascending
+// order.  Allocated addresses are not affected, so a pool trimmed below
+// its number of allocated addresses will be left with nothing free.
+func (ipa *IpAlloc) TrimTo(max *big.Int) []IpRange {
+	excess := new(big.Int).Neg(max)
+	for _, r := range ipa.FreeList {
+		excess.Add(excess, rangeSize(r))
+	}
+
+	var removed []IpRange
+	for excess.Sign() > 0 && len(ipa.FreeList) > 0 {
+		r := ipa.FreeList[len(ipa.FreeList)-1]
+		if rangeSize(r).Cmp(excess) > 0 {
+			end := new(big.Int).SetBytes(r.End)
+			r.Start = bigToIp(new(big.Int).Sub(
+				new(big.Int).Add(end, one), excess), len(r.End))
+		}
+		ipa.removeRange(r.Start, r.End)
+		excess.Sub(excess, rangeSize(r))
+		removed = append(removed, r)
+	}
+
+	for i, j := 0, len(removed)-1; i < j; i, j = i+1, j-1 {
+		removed[i], removed[j] = removed[j], removed[i]
+	}
+	return removed
+}
+
 // Add all IP ranges from another IpAlloc object
 func (ipa *IpAlloc) AddAll(other *IpAlloc) error {
 	return ipa.AddRanges(other.FreeList)
@@ -326,6 +942,39 @@ func (ipa *IpAlloc) RemoveRanges(ranges []IpRange) error {
 	return nil
 }
 
+// Remove the first n addresses of every range of the pool from the
+// free list, for example to reserve the gateway address of each
+// subnet.  The ranges are those set by ApplyConfig, or otherwise the
+// free ranges at the time of the first call, so this should be called
+// after the ranges are added and before any addresses are allocated.
+// Calling it again with the same n has no further effect, and a larger
+// n reserves the additional addresses; addresses already reserved are
+// not returned by a smaller n.
+func (ipa *IpAlloc) ReserveRangeHeads(n int) {
+	if n <= 0 {
+		return
+	}
+	ranges := ipa.headRanges
+	if ipa.configured != nil {
+		ranges = ipa.configured.FreeList
+	} else if ranges == nil {
+		ranges = make([]IpRange, len(ipa.FreeList))
+		copy(ranges, ipa.FreeList)
+	}
+	ipa.headRanges = ranges
+
+	count := big.NewInt(int64(n))
+	for _, r := range ranges {
+		start := new(big.Int).SetBytes(r.Start)
+		last := new(big.Int).Sub(new(big.Int).Add(start, count), one)
+		end := r.End
+		if last.Cmp(new(big.Int).SetBytes(r.End)) < 0 {
+			end = bigToIp(last, len(r.End))
+		}
+		ipa.RemoveRange(r.Start, end)
+	}
+}
+
 // Get the number of IPs available in the free list
 func (ipa *IpAlloc) GetSize() int64 {
 	size := big.NewInt(0)
@@ -337,6 +986,10 @@ func (ipa *IpAlloc) GetSize() int64 {
 		size.Add(size, one)
 	}
 
+	return clampSize(size)
+}
+
+func clampSize(size *big.Int) int64 {
 	if big.NewInt(math.MaxInt64).Cmp(size) <= 0 {
 		return math.MaxInt64
 	} else {
@@ -349,6 +1002,110 @@ func (ipa *IpAlloc) Empty() bool {
 	return len(ipa.FreeList) == 0
 }
 
+// Get the number of disjoint ranges in the free list
+func (ipa *IpAlloc) FragmentCount() int {
+	return len(ipa.FreeList)
+}
+
+// Get the number of IPs in the largest contiguous range in the free
+// list.  A small value relative to GetSize indicates a fragmented pool
+// that may not be able to satisfy large contiguous requests.
+func (ipa *IpAlloc) LargestContiguous() *big.Int {
+	largest := big.NewInt(0)
+	for _, r := range ipa.FreeList {
+		size := rangeSize(r)
+		if size.Cmp(largest) > 0 {
+			largest = size
+		}
+	}
+	return largest
+}
+
+// Check whether the pool could currently satisfy a request for n
+// addresses, as with GetIpChunk, without allocating anything
+func (ipa *IpAlloc) CanAllocate(n int64) bool {
+	return n <= ipa.GetSize()
+}
+
+// Check whether the pool currently has n free addresses in a single
+// contiguous range, without allocating anything
+func (ipa *IpAlloc) CanAllocateContiguous(n int64) bool {
+	return big.NewInt(n).Cmp(ipa.LargestContiguous()) <= 0
+}
+
+// Get up to limit free ranges starting at index offset of the free
+// list, in ascending order, and whether there are more ranges after
+// them.  The ranges are copies, so they are unaffected by later changes
+// to the pool.
+func (ipa *IpAlloc) FreeRangesPage(offset int, limit int) ([]IpRange, bool) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(ipa.FreeList) || limit <= 0 {
+		return []IpRange{}, offset < len(ipa.FreeList)
+	}
+	end := len(ipa.FreeList)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	page := make([]IpRange, 0, end-offset)
+	for _, r := range ipa.FreeList[offset:end] {
+		page = append(page, IpRange{
+			Start: append(net.IP(nil), r.Start...),
+			End:   append(net.IP(nil), r.End...),
+		})
+	}
+	return page, end < len(ipa.FreeList)
+}
+
+// Get the minimal set of CIDR blocks covering exactly the free
+// addresses, in ascending order.  IPv4 blocks use the 4-byte
+// representation.
+func (ipa *IpAlloc) FreeCidrs() []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(ipa.FreeList))
+	for _, r := range ipa.FreeList {
+		start, end := r.Start, r.End
+		if v4 := start.To4(); v4 != nil {
+			start, end = v4, end.To4()
+		}
+		result = append(result,
+			Range2Cidr(append(net.IP(nil), start...), end)...)
+	}
+	return result
+}
+
+// Get the lowest free address strictly greater than the given address
+// without allocating it, so that free space can be walked from any
+// point.  Returns false if there is no such address.  Dynamic
+// exclusions are not applied.
+func (ipa *IpAlloc) NextFree(after net.IP) (net.IP, bool) {
+	after = ipa.canonicalIp(after)
+	if after == nil {
+		return nil, false
+	}
+	return nextFree(ipa.FreeList, after)
+}
+
+// Get the lowest address in the free list strictly greater than the
+// given address, which must be in the representation used by the free
+// list
+func nextFree(free []IpRange, after net.IP) (net.IP, bool) {
+	next, carry := carryIncrement(after)
+	if carry {
+		return nil, false
+	}
+	i := sort.Search(len(free), func(i int) bool {
+		return bytes.Compare(free[i].End, next) >= 0
+	})
+	if i == len(free) {
+		return nil, false
+	}
+	if bytes.Compare(next, free[i].Start) < 0 {
+		next = append(net.IP(nil), free[i].Start...)
+	}
+	return next, true
+}
+
 func intersectLeft(result *IpAlloc, a *IpRange, b *IpRange, i *int, j *int) {
 	if bytes.Compare(a.End, b.Start) < 0 {
 		*i += 1
@@ -15,8 +15,11 @@
 package ipam
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"math"
+	"math/big"
 	"net"
 	"testing"
 
@@ -216,6 +219,30 @@ var addRangeTests = []addRangeTest{
 		},
 		"complex merge adjacent",
 	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+			{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.20")},
+			{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.12")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+			{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.20")},
+		},
+		"merge next only",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+			{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.20")},
+			{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.9")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+			{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.20")},
+		},
+		"adjacent next only",
+	},
 }
 
 func TestAddRange(t *testing.T) {
@@ -263,6 +290,43 @@ func TestAddSubnet(t *testing.T) {
 	}
 }
 
+func TestIpv4Mapped(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/30")
+	ipa := New()
+	ipa.AddSubnet(subnet)
+	assert.True(t, ipa.RemoveIp(net.ParseIP("::ffff:10.0.0.1")), "remove mapped")
+	assert.Equal(t, []IpRange{
+		{net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 0}},
+		{net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 3}},
+	}, ipa.FreeList, "remove mapped")
+	assert.False(t, ipa.RemoveIp(net.IP{10, 0, 0, 1}), "remove again")
+
+	ipa.AddIp(net.ParseIP("10.0.0.1"))
+	assert.Equal(t, []IpRange{
+		{net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 3}},
+	}, ipa.FreeList, "add back")
+
+	ipa = NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.3")},
+	})
+	ipa.AddIp(net.IP{10, 0, 0, 4})
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.4")},
+	}, ipa.FreeList, "add short form")
+
+	ipa = NewFromRanges([]IpRange{
+		{net.ParseIP("fd43:85d7:bcf2:9ad2::"),
+			net.ParseIP("fd43:85d7:bcf2:9ad2::ff")},
+	})
+	ipa.AddIp(net.ParseIP("::ffff:10.0.0.1"))
+	assert.False(t, ipa.RemoveIp(net.ParseIP("::ffff:10.0.0.1")),
+		"v6 pool remove")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("fd43:85d7:bcf2:9ad2::"),
+			net.ParseIP("fd43:85d7:bcf2:9ad2::ff")},
+	}, ipa.FreeList, "v6 pool")
+}
+
 type removeRangeTest struct {
 	add      []IpRange
 	remove   []IpRange
@@ -484,6 +548,53 @@ var removeRangeTests = []removeRangeTest{
 		true,
 		"one from middle",
 	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.100")},
+			{net.ParseIP("10.0.1.200"), net.ParseIP("10.0.2.10")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.1.50"), net.ParseIP("10.0.1.220")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.49")},
+			{net.ParseIP("10.0.1.221"), net.ParseIP("10.0.2.10")},
+		},
+		true,
+		"span gap",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.100")},
+			{net.ParseIP("10.0.1.200"), net.ParseIP("10.0.2.10")},
+			{net.ParseIP("10.0.2.100"), net.ParseIP("10.0.2.200")},
+			{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.255")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.1.50"), net.ParseIP("10.0.3.220")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.49")},
+			{net.ParseIP("10.0.3.221"), net.ParseIP("10.0.3.255")},
+		},
+		true,
+		"span multiple gaps",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.100")},
+			{net.ParseIP("10.0.1.200"), net.ParseIP("10.0.2.10")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.1.101"), net.ParseIP("10.0.1.199")},
+		},
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.100")},
+			{net.ParseIP("10.0.1.200"), net.ParseIP("10.0.2.10")},
+		},
+		false,
+		"gap only",
+	},
 }
 
 func TestRemoveRange(t *testing.T) {
@@ -500,6 +611,57 @@ func TestRemoveRange(t *testing.T) {
 	}
 }
 
+func TestRemoveRangeCount(t *testing.T) {
+	for i, rt := range removeRangeTests {
+		ipa := NewFromRanges(rt.add)
+		for _, r := range rt.remove {
+			before := ipa.GetSize()
+			count := ipa.RemoveRangeCount(r.Start, r.End)
+			assert.Equal(t, before-ipa.GetSize(), count,
+				fmt.Sprintf("RemoveRangeCount %d: %s", i, rt.desc))
+		}
+		assert.Equal(t, rt.freeList, ipa.FreeList,
+			fmt.Sprintf("RemoveRangeCount %d: %s", i, rt.desc))
+	}
+
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.9")},
+		{net.ParseIP("10.0.1.20"), net.ParseIP("10.0.1.29")},
+	})
+	assert.Equal(t, int64(8), ipa.RemoveRangeCount(net.ParseIP("10.0.1.5"),
+		net.ParseIP("10.0.1.22")), "partial overlap")
+	assert.Equal(t, int64(0), ipa.RemoveRangeCount(net.ParseIP("10.0.1.5"),
+		net.ParseIP("10.0.1.22")), "already removed")
+	assert.Equal(t, int64(12), ipa.GetSize(), "remaining")
+}
+
+// Build a pool with the given number of single-address fragments
+func fragmentedPool(fragments int) *IpAlloc {
+	ranges := make([]IpRange, 0, fragments)
+	ip := net.ParseIP("10.0.0.0")
+	for i := 0; i < fragments; i++ {
+		ranges = append(ranges, IpRange{ip, ip})
+		ip = next(next(ip))
+	}
+	return NewFromRanges(ranges)
+}
+
+func BenchmarkRemoveRange(b *testing.B) {
+	const fragments = 10000
+	ipa := fragmentedPool(fragments)
+	ips := make([]net.IP, 0, fragments)
+	for _, r := range ipa.FreeList {
+		ips = append(ips, r.Start)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := ips[(i*7919)%fragments]
+		ipa.RemoveIp(ip)
+		ipa.AddIp(ip)
+	}
+}
+
 type removeSubnetTest struct {
 	add      []string
 	remove   []string
@@ -615,6 +777,181 @@ func TestGetIp(t *testing.T) {
 	}
 }
 
+func TestGetIpContext(t *testing.T) {
+	for i, rt := range getIpTests {
+		ipa := NewFromRanges(rt.add)
+		ip, err := ipa.GetIpContext(context.Background())
+		if rt.err {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, rt.desc))
+		}
+		assert.Equal(t, rt.freeList, ipa.FreeList,
+			fmt.Sprintf("freeList %d: %s", i, rt.desc))
+		assert.Equal(t, rt.ip, ip,
+			fmt.Sprintf("ip %d: %s", i, rt.desc))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	})
+	ip, err := ipa.GetIpContext(ctx)
+	assert.Equal(t, context.Canceled, err, "cancelled")
+	assert.Nil(t, ip, "cancelled")
+	assert.Equal(t, int64(10), ipa.GetSize(), "cancelled size")
+}
+
+func TestGetIpWithRange(t *testing.T) {
+	for i, rt := range getIpTests {
+		ipa := NewFromRanges(rt.add)
+		ip, r, err := ipa.GetIpWithRange()
+		if rt.err {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, rt.desc))
+			continue
+		}
+		assert.Equal(t, rt.ip, ip, fmt.Sprintf("ip %d: %s", i, rt.desc))
+		assert.Equal(t, rt.add[0], r, fmt.Sprintf("range %d: %s", i, rt.desc))
+		assert.True(t, bytes.Compare(r.Start, ip) <= 0 &&
+			bytes.Compare(ip, r.End) <= 0,
+			fmt.Sprintf("contains %d: %s", i, rt.desc))
+		assert.Equal(t, rt.freeList, ipa.FreeList,
+			fmt.Sprintf("freeList %d: %s", i, rt.desc))
+	}
+
+	// the range is the one the address came from, not the first
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10")},
+	})
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.1.1")})
+	ip, r, err := ipa.GetIpWithRange()
+	assert.Nil(t, err, "excluded")
+	assert.Equal(t, "10.0.2.1", ip.String(), "excluded")
+	assert.Equal(t, IpRange{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10")},
+		r, "excluded")
+}
+
+type getIpNearTest struct {
+	add      []IpRange
+	ref      net.IP
+	freeList []IpRange
+	ip       net.IP
+	err      bool
+	desc     string
+}
+
+var getIpNearTests = []getIpNearTest{
+	{
+		[]IpRange{},
+		net.ParseIP("10.0.1.1"),
+		[]IpRange{},
+		nil,
+		true,
+		"empty",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+		},
+		net.ParseIP("10.0.1.5"),
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.4")},
+			{net.ParseIP("10.0.1.6"), net.ParseIP("10.0.1.10")},
+		},
+		net.ParseIP("10.0.1.5"),
+		false,
+		"inside",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.1.30"), net.ParseIP("10.0.1.40")},
+		},
+		net.ParseIP("10.0.1.25"),
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.1.31"), net.ParseIP("10.0.1.40")},
+		},
+		net.ParseIP("10.0.1.30"),
+		false,
+		"nearer above",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.1.30"), net.ParseIP("10.0.1.40")},
+		},
+		net.ParseIP("10.0.1.12"),
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.9")},
+			{net.ParseIP("10.0.1.30"), net.ParseIP("10.0.1.40")},
+		},
+		net.ParseIP("10.0.1.10"),
+		false,
+		"nearer below",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.1.30"), net.ParseIP("10.0.1.40")},
+		},
+		net.ParseIP("10.0.1.20"),
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.9")},
+			{net.ParseIP("10.0.1.30"), net.ParseIP("10.0.1.40")},
+		},
+		net.ParseIP("10.0.1.10"),
+		false,
+		"tie",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.10")},
+		},
+		net.ParseIP("10.0.2.200"),
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.3.1"), net.ParseIP("10.0.3.10")},
+		},
+		net.ParseIP("10.0.3.0"),
+		false,
+		"carry",
+	},
+}
+
+func TestGetIpNear(t *testing.T) {
+	for i, rt := range getIpNearTests {
+		ipa := NewFromRanges(rt.add)
+		ip, err := ipa.GetIpNear(rt.ref)
+		if rt.err {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, rt.desc))
+		}
+		assert.Equal(t, rt.freeList, ipa.FreeList,
+			fmt.Sprintf("freeList %d: %s", i, rt.desc))
+		assert.Equal(t, rt.ip, ip,
+			fmt.Sprintf("ip %d: %s", i, rt.desc))
+	}
+
+	// excluded addresses are skipped
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	})
+	ipa.SetDynamicExclusions([]net.IP{
+		net.ParseIP("10.0.1.5"), net.ParseIP("10.0.1.6"),
+	})
+	ip, err := ipa.GetIpNear(net.ParseIP("10.0.1.6"))
+	assert.Nil(t, err, "excluded")
+	assert.Equal(t, "10.0.1.7", ip.String(), "excluded")
+
+	ipa = NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+	})
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.1.1")})
+	_, err = ipa.GetIpNear(net.ParseIP("10.0.1.1"))
+	assert.NotNil(t, err, "all excluded")
+}
+
 type getIpChunkTest struct {
 	add       []IpRange
 	chunkSize int64
@@ -718,6 +1055,77 @@ func TestGetIpChunk(t *testing.T) {
 	}
 }
 
+type getFragmentTest struct {
+	add      []IpRange
+	first    IpRange
+	largest  IpRange
+	freeList []IpRange
+	desc     string
+}
+
+var getFragmentTests = []getFragmentTest{
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		},
+		IpRange{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		IpRange{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		[]IpRange{},
+		"one",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+			{net.ParseIP("10.0.2.0"), net.ParseIP("10.0.3.255")},
+			{net.ParseIP("10.0.5.0"), net.ParseIP("10.0.5.255")},
+		},
+		IpRange{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+		IpRange{net.ParseIP("10.0.2.0"), net.ParseIP("10.0.3.255")},
+		[]IpRange{
+			{net.ParseIP("10.0.5.0"), net.ParseIP("10.0.5.255")},
+		},
+		"multiple",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.255")},
+			{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.255")},
+			{net.ParseIP("10.0.5.0"), net.ParseIP("10.0.5.255")},
+		},
+		IpRange{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.255")},
+		IpRange{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.255")},
+		[]IpRange{
+			{net.ParseIP("10.0.5.0"), net.ParseIP("10.0.5.255")},
+		},
+		"tie",
+	},
+}
+
+func TestGetFragment(t *testing.T) {
+	for i, rt := range getFragmentTests {
+		ipa := NewFromRanges(rt.add)
+		first, err := ipa.GetFirstFragment()
+		assert.Nil(t, err, fmt.Sprintf("first err %d: %s", i, rt.desc))
+		assert.Equal(t, rt.first, first,
+			fmt.Sprintf("first %d: %s", i, rt.desc))
+		if len(ipa.FreeList) == 0 {
+			continue
+		}
+		largest, err := ipa.GetLargestFragment()
+		assert.Nil(t, err, fmt.Sprintf("largest err %d: %s", i, rt.desc))
+		assert.Equal(t, rt.largest, largest,
+			fmt.Sprintf("largest %d: %s", i, rt.desc))
+		assert.Equal(t, rt.freeList, ipa.FreeList,
+			fmt.Sprintf("freeList %d: %s", i, rt.desc))
+	}
+
+	ipa := New()
+	_, err := ipa.GetFirstFragment()
+	assert.NotNil(t, err, "first empty")
+	_, err = ipa.GetLargestFragment()
+	assert.NotNil(t, err, "largest empty")
+}
+
 type getSizeTest struct {
 	add  []IpRange
 	size int64
@@ -772,6 +1180,204 @@ func TestGetSize(t *testing.T) {
 	}
 }
 
+func TestFragmentation(t *testing.T) {
+	ipa := New()
+	assert.Equal(t, 0, ipa.FragmentCount(), "empty count")
+	assert.Equal(t, big.NewInt(0), ipa.LargestContiguous(), "empty largest")
+
+	ipa.AddRange(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.255"))
+	ipa.RemoveIp(net.ParseIP("10.0.0.10"))
+	ipa.RemoveIp(net.ParseIP("10.0.0.100"))
+	ipa.AddRange(net.ParseIP("10.0.2.0"), net.ParseIP("10.0.2.9"))
+	assert.Equal(t, 4, ipa.FragmentCount(), "count")
+	assert.Equal(t, big.NewInt(155), ipa.LargestContiguous(), "largest")
+	assert.Equal(t, int64(264), ipa.GetSize(), "size")
+
+	ipa = New()
+	ipa.AddRange(net.ParseIP("fd43:85d7:bcf2:9ad2::"),
+		net.ParseIP("fd43:85d7:bcf2:9ad2:ffff:ffff:ffff:ffff"))
+	expected, _ := new(big.Int).SetString("10000000000000000", 16)
+	assert.Equal(t, expected, ipa.LargestContiguous(), "v6 largest")
+}
+
+type getIpChunkAlignedTest struct {
+	freeList  []IpRange
+	size      int64
+	align     int64
+	result    []IpRange
+	remaining []IpRange
+	desc      string
+}
+
+var getIpChunkAlignedTests = []getIpChunkAlignedTest{
+	{
+		[]IpRange{{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.63")}},
+		16,
+		16,
+		[]IpRange{{net.ParseIP("10.0.0.16"), net.ParseIP("10.0.0.31")}},
+		[]IpRange{
+			{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.15")},
+			{net.ParseIP("10.0.0.32"), net.ParseIP("10.0.0.63")},
+		},
+		"skip misaligned start",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.20")},
+			{net.ParseIP("10.0.0.40"), net.ParseIP("10.0.0.79")},
+		},
+		16,
+		16,
+		[]IpRange{{net.ParseIP("10.0.0.48"), net.ParseIP("10.0.0.63")}},
+		[]IpRange{
+			{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.20")},
+			{net.ParseIP("10.0.0.40"), net.ParseIP("10.0.0.47")},
+			{net.ParseIP("10.0.0.64"), net.ParseIP("10.0.0.79")},
+		},
+		"skip range without aligned block",
+	},
+	{
+		[]IpRange{{net.ParseIP("10.0.0.32"), net.ParseIP("10.0.0.47")}},
+		16,
+		16,
+		[]IpRange{{net.ParseIP("10.0.0.32"), net.ParseIP("10.0.0.47")}},
+		[]IpRange{},
+		"exact",
+	},
+	{
+		[]IpRange{{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.30")}},
+		16,
+		16,
+		nil,
+		[]IpRange{{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.30")}},
+		"no aligned block",
+	},
+	{
+		[]IpRange{{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.9")}},
+		2,
+		0,
+		[]IpRange{{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4")}},
+		[]IpRange{{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.9")}},
+		"unaligned",
+	},
+	{
+		[]IpRange{{net.ParseIP("fd43:85d7:bcf2:9ad2::3"),
+			net.ParseIP("fd43:85d7:bcf2:9ad2::ffff")}},
+		256,
+		256,
+		[]IpRange{{net.ParseIP("fd43:85d7:bcf2:9ad2::100"),
+			net.ParseIP("fd43:85d7:bcf2:9ad2::1ff")}},
+		[]IpRange{
+			{net.ParseIP("fd43:85d7:bcf2:9ad2::3"),
+				net.ParseIP("fd43:85d7:bcf2:9ad2::ff")},
+			{net.ParseIP("fd43:85d7:bcf2:9ad2::200"),
+				net.ParseIP("fd43:85d7:bcf2:9ad2::ffff")},
+		},
+		"v6",
+	},
+}
+
+func TestGetIpChunkAligned(t *testing.T) {
+	for i, ct := range getIpChunkAlignedTests {
+		ipa := NewFromRanges(ct.freeList)
+		result, err := ipa.GetIpChunkAligned(ct.size, ct.align)
+		if ct.result == nil {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, ct.desc))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("err %d: %s", i, ct.desc))
+		}
+		assert.Equal(t, ct.result, result,
+			fmt.Sprintf("result %d: %s", i, ct.desc))
+		assert.Equal(t, ct.remaining, ipa.FreeList,
+			fmt.Sprintf("remaining %d: %s", i, ct.desc))
+	}
+}
+
+func TestAllocatedIps(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	})
+	assert.Equal(t, []net.IP{}, ipa.AllocatedIps(), "empty")
+
+	var ips []net.IP
+	for i := 0; i < 3; i++ {
+		ip, err := ipa.GetIp()
+		assert.Nil(t, err, "get")
+		ips = append(ips, ip)
+	}
+	ip, err := ipa.GetIpNear(net.ParseIP("10.0.1.9"))
+	assert.Nil(t, err, "get near")
+	ipa.RemoveIp(net.ParseIP("10.0.1.5"))
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.1.1"),
+		net.ParseIP("10.0.1.2"),
+		net.ParseIP("10.0.1.3"),
+		net.ParseIP("10.0.1.9"),
+	}, ipa.AllocatedIps(), "allocated")
+
+	ipa.AddIp(ips[1])
+	ipa.AddIp(net.ParseIP("10.0.1.5"))
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.1.1"),
+		net.ParseIP("10.0.1.3"),
+		net.ParseIP("10.0.1.9"),
+	}, ipa.AllocatedIps(), "release one")
+
+	ipa.AddRange(net.ParseIP("10.0.1.3"), net.ParseIP("10.0.1.10"))
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.1.1")}, ipa.AllocatedIps(),
+		"release range")
+	assert.Equal(t, net.ParseIP("10.0.1.9"), ip, "near")
+
+	// every address is either free or allocated
+	ipa.AddIp(ips[0])
+	assert.Equal(t, []net.IP{}, ipa.AllocatedIps(), "release all")
+	assert.Equal(t, int64(10), ipa.GetSize(), "all free")
+
+	// releasing into an exhausted pool in the other representation
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/30")
+	exhausted := New()
+	exhausted.AddSubnet(subnet)
+	for i := 0; i < 4; i++ {
+		_, err := exhausted.GetIp()
+		assert.Nil(t, err, "exhaust")
+	}
+	exhausted.AddIp(net.ParseIP("10.0.0.1"))
+	assert.Equal(t, []net.IP{
+		{10, 0, 0, 0}, {10, 0, 0, 2}, {10, 0, 0, 3},
+	}, exhausted.AllocatedIps(), "released mapped")
+	assert.Equal(t, []IpRange{
+		{net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 1}},
+	}, exhausted.FreeList, "free list representation")
+	exhausted.AddIp(net.ParseIP("10.0.0.2").To4())
+	assert.Len(t, exhausted.AllocatedIps(), 2, "released")
+}
+
+func TestCanAllocate(t *testing.T) {
+	// fragments of 1, 4, 2 and 8 addresses
+	pool := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")},
+		{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.6")},
+		{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11")},
+		{net.ParseIP("10.0.0.20"), net.ParseIP("10.0.0.27")},
+	})
+
+	for n := int64(0); n <= 17; n++ {
+		ipa := NewFromRanges(pool.FreeList)
+		_, err := ipa.GetIpChunk(n)
+		assert.Equal(t, err == nil, pool.CanAllocate(n),
+			fmt.Sprintf("CanAllocate %d", n))
+
+		ipa = NewFromRanges(pool.FreeList)
+		r, _ := ipa.GetLargestFragment()
+		assert.Equal(t, rangeSize(r).Cmp(big.NewInt(n)) >= 0,
+			pool.CanAllocateContiguous(n),
+			fmt.Sprintf("CanAllocateContiguous %d", n))
+	}
+	assert.Equal(t, int64(15), pool.GetSize(), "unchanged size")
+	assert.Equal(t, 4, pool.FragmentCount(), "unchanged fragments")
+	assert.False(t, New().CanAllocateContiguous(1), "empty")
+}
+
 func TestEmpty(t *testing.T) {
 	for i, rt := range getSizeTests {
 		ipa := NewFromRanges(rt.add)
@@ -921,3 +1527,445 @@ func TestIntersect(t *testing.T) {
 			fmt.Sprintf("intersect %d: %s", i, rt.desc))
 	}
 }
+
+func TestGetIpv6Chunk(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("fd00::/48")
+	ipa := New()
+	ipa.AddSubnet(pool)
+
+	for i, expected := range []string{
+		"fd00::/64",
+		"fd00:0:0:1::/64",
+		"fd00:0:0:2::/64",
+	} {
+		chunk, err := ipa.GetIpv6Chunk(0)
+		if assert.Nil(t, err, fmt.Sprintf("err %d", i)) {
+			assert.Equal(t, expected, chunk.String(),
+				fmt.Sprintf("chunk %d", i))
+		}
+	}
+
+	// rounded up to a /60 on the next /60 boundary
+	chunk, err := ipa.GetIpv6Chunk(62)
+	if assert.Nil(t, err, "rounded") {
+		assert.Equal(t, "fd00:0:0:10::/60", chunk.String(), "rounded")
+	}
+
+	// the skipped space is still available
+	chunk, err = ipa.GetIpv6Chunk(64)
+	if assert.Nil(t, err, "skipped") {
+		assert.Equal(t, "fd00:0:0:3::/64", chunk.String(), "skipped")
+	}
+
+	_, err = ipa.GetIpv6Chunk(44)
+	assert.NotNil(t, err, "too large")
+	_, err = ipa.GetIpv6Chunk(129)
+	assert.NotNil(t, err, "invalid")
+
+	v4 := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.0.0").To4(), net.ParseIP("10.0.0.255").To4()},
+	})
+	_, err = v4.GetIpv6Chunk(0)
+	assert.NotNil(t, err, "v4 pool")
+}
+
+func TestGetIpPreferred(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	})
+
+	ip, err := ipa.GetIpPreferred(net.ParseIP("10.0.1.5"))
+	assert.Nil(t, err, "free")
+	assert.Equal(t, net.ParseIP("10.0.1.5"), ip, "free")
+
+	ip, err = ipa.GetIpPreferred(net.ParseIP("10.0.1.5"))
+	assert.Nil(t, err, "taken")
+	assert.Equal(t, net.ParseIP("10.0.1.1"), ip, "taken")
+
+	ip, err = ipa.GetIpPreferred(net.ParseIP("10.0.2.1"))
+	assert.Nil(t, err, "outside")
+	assert.Equal(t, net.ParseIP("10.0.1.2"), ip, "outside")
+
+	ip, err = ipa.GetIpPreferred(net.ParseIP("fd00::1"))
+	assert.Nil(t, err, "family")
+	assert.Equal(t, net.ParseIP("10.0.1.3"), ip, "family")
+
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.1.1"),
+		net.ParseIP("10.0.1.2"),
+		net.ParseIP("10.0.1.3"),
+		net.ParseIP("10.0.1.5"),
+	}, ipa.AllocatedIps(), "allocated")
+
+	empty := New()
+	_, err = empty.GetIpPreferred(net.ParseIP("10.0.1.5"))
+	assert.NotNil(t, err, "empty")
+}
+
+var freeCidrsTests = []struct {
+	freeList []IpRange
+	cidrs    []string
+	desc     string
+}{
+	{
+		[]IpRange{},
+		[]string{},
+		"empty",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.6")},
+		},
+		[]string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"},
+		"unaligned",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("10.0.0.0"), net.ParseIP("10.0.1.255")},
+			{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.0")},
+		},
+		[]string{"10.0.0.0/23", "10.0.3.0/32"},
+		"aligned",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("fd00::1"), net.ParseIP("fd00::ffff")},
+		},
+		[]string{
+			"fd00::1/128", "fd00::2/127", "fd00::4/126", "fd00::8/125",
+			"fd00::10/124", "fd00::20/123", "fd00::40/122",
+			"fd00::80/121", "fd00::100/120", "fd00::200/119",
+			"fd00::400/118", "fd00::800/117", "fd00::1000/116",
+			"fd00::2000/115", "fd00::4000/114", "fd00::8000/113",
+		},
+		"v6",
+	},
+	{
+		[]IpRange{
+			{net.ParseIP("255.255.255.254"), net.ParseIP("255.255.255.255")},
+		},
+		[]string{"255.255.255.254/31"},
+		"end of address space",
+	},
+}
+
+func TestFreeCidrs(t *testing.T) {
+	for i, ct := range freeCidrsTests {
+		ipa := NewFromRanges(ct.freeList)
+		cidrs := make([]string, 0)
+		for _, c := range ipa.FreeCidrs() {
+			cidrs = append(cidrs, c.String())
+		}
+		assert.Equal(t, ct.cidrs, cidrs, fmt.Sprintf("cidrs %d: %s", i, ct.desc))
+		assert.Equal(t, ct.freeList, ipa.FreeList,
+			fmt.Sprintf("unchanged %d: %s", i, ct.desc))
+	}
+}
+
+func TestMarkAllocated(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	ipa := New()
+	ipa.AddSubnet(subnet)
+
+	used := []net.IP{
+		net.ParseIP("10.0.1.0"),
+		net.ParseIP("10.0.1.1"),
+		net.ParseIP("10.0.1.7"),
+		net.ParseIP("10.0.1.128"),
+		net.ParseIP("10.0.1.255"),
+	}
+	assert.Nil(t, ipa.MarkAllocated(used), "mark")
+	assert.Equal(t, int64(251), ipa.GetSize(), "size")
+
+	for !ipa.Empty() {
+		ip, err := ipa.GetIp()
+		assert.Nil(t, err, "get")
+		for _, u := range used {
+			assert.False(t, u.Equal(ip), "reused", ip)
+		}
+	}
+	assert.Equal(t, 256, len(ipa.AllocatedIps()), "allocated")
+
+	ipa = New()
+	ipa.AddSubnet(subnet)
+	err := ipa.MarkAllocated([]net.IP{
+		net.ParseIP("10.0.2.1"),
+		net.ParseIP("10.0.1.5"),
+		net.ParseIP("fd00::1"),
+	})
+	assert.NotNil(t, err, "outside")
+	assert.Equal(t, int64(255), ipa.GetSize(), "inside still marked")
+}
+
+func TestDynamicExclusions(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+		{net.ParseIP("10.0.1.4"), net.ParseIP("10.0.1.5")},
+	})
+	ipa.SetDynamicExclusions([]net.IP{
+		net.ParseIP("10.0.1.1"),
+		net.ParseIP("10.0.1.2"),
+		net.ParseIP("10.0.1.5").To4(),
+	})
+	assert.Equal(t, int64(4), ipa.GetSize(), "still free")
+
+	ip, err := ipa.GetIp()
+	assert.Nil(t, err, "first")
+	assert.Equal(t, net.ParseIP("10.0.1.4"), ip, "first")
+
+	ip, err = ipa.GetIpPreferred(net.ParseIP("10.0.1.5"))
+	assert.NotNil(t, err, "preferred excluded")
+	_, err = ipa.GetIp()
+	assert.NotNil(t, err, "only excluded left")
+	assert.Equal(t, int64(3), ipa.GetSize(), "excluded stay free")
+
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.1.1")})
+	ip, err = ipa.GetIp()
+	assert.Nil(t, err, "un-excluded")
+	assert.Equal(t, net.ParseIP("10.0.1.2"), ip, "un-excluded")
+
+	ipa.SetDynamicExclusions(nil)
+	ip, err = ipa.GetIp()
+	assert.Nil(t, err, "cleared")
+	assert.Equal(t, net.ParseIP("10.0.1.1"), ip, "cleared")
+}
+
+func TestReserveRangeHeads(t *testing.T) {
+	ipa := New()
+	for _, cidr := range []string{"10.0.1.0/24", "10.0.3.0/24"} {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		ipa.AddRange(UsableHostRange(subnet))
+	}
+	ipa.ReserveRangeHeads(1)
+	ipa.ReserveRangeHeads(1)
+	assert.Equal(t, int64(2*253), ipa.GetSize(), "idempotent")
+
+	for !ipa.Empty() {
+		ip, err := ipa.GetIp()
+		assert.Nil(t, err, "get")
+		assert.False(t, ip.Equal(net.ParseIP("10.0.1.1")), "10.0.1.1")
+		assert.False(t, ip.Equal(net.ParseIP("10.0.3.1")), "10.0.3.1")
+	}
+
+	// ranges smaller than n are reserved entirely, and a larger n
+	// reserves more
+	ipa = NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10")},
+	})
+	ipa.ReserveRangeHeads(3)
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.2.4"), net.ParseIP("10.0.2.10")},
+	}, ipa.FreeList, "small range")
+	ipa.ReserveRangeHeads(4)
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.2.5"), net.ParseIP("10.0.2.10")},
+	}, ipa.FreeList, "larger n")
+
+	// configured ranges are used when set
+	ipa = New()
+	ipa.ApplyConfig([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	})
+	ipa.GetIp()
+	ipa.ReserveRangeHeads(2)
+	assert.Equal(t, int64(8), ipa.GetSize(), "configured")
+}
+
+var nextFreeTests = []struct {
+	after  string
+	result string
+	desc   string
+}{
+	{"10.0.0.1", "10.0.1.1", "before pool"},
+	{"10.0.1.1", "10.0.1.2", "inside fragment"},
+	{"10.0.1.4", "10.0.1.5", "fragment end"},
+	{"10.0.1.5", "10.0.2.1", "fragment boundary"},
+	{"10.0.1.200", "10.0.2.1", "gap"},
+	{"10.0.2.254", "10.0.2.255", "top of pool"},
+	{"10.0.2.255", "", "last address"},
+	{"10.0.3.1", "", "after pool"},
+	{"255.255.255.255", "", "overflow"},
+	{"fd00::1", "", "wrong family"},
+}
+
+func TestNextFree(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.5")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.255")},
+	})
+	size := ipa.GetSize()
+	for i, nt := range nextFreeTests {
+		ip, ok := ipa.NextFree(net.ParseIP(nt.after))
+		if nt.result == "" {
+			assert.False(t, ok, fmt.Sprintf("none %d: %s", i, nt.desc))
+			continue
+		}
+		assert.True(t, ok, fmt.Sprintf("found %d: %s", i, nt.desc))
+		assert.Equal(t, nt.result, ip.String(),
+			fmt.Sprintf("result %d: %s", i, nt.desc))
+	}
+	assert.Equal(t, size, ipa.GetSize(), "read-only")
+
+	// walking from the start visits every free address
+	count := int64(0)
+	for ip, ok := ipa.NextFree(net.ParseIP("0.0.0.0")); ok; ip, ok =
+		ipa.NextFree(ip) {
+		count++
+	}
+	assert.Equal(t, size, count, "walk")
+
+	_, ok := New().NextFree(net.ParseIP("10.0.0.1"))
+	assert.False(t, ok, "empty")
+}
+
+func TestAllocateSurrounding(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.11")},
+	})
+
+	block, err := ipa.AllocateSurrounding(net.ParseIP("10.0.1.5"), 31)
+	if assert.Nil(t, err, "/31") {
+		assert.Equal(t, "10.0.1.4/31", block.String(), "/31")
+	}
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3")},
+		{net.ParseIP("10.0.1.6"), net.ParseIP("10.0.1.11")},
+	}, ipa.FreeList, "/31")
+
+	// part of the block is already taken
+	_, err = ipa.AllocateSurrounding(net.ParseIP("10.0.1.6"), 30)
+	assert.NotNil(t, err, "in use")
+	_, err = ipa.AllocateSurrounding(net.ParseIP("10.0.1.1"), 30)
+	assert.NotNil(t, err, "outside pool")
+	assert.Equal(t, int64(9), ipa.GetSize(), "unchanged")
+
+	block, err = ipa.AllocateSurrounding(net.ParseIP("10.0.1.9"), 30)
+	if assert.Nil(t, err, "/30") {
+		assert.Equal(t, "10.0.1.8/30", block.String(), "/30")
+	}
+	assert.Equal(t, int64(5), ipa.GetSize(), "/30")
+
+	_, err = ipa.AllocateSurrounding(net.ParseIP("10.0.1.1"), 33)
+	assert.NotNil(t, err, "prefix length")
+	_, err = ipa.AllocateSurrounding(net.ParseIP("fd00::1"), 127)
+	assert.NotNil(t, err, "family")
+}
+
+func TestTrimTo(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	ipa := New()
+	ipa.AddSubnet(subnet)
+	for i := 0; i < 3; i++ {
+		_, err := ipa.GetIp()
+		assert.Nil(t, err, "allocate")
+	}
+
+	removed := ipa.TrimTo(big.NewInt(100))
+	assert.Equal(t, int64(100), ipa.GetSize(), "trimmed")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.0.103").To4(), net.ParseIP("10.0.0.255").To4()},
+	}, removed, "removed from the top")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.0.3").To4(), net.ParseIP("10.0.0.102").To4()},
+	}, ipa.FreeList, "remaining")
+	assert.Equal(t, 3, len(ipa.AllocatedIps()), "allocated unaffected")
+
+	assert.Nil(t, ipa.TrimTo(big.NewInt(100)), "already small enough")
+	assert.Nil(t, ipa.TrimTo(big.NewInt(1000)), "larger")
+
+	// trimming across fragments
+	ipa = NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.4")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.2")},
+		{net.ParseIP("10.0.3.1"), net.ParseIP("10.0.3.1")},
+	})
+	removed = ipa.TrimTo(big.NewInt(2))
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.3"), net.ParseIP("10.0.1.4")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.2")},
+		{net.ParseIP("10.0.3.1"), net.ParseIP("10.0.3.1")},
+	}, removed, "fragments")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+	}, ipa.FreeList, "fragments remaining")
+
+	ipa.TrimTo(big.NewInt(0))
+	assert.True(t, ipa.Empty(), "zero")
+}
+
+func TestGetIpBatch(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10")},
+	})
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.2.3")})
+
+	// the first run long enough, skipping the excluded address
+	ips, contiguous, err := ipa.GetIpBatch(4)
+	assert.Nil(t, err, "contiguous")
+	assert.True(t, contiguous, "contiguous")
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.2.4"), net.ParseIP("10.0.2.5"),
+		net.ParseIP("10.0.2.6"), net.ParseIP("10.0.2.7"),
+	}, ips, "contiguous")
+	assert.Equal(t, ips, ipa.AllocatedIps(), "tracked")
+
+	// now fragmented: 10.0.1.1-2, 10.0.2.1-2, 10.0.2.8-10
+	ips, contiguous, err = ipa.GetIpBatch(5)
+	assert.Nil(t, err, "scattered")
+	assert.False(t, contiguous, "scattered")
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2"),
+		net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.2"),
+		net.ParseIP("10.0.2.8"),
+	}, ips, "scattered")
+
+	size := ipa.GetSize()
+	_, _, err = ipa.GetIpBatch(3)
+	assert.NotNil(t, err, "insufficient")
+	assert.Equal(t, size, ipa.GetSize(), "nothing allocated")
+
+	ips, _, err = ipa.GetIpBatch(0)
+	assert.Nil(t, err, "none")
+	assert.Empty(t, ips, "none")
+}
+
+func TestFreeRangesPage(t *testing.T) {
+	ipa := fragmentedPool(7)
+	expected := append([]IpRange(nil), ipa.FreeList...)
+
+	var all []IpRange
+	pages := 0
+	for offset := 0; ; offset += 3 {
+		page, more := ipa.FreeRangesPage(offset, 3)
+		pages++
+		assert.True(t, len(page) <= 3, "page size")
+		all = append(all, page...)
+		if !more {
+			break
+		}
+	}
+	assert.Equal(t, 3, pages, "pages")
+	assert.Equal(t, expected, all, "complete coverage")
+	for i := 1; i < len(all); i++ {
+		assert.True(t, bytes.Compare(all[i-1].End, all[i].Start) < 0,
+			"ascending and disjoint")
+	}
+
+	// pages are copies
+	first := ipa.FreeList[0].String()
+	page, _ := ipa.FreeRangesPage(0, 1)
+	page[0].Start[len(page[0].Start)-1]++
+	assert.Equal(t, first, ipa.FreeList[0].String(), "copy")
+
+	page, more := ipa.FreeRangesPage(7, 3)
+	assert.Empty(t, page, "past the end")
+	assert.False(t, more, "past the end")
+	page, more = ipa.FreeRangesPage(0, 0)
+	assert.Empty(t, page, "no limit")
+	assert.True(t, more, "no limit")
+	page, more = New().FreeRangesPage(0, 10)
+	assert.Empty(t, page, "empty pool")
+	assert.False(t, more, "empty pool")
+}
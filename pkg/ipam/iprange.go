@@ -17,9 +17,62 @@ package ipam
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 )
 
+// Parse an IP address for use in an IP range.  IPv6 addresses with a
+// zone (e.g. fe80::1%eth0) are rejected rather than stripped, since
+// the zone cannot be represented in the free list and two addresses
+// differing only by zone would otherwise compare as equal.
+func ParseIp(s string) (net.IP, error) {
+	if strings.Contains(s, "%") {
+		return nil, fmt.Errorf("Scoped IP address %q is not supported", s)
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("Invalid IP address: " + s)
+	}
+	return ip, nil
+}
+
+// Format the range as start-end, or just the address for a range
+// containing a single address
+func (r IpRange) String() string {
+	if r.Start.Equal(r.End) {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// Parse an IP range in the format produced by IpRange.String
+func ParseIpRange(s string) (IpRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := ParseIp(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return IpRange{}, err
+	}
+	end := start
+	if len(parts) > 1 {
+		end, err = ParseIp(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return IpRange{}, err
+		}
+	}
+
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return IpRange{},
+			fmt.Errorf("Mixed address families in IP range %q", s)
+	}
+	if bytes.Compare(start, end) > 0 {
+		return IpRange{},
+			fmt.Errorf("Start of IP range %q is after the end", s)
+	}
+	return IpRange{Start: start, End: end}, nil
+}
+
 func Range2Cidr(start, end net.IP) (r []*net.IPNet) {
 	maxLen := 8 * len(start)
 	endOfRange := make([]byte, len(start))
@@ -54,6 +107,20 @@ func subnetRange(subnet *net.IPNet) (start net.IP, end net.IP) {
 	return
 }
 
+// Compute the first and last usable host addresses in a subnet.  For
+// IPv4 subnets with a prefix shorter than /31 the network and
+// broadcast addresses are excluded; IPv6 subnets and IPv4 /31 and /32
+// subnets return the full range.
+func UsableHostRange(cidr *net.IPNet) (net.IP, net.IP) {
+	start, end := subnetRange(cidr)
+	ones, bits := cidr.Mask.Size()
+	if bits == 8*net.IPv4len && ones < 31 {
+		start = next(start)
+		end = prev(end)
+	}
+	return start, end
+}
+
 func next(ip net.IP) net.IP {
 	n := len(ip)
 	out := make(net.IP, n)
@@ -74,6 +141,26 @@ func next(ip net.IP) net.IP {
 	return out
 }
 
+func prev(ip net.IP) net.IP {
+	n := len(ip)
+	out := make(net.IP, n)
+	copy := false
+	for n > 0 {
+		n--
+		if copy {
+			out[n] = ip[n]
+			continue
+		}
+		if ip[n] > 0 {
+			out[n] = ip[n] - 1
+			copy = true
+			continue
+		}
+		out[n] = 255
+	}
+	return out
+}
+
 func last(ip net.IP, mask net.IPMask) net.IP {
 	n := len(ip)
 	out := make(net.IP, n)
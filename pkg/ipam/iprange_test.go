@@ -15,6 +15,7 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"testing"
@@ -217,3 +218,154 @@ func TestRange2Cidr(t *testing.T) {
 			fmt.Sprintf("%s - %s", rt.input[0], rt.input[1]))
 	}
 }
+
+type parseIpTest struct {
+	input string
+	ip    net.IP
+	err   bool
+	desc  string
+}
+
+var parseIpTests = []parseIpTest{
+	{"10.0.1.1", net.ParseIP("10.0.1.1"), false, "v4"},
+	{"fe80::1", net.ParseIP("fe80::1"), false, "v6 link-local"},
+	{"fe80::1%eth0", nil, true, "v6 zone"},
+	{"fe80::1%", nil, true, "v6 empty zone"},
+	{"10.0.1", nil, true, "invalid"},
+}
+
+func TestParseIp(t *testing.T) {
+	for i, pt := range parseIpTests {
+		ip, err := ParseIp(pt.input)
+		if pt.err {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, pt.desc))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("err %d: %s", i, pt.desc))
+		}
+		assert.Equal(t, pt.ip, ip, fmt.Sprintf("ip %d: %s", i, pt.desc))
+	}
+
+	// an unparseable zoned address must never reach the free list
+	ipa := New()
+	ipa.AddRange(net.ParseIP("fe80::1%eth0"), net.ParseIP("fe80::ff"))
+	assert.Equal(t, []IpRange{}, ipa.FreeList, "zoned range")
+}
+
+type parseIpRangeTest struct {
+	input  string
+	output IpRange
+	str    string
+	err    bool
+	desc   string
+}
+
+var parseIpRangeTests = []parseIpRangeTest{
+	{
+		"10.0.1.1-10.0.1.254",
+		IpRange{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.254")},
+		"10.0.1.1-10.0.1.254",
+		false,
+		"v4",
+	},
+	{
+		"10.0.1.1",
+		IpRange{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		"10.0.1.1",
+		false,
+		"v4 single",
+	},
+	{
+		"10.0.1.1-10.0.1.1",
+		IpRange{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		"10.0.1.1",
+		false,
+		"v4 single range",
+	},
+	{
+		" fd43:85d7:bcf2:9ad2:: - fd43:85d7:bcf2:9ad2::ff ",
+		IpRange{net.ParseIP("fd43:85d7:bcf2:9ad2::"),
+			net.ParseIP("fd43:85d7:bcf2:9ad2::ff")},
+		"fd43:85d7:bcf2:9ad2::-fd43:85d7:bcf2:9ad2::ff",
+		false,
+		"v6",
+	},
+	{"10.0.1.254-10.0.1.1", IpRange{}, "", true, "reversed"},
+	{"10.0.1.1-fd43:85d7:bcf2:9ad2::ff", IpRange{}, "", true, "mixed"},
+	{"10.0.1.1-", IpRange{}, "", true, "missing end"},
+	{"fe80::1%eth0", IpRange{}, "", true, "zoned"},
+}
+
+func TestParseIpRange(t *testing.T) {
+	for i, pt := range parseIpRangeTests {
+		r, err := ParseIpRange(pt.input)
+		if pt.err {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, pt.desc))
+			continue
+		}
+		assert.Nil(t, err, fmt.Sprintf("err %d: %s", i, pt.desc))
+		assert.Equal(t, pt.output, r, fmt.Sprintf("parse %d: %s", i, pt.desc))
+		assert.Equal(t, pt.str, r.String(),
+			fmt.Sprintf("string %d: %s", i, pt.desc))
+
+		rt, err := ParseIpRange(r.String())
+		assert.Nil(t, err, fmt.Sprintf("round trip err %d: %s", i, pt.desc))
+		assert.Equal(t, r, rt, fmt.Sprintf("round trip %d: %s", i, pt.desc))
+	}
+}
+
+type usableHostRangeTest struct {
+	cidr  string
+	start string
+	end   string
+	desc  string
+}
+
+var usableHostRangeTests = []usableHostRangeTest{
+	{"10.0.1.0/24", "10.0.1.1", "10.0.1.254", "v4 /24"},
+	{"10.0.1.77/24", "10.0.1.1", "10.0.1.254", "v4 /24 host bits"},
+	{"10.0.1.4/31", "10.0.1.4", "10.0.1.5", "v4 /31"},
+	{"10.0.1.4/32", "10.0.1.4", "10.0.1.4", "v4 /32"},
+	{"fd43:85d7:bcf2:9ad2::/64", "fd43:85d7:bcf2:9ad2::",
+		"fd43:85d7:bcf2:9ad2:ffff:ffff:ffff:ffff", "v6 /64"},
+}
+
+func TestUsableHostRange(t *testing.T) {
+	for i, ut := range usableHostRangeTests {
+		_, cidr, err := net.ParseCIDR(ut.cidr)
+		assert.Nil(t, err, fmt.Sprintf("parse %d: %s", i, ut.desc))
+		start, end := UsableHostRange(cidr)
+		assert.Equal(t, ut.start, start.String(),
+			fmt.Sprintf("start %d: %s", i, ut.desc))
+		assert.Equal(t, ut.end, end.String(),
+			fmt.Sprintf("end %d: %s", i, ut.desc))
+	}
+}
+
+func TestIpRangeJson(t *testing.T) {
+	// net.IP marshals as text, so ranges serialize as readable
+	// address strings without custom marshalling
+	ranges := []IpRange{
+		{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.254")},
+		{net.ParseIP("10.0.2.1").To4(), net.ParseIP("10.0.2.1").To4()},
+		{net.ParseIP("fd00::1"), net.ParseIP("fd00::ff")},
+	}
+	raw, err := json.Marshal(ranges)
+	assert.Nil(t, err, "marshal")
+	assert.Equal(t, `[{"start":"10.0.0.1","end":"10.0.1.254"},`+
+		`{"start":"10.0.2.1","end":"10.0.2.1"},`+
+		`{"start":"fd00::1","end":"fd00::ff"}]`, string(raw), "marshal")
+
+	var parsed []IpRange
+	assert.Nil(t, json.Unmarshal(raw, &parsed), "unmarshal")
+	if assert.Equal(t, len(ranges), len(parsed), "unmarshal") {
+		for i := range ranges {
+			assert.True(t, ranges[i].Start.Equal(parsed[i].Start),
+				fmt.Sprintf("start %d", i))
+			assert.True(t, ranges[i].End.Equal(parsed[i].End),
+				fmt.Sprintf("end %d", i))
+		}
+	}
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"start":"10.0.0.300"}`),
+		&IpRange{}), "invalid address")
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package ipam
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Return a free IP address as a netip.Addr and remove it from the free
+// list.  IPv4 addresses are returned in their 4-byte form.
+func (ipa *IpAlloc) GetAddr() (netip.Addr, error) {
+	ip, err := ipa.GetIp()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr, nil
+}
+
+// Add all the addresses in the given prefix to the free list.  As with
+// AddSubnet, this includes the network address.  Invalid prefixes are
+// ignored.
+func (ipa *IpAlloc) AddPrefix(prefix netip.Prefix) {
+	if !prefix.IsValid() {
+		return
+	}
+	addr := prefix.Masked().Addr()
+	ipa.AddSubnet(&net.IPNet{
+		IP:   net.IP(addr.AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), addr.BitLen()),
+	})
+}
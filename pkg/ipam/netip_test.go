@@ -0,0 +1,60 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package ipam
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetipAddr(t *testing.T) {
+	prefixes := []string{
+		"10.0.1.0/30",
+		"10.0.2.5/31",
+		"fd43:85d7:bcf2:9ad2::/126",
+	}
+
+	for _, p := range prefixes {
+		prefix := netip.MustParsePrefix(p)
+		_, subnet, _ := net.ParseCIDR(p)
+
+		withNetip := New()
+		withNetip.AddPrefix(prefix)
+		withNet := New()
+		withNet.AddSubnet(subnet)
+		assert.Equal(t, withNet.GetSize(), withNetip.GetSize(), "size", p)
+
+		for !withNet.Empty() {
+			expected, err := withNet.GetIp()
+			assert.Nil(t, err, "GetIp", p)
+			addr, err := withNetip.GetAddr()
+			assert.Nil(t, err, "GetAddr", p)
+			assert.Equal(t, expected.String(), addr.String(), "addr", p)
+			assert.Equal(t, expected.To4() != nil, addr.Is4(), "family", p)
+		}
+		_, err := withNetip.GetAddr()
+		assert.NotNil(t, err, "exhausted", p)
+	}
+
+	ipa := New()
+	ipa.AddPrefix(netip.Prefix{})
+	assert.True(t, ipa.Empty(), "invalid prefix")
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// Chooses which free address GetIp hands out
+type AllocationPolicy interface {
+	// Select a free address from the free list, which is sorted and
+	// must not be modified.  The free list is never empty and does not
+	// contain dynamically excluded addresses.
+	Select(free []IpRange) (net.IP, error)
+}
+
+// Allocation policy that hands out the lowest free address.  This is
+// the policy used by pools created without one.
+type LowestFirstPolicy struct{}
+
+func (LowestFirstPolicy) Select(free []IpRange) (net.IP, error) {
+	return free[0].Start, nil
+}
+
+// Allocation policy with state that Save and Load persist along with
+// the free list
+type PersistentPolicy interface {
+	AllocationPolicy
+
+	// Serialize the state of the policy
+	SaveState() ([]byte, error)
+
+	// Restore state written by SaveState
+	LoadState(data []byte) error
+}
+
+// Allocation policy that hands out addresses in a ring.  Each
+// allocation takes the lowest free address after the previous one,
+// wrapping to the start of the pool only when there is no free address
+// above it, so an address that is released is not handed out again
+// until the ring has gone around.  The position in the ring is saved
+// and restored by Save and Load.
+type RingPolicy struct {
+	cursor net.IP
+}
+
+type ringPolicyState struct {
+	Cursor net.IP `json:"cursor,omitempty"`
+}
+
+func (p *RingPolicy) Select(free []IpRange) (net.IP, error) {
+	ip := free[0].Start
+	cursor := p.cursor.To16()
+	if len(ip) == net.IPv4len {
+		cursor = p.cursor.To4()
+	}
+	if cursor != nil && (cursor.To4() == nil) == (ip.To4() == nil) {
+		if next, ok := nextFree(free, cursor); ok {
+			ip = next
+		}
+	}
+	p.cursor = append(net.IP(nil), ip...)
+	return ip, nil
+}
+
+func (p *RingPolicy) SaveState() ([]byte, error) {
+	return json.Marshal(&ringPolicyState{Cursor: p.cursor})
+}
+
+func (p *RingPolicy) LoadState(data []byte) error {
+	state := &ringPolicyState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+	p.cursor = state.Cursor
+	return nil
+}
+
+// Create a new IpAlloc that uses the given policy to choose the
+// addresses handed out by GetIp
+func NewWithPolicy(policy AllocationPolicy) *IpAlloc {
+	ipa := New()
+	ipa.policy = policy
+	return ipa
+}
+
+// Allocate the address chosen by the allocation policy
+func (ipa *IpAlloc) getIpWithPolicy() (net.IP, error) {
+	free := ipa.allocatableRanges()
+	if len(free) == 0 {
+		ipa.emitEvent(AllocEventExhausted, nil)
+		return nil, errors.New("No IP addresses are available")
+	}
+	ip, err := ipa.policy.Select(free)
+	if err != nil {
+		return nil, err
+	}
+	ip = ipa.canonicalIp(ip)
+	if ip == nil {
+		return nil, errors.New("Allocation policy selected an invalid address")
+	}
+	if ipa.isExcluded(ip) {
+		return nil, errors.New("Allocation policy selected an excluded address")
+	}
+	ip = append(net.IP(nil), ip...)
+	if !ipa.RemoveIp(ip) {
+		return nil, errors.New("Allocation policy selected an address that is not free")
+	}
+	ipa.trackAllocated(ip)
+	return ip, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type highestFirstPolicy struct{}
+
+func (highestFirstPolicy) Select(free []IpRange) (net.IP, error) {
+	return free[len(free)-1].End, nil
+}
+
+type fixedPolicy struct {
+	ip  net.IP
+	err error
+}
+
+func (p fixedPolicy) Select(free []IpRange) (net.IP, error) {
+	return p.ip, p.err
+}
+
+func TestAllocationPolicy(t *testing.T) {
+	ipa := NewWithPolicy(highestFirstPolicy{})
+	ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3"))
+	ipa.AddRange(net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.2"))
+
+	for _, expected := range []string{
+		"10.0.2.2", "10.0.2.1", "10.0.1.3", "10.0.1.2", "10.0.1.1",
+	} {
+		ip, err := ipa.GetIp()
+		assert.Nil(t, err, expected)
+		assert.Equal(t, expected, ip.String(), expected)
+	}
+	_, err := ipa.GetIp()
+	assert.NotNil(t, err, "empty")
+
+	lowest := NewWithPolicy(LowestFirstPolicy{})
+	lowest.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3"))
+	ip, err := lowest.GetIp()
+	assert.Nil(t, err, "lowest")
+	assert.Equal(t, "10.0.1.1", ip.String(), "lowest")
+}
+
+func TestAllocationPolicyErrors(t *testing.T) {
+	for _, pt := range []struct {
+		policy fixedPolicy
+		desc   string
+	}{
+		{fixedPolicy{nil, errors.New("no")}, "policy error"},
+		{fixedPolicy{net.ParseIP("10.0.9.9"), nil}, "not free"},
+		{fixedPolicy{net.ParseIP("fd00::1"), nil}, "wrong family"},
+	} {
+		ipa := NewWithPolicy(pt.policy)
+		ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3"))
+		_, err := ipa.GetIp()
+		assert.NotNil(t, err, pt.desc)
+		assert.Equal(t, int64(3), ipa.GetSize(), pt.desc)
+	}
+}
+
+func TestAllocationPolicyExclusions(t *testing.T) {
+	ipa := NewWithPolicy(highestFirstPolicy{})
+	ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3"))
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.1.3")})
+
+	assert.Nil(t, ipa.AdmitServiceIp(nil), "admit")
+	getIps(t, ipa, "10.0.1.2", "10.0.1.1")
+
+	// only the excluded address is left
+	reason, _ := admissionReason(ipa.AdmitServiceIp(nil))
+	assert.Equal(t, AdmissionExhausted, reason, "admit excluded")
+	_, err := ipa.GetIp()
+	assert.NotNil(t, err, "get excluded")
+	assert.Equal(t, int64(1), ipa.GetSize(), "excluded still free")
+}
+
+func getIps(t *testing.T, ipa *IpAlloc, expected ...string) {
+	for _, e := range expected {
+		ip, err := ipa.GetIp()
+		if assert.Nil(t, err, e) {
+			assert.Equal(t, e, ip.String(), e)
+		}
+	}
+}
+
+func TestRingPolicy(t *testing.T) {
+	ipa := NewWithPolicy(&RingPolicy{})
+	ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3"))
+	ipa.AddRange(net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.2"))
+
+	getIps(t, ipa, "10.0.1.1", "10.0.1.2")
+
+	// a released address is not reused until the ring wraps
+	ipa.AddIp(net.ParseIP("10.0.1.1"))
+	getIps(t, ipa, "10.0.1.3", "10.0.2.1")
+	ipa.AddIp(net.ParseIP("10.0.1.3"))
+	getIps(t, ipa, "10.0.2.2", "10.0.1.1", "10.0.1.3")
+	_, err := ipa.GetIp()
+	assert.NotNil(t, err, "empty")
+}
+
+func TestRingPolicySaveLoad(t *testing.T) {
+	ipa := NewWithPolicy(&RingPolicy{})
+	ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.4"))
+	getIps(t, ipa, "10.0.1.1", "10.0.1.2")
+	ipa.AddIp(net.ParseIP("10.0.1.1"))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, ipa.Save(buf), "save")
+	loaded := NewWithPolicy(&RingPolicy{})
+	assert.Nil(t, loaded.Load(bytes.NewReader(buf.Bytes())), "load")
+	assert.Equal(t, int64(3), loaded.GetSize(), "size")
+	getIps(t, loaded, "10.0.1.3", "10.0.1.4", "10.0.1.1")
+
+	// pools without a persistent policy ignore the saved cursor
+	plain := New()
+	assert.Nil(t, plain.Load(bytes.NewReader(buf.Bytes())), "plain")
+	getIps(t, plain, "10.0.1.1")
+
+	// a ring pool still loads state saved as just the free list
+	buf.Reset()
+	assert.Nil(t, New().Save(buf), "save plain")
+	assert.Nil(t, loaded.Load(buf), "load plain")
+	assert.True(t, loaded.Empty(), "load plain")
+
+	err := NewWithPolicy(&RingPolicy{}).Load(bytes.NewReader([]byte(
+		`{"free-list":[],"policy":{"cursor":"bogus"}}`)))
+	_, ok := err.(*CorruptStateError)
+	assert.True(t, ok, "corrupt cursor")
+}
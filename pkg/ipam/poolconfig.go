@@ -0,0 +1,234 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// Configuration for populating an IP pool, for example:
+//
+//	{
+//	    "cidrs": ["10.1.0.0/24"],
+//	    "ranges": ["10.2.0.10-10.2.0.99", "10.2.0.200"],
+//	    "exclude": ["10.1.0.0/30", "10.2.0.50-10.2.0.59"]
+//	}
+//
+// CIDRs are added in full, including the network address, as with
+// AddSubnet.  Ranges use the format accepted by ParseIpRange.  Each
+// exclude entry is either a CIDR or a range, and is removed after all
+// the CIDRs and ranges have been added.  All the addresses must be of
+// the same family.
+type PoolConfig struct {
+	Cidrs   []string `json:"cidrs,omitempty"`
+	Ranges  []string `json:"ranges,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func parseConfigCidr(s string) (IpRange, error) {
+	_, subnet, err := net.ParseCIDR(strings.TrimSpace(s))
+	if err != nil {
+		return IpRange{}, err
+	}
+	start, end := subnetRange(subnet)
+	return IpRange{Start: start, End: end}, nil
+}
+
+func parseConfigExclude(s string) (IpRange, error) {
+	if strings.Contains(s, "/") {
+		return parseConfigCidr(s)
+	}
+	return ParseIpRange(s)
+}
+
+// Populate the pool from a JSON PoolConfig.  The configuration is
+// validated in full before the pool is changed, so on error the pool
+// is left as it was.
+func (ipa *IpAlloc) LoadConfig(r io.Reader) error {
+	config := &PoolConfig{}
+	err := json.NewDecoder(r).Decode(config)
+	if err != nil {
+		return err
+	}
+
+	var add, exclude []IpRange
+	for _, s := range config.Cidrs {
+		ipr, err := parseConfigCidr(s)
+		if err != nil {
+			return err
+		}
+		add = append(add, ipr)
+	}
+	for _, s := range config.Ranges {
+		ipr, err := ParseIpRange(s)
+		if err != nil {
+			return err
+		}
+		add = append(add, ipr)
+	}
+	for _, s := range config.Exclude {
+		ipr, err := parseConfigExclude(s)
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, ipr)
+	}
+
+	if err := ipa.checkFamily(append(add, exclude...)); err != nil {
+		return err
+	}
+
+	ipa.AddRanges(add)
+	ipa.RemoveRanges(exclude)
+	return nil
+}
+
+// Check that the ranges are all of the same family as each other and
+// as the addresses already in the pool
+func (ipa *IpAlloc) checkFamily(ranges []IpRange) error {
+	var v4 *bool
+	if len(ipa.FreeList) > 0 {
+		isV4 := ipa.FreeList[0].Start.To4() != nil
+		v4 = &isV4
+	}
+	for _, ipr := range ranges {
+		isV4 := ipr.Start.To4() != nil
+		if v4 == nil {
+			v4 = &isV4
+		} else if *v4 != isV4 || (ipr.End.To4() != nil) != isV4 {
+			return fmt.Errorf("Mixed address families in IP pool at %s",
+				ipr.String())
+		}
+	}
+	return nil
+}
+
+// Change the configured ranges of the pool to the given ranges.  Only
+// the difference from the ranges configured by the previous call is
+// applied: newly configured addresses are added to the free list and
+// addresses no longer configured are removed from it, while addresses
+// in ranges that remain configured are left alone, so allocations
+// from them are unaffected.  The first call treats the pool as having
+// no configured ranges, but does not add addresses the pool already
+// holds, so it never frees an address that has been handed out.
+//
+// Removing a range that contains addresses that are not free would
+// leave those addresses allocated outside the pool, so in that case
+// an error listing the ranges and the number of addresses in use is
+// returned and the pool is left unchanged.
+func (ipa *IpAlloc) ApplyConfig(ranges []IpRange) error {
+	if err := ipa.checkFamily(ranges); err != nil {
+		return err
+	}
+
+	configured := New()
+	configured.AddRanges(ranges)
+	previous := ipa.configured
+	if previous == nil {
+		previous = New()
+	}
+
+	removed := NewFromRanges(previous.FreeList)
+	removed.RemoveAll(configured)
+	added := NewFromRanges(configured.FreeList)
+	added.RemoveAll(previous)
+	if ipa.configured == nil {
+		added.RemoveAll(ipa.heldAddresses())
+	}
+
+	var inUse []string
+	for _, r := range removed.FreeList {
+		free := NewFromRanges(ipa.FreeList).removeRange(r.Start, r.End)
+		used := new(big.Int).Sub(rangeSize(r), free)
+		if used.Sign() > 0 {
+			inUse = append(inUse,
+				fmt.Sprintf("%s (%s in use)", r.String(), used.String()))
+		}
+	}
+	if len(inUse) > 0 {
+		return fmt.Errorf("Cannot remove IP ranges with allocated addresses: %s",
+			strings.Join(inUse, ", "))
+	}
+
+	ipa.RemoveAll(removed)
+	ipa.AddAll(added)
+	ipa.configured = configured
+	ipa.configuredRanges = append([]IpRange(nil), ranges...)
+	return nil
+}
+
+// Get the addresses the pool holds: the free list together with the
+// addresses that are allocated, reserved, quarantined or reserved as
+// range heads.  Chunks taken by GetIpChunk are not tracked and so are
+// not included.
+func (ipa *IpAlloc) heldAddresses() *IpAlloc {
+	held := NewFromRanges(ipa.FreeList)
+	held.AddRanges(ipa.headRanges)
+	for _, ip := range ipa.allocated {
+		held.AddIp(ipa.canonicalIp(ip))
+	}
+	for _, res := range ipa.reservations {
+		held.AddIp(ipa.canonicalIp(res.ip))
+	}
+	for _, q := range ipa.quarantined {
+		held.AddRange(q.r.Start, q.r.End)
+	}
+	return held
+}
+
+// Get the index in the ranges last passed to ApplyConfig of the first
+// range containing the address, whether the address is free or
+// allocated.  Returns false if no configured range contains it.
+func (ipa *IpAlloc) RangeOf(ip net.IP) (int, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return 0, false
+	}
+	for i, r := range ipa.configuredRanges {
+		if (ip.To4() == nil) != (r.Start.To4() == nil) {
+			continue
+		}
+		if bytes.Compare(ip, r.Start.To16()) >= 0 &&
+			bytes.Compare(ip, r.End.To16()) <= 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Get the address ranges between the lowest and highest configured
+// addresses that are not in any range passed to ApplyConfig, in
+// ascending order.  Free and allocated addresses are both part of the
+// configured ranges, so these are the holes in the address space of
+// the pool.  Returns nil if the pool has no configured ranges.
+func (ipa *IpAlloc) Holes() []IpRange {
+	if ipa.configured == nil {
+		return nil
+	}
+	var holes []IpRange
+	ranges := ipa.configured.FreeList
+	for i := 1; i < len(ranges); i++ {
+		start, _ := carryIncrement(ranges[i-1].End)
+		end, _ := carryDecrement(ranges[i].Start)
+		holes = append(holes, IpRange{Start: start, End: end})
+	}
+	return holes
+}
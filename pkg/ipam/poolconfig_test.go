@@ -0,0 +1,264 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type loadConfigTest struct {
+	existing []IpRange
+	config   string
+	freeList []IpRange
+	err      bool
+	desc     string
+}
+
+var loadConfigTests = []loadConfigTest{
+	{
+		nil,
+		`{
+		    "cidrs": ["10.1.0.0/29"],
+		    "ranges": ["10.2.0.10-10.2.0.19", "10.2.0.30"],
+		    "exclude": ["10.1.0.0/30", "10.2.0.12-10.2.0.13", "10.2.0.30"]
+		}`,
+		// the pool takes the 4-byte form of the first CIDR
+		[]IpRange{
+			{net.ParseIP("10.1.0.4").To4(), net.ParseIP("10.1.0.7").To4()},
+			{net.ParseIP("10.2.0.10").To4(), net.ParseIP("10.2.0.11").To4()},
+			{net.ParseIP("10.2.0.14").To4(), net.ParseIP("10.2.0.19").To4()},
+		},
+		false,
+		"cidrs ranges and excludes",
+	},
+	{
+		nil,
+		`{"cidrs": ["fd43:85d7:bcf2:9ad2::/120"],
+		  "exclude": ["fd43:85d7:bcf2:9ad2::/121"]}`,
+		[]IpRange{
+			{net.ParseIP("fd43:85d7:bcf2:9ad2::80"),
+				net.ParseIP("fd43:85d7:bcf2:9ad2::ff")},
+		},
+		false,
+		"v6",
+	},
+	{
+		[]IpRange{{net.ParseIP("10.3.0.1"), net.ParseIP("10.3.0.1")}},
+		`{"ranges": ["10.3.0.2"]}`,
+		[]IpRange{{net.ParseIP("10.3.0.1"), net.ParseIP("10.3.0.2")}},
+		false,
+		"existing pool",
+	},
+	{
+		nil,
+		`{"cidrs": ["10.1.0.0/29"], "ranges": ["fd43:85d7:bcf2:9ad2::1"]}`,
+		[]IpRange{},
+		true,
+		"mixed families",
+	},
+	{
+		nil,
+		`{"cidrs": ["10.1.0.0/29"], "exclude": ["fd43:85d7:bcf2:9ad2::/64"]}`,
+		[]IpRange{},
+		true,
+		"mixed family exclude",
+	},
+	{
+		[]IpRange{{net.ParseIP("10.3.0.1"), net.ParseIP("10.3.0.1")}},
+		`{"cidrs": ["fd43:85d7:bcf2:9ad2::/64"]}`,
+		[]IpRange{{net.ParseIP("10.3.0.1"), net.ParseIP("10.3.0.1")}},
+		true,
+		"family differs from pool",
+	},
+	{
+		nil,
+		`{"cidrs": ["10.1.0.0/33"]}`,
+		[]IpRange{},
+		true,
+		"invalid cidr",
+	},
+	{
+		nil,
+		`{"ranges": ["10.1.0.9-10.1.0.1"]}`,
+		[]IpRange{},
+		true,
+		"invalid range",
+	},
+	{
+		nil,
+		`{"cidrs": `,
+		[]IpRange{},
+		true,
+		"invalid json",
+	},
+}
+
+func TestLoadConfig(t *testing.T) {
+	for i, lt := range loadConfigTests {
+		ipa := NewFromRanges(lt.existing)
+		err := ipa.LoadConfig(strings.NewReader(lt.config))
+		if lt.err {
+			assert.NotNil(t, err, fmt.Sprintf("err %d: %s", i, lt.desc))
+		} else {
+			assert.Nil(t, err, fmt.Sprintf("err %d: %s", i, lt.desc))
+		}
+		assert.Equal(t, lt.freeList, ipa.FreeList,
+			fmt.Sprintf("free list %d: %s", i, lt.desc))
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	ipr := func(s string) IpRange {
+		r, err := ParseIpRange(s)
+		if err != nil {
+			panic(err)
+		}
+		return r
+	}
+
+	ipa := New()
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		ipr("10.0.0.1-10.0.0.10"),
+		ipr("10.0.1.1-10.0.1.10"),
+	}), "initial")
+	assert.Equal(t, int64(20), ipa.GetSize(), "initial")
+
+	allocated, _ := ipa.GetIp()
+	assert.Equal(t, "10.0.0.1", allocated.String(), "allocated")
+
+	// grow the first range and drop the second
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		ipr("10.0.0.1-10.0.0.20"),
+	}), "grow and shrink")
+	assert.Equal(t, []IpRange{
+		ipr("10.0.0.2-10.0.0.20"),
+	}, ipa.FreeList, "grow and shrink")
+
+	// the allocated address is in the range being removed
+	err := ipa.ApplyConfig([]IpRange{
+		ipr("10.0.0.11-10.0.0.20"),
+	})
+	if assert.NotNil(t, err, "in use") {
+		assert.Equal(t, "Cannot remove IP ranges with allocated "+
+			"addresses: 10.0.0.1-10.0.0.10 (1 in use)", err.Error(), "in use")
+	}
+	assert.Equal(t, []IpRange{
+		ipr("10.0.0.2-10.0.0.20"),
+	}, ipa.FreeList, "unchanged")
+
+	// shrink around the allocation, which survives
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		ipr("10.0.0.1-10.0.0.5"),
+		ipr("10.0.2.1"),
+	}), "shrink")
+	assert.Equal(t, []IpRange{
+		ipr("10.0.0.2-10.0.0.5"),
+		ipr("10.0.2.1"),
+	}, ipa.FreeList, "shrink")
+	assert.Equal(t, []net.IP{allocated}, ipa.AllocatedIps(), "survives")
+
+	assert.NotNil(t, ipa.ApplyConfig([]IpRange{
+		ipr("fd00::1-fd00::10"),
+	}), "family")
+
+	// the first call does not free addresses already handed out
+	ipa = New()
+	ipa.AddRange(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.3"))
+	allocated, _ = ipa.GetIp()
+	assert.Nil(t, ipa.MarkAllocated([]net.IP{net.ParseIP("10.0.0.2")}),
+		"mark allocated")
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		ipr("10.0.0.1-10.0.0.3"),
+	}), "existing pool")
+	assert.Equal(t, []IpRange{
+		ipr("10.0.0.3"),
+	}, ipa.FreeList, "existing pool")
+	for i := 0; i < 2; i++ {
+		ip, err := ipa.GetIp()
+		if err == nil {
+			assert.NotEqual(t, allocated.String(), ip.String(), "reallocated")
+			assert.NotEqual(t, "10.0.0.2", ip.String(), "reallocated")
+		}
+	}
+}
+
+var rangeOfTests = []struct {
+	ip    string
+	index int
+	found bool
+	desc  string
+}{
+	{"10.0.1.1", 0, true, "first address"},
+	{"10.0.1.10", 0, true, "last address"},
+	{"10.0.2.5", 1, true, "second range"},
+	{"::ffff:10.0.2.5", 1, true, "mapped"},
+	{"10.0.3.1", 2, true, "adjacent range"},
+	{"10.0.1.11", 0, false, "gap"},
+	{"10.0.9.1", 0, false, "outside pool"},
+	{"fd00::1", 0, false, "wrong family"},
+}
+
+func TestRangeOf(t *testing.T) {
+	ipa := New()
+	_, ok := ipa.RangeOf(net.ParseIP("10.0.1.1"))
+	assert.False(t, ok, "not configured")
+
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+		{net.ParseIP("10.0.2.1").To4(), net.ParseIP("10.0.2.255").To4()},
+		{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.10")},
+	}), "apply")
+	// allocated addresses are found as well as free ones
+	ipa.GetIp()
+	ipa.RemoveRange(net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10"))
+
+	for i, rt := range rangeOfTests {
+		index, ok := ipa.RangeOf(net.ParseIP(rt.ip))
+		assert.Equal(t, rt.found, ok, fmt.Sprintf("found %d: %s", i, rt.desc))
+		assert.Equal(t, rt.index, index, fmt.Sprintf("index %d: %s", i, rt.desc))
+	}
+}
+
+func TestHoles(t *testing.T) {
+	ipa := New()
+	assert.Nil(t, ipa.Holes(), "not configured")
+
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	}), "apply one")
+	assert.Nil(t, ipa.Holes(), "one range")
+
+	// adjacent ranges have no hole between them
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		{net.ParseIP("10.0.5.0"), net.ParseIP("10.0.5.10")},
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+		{net.ParseIP("10.0.1.11"), net.ParseIP("10.0.1.20")},
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.255")},
+		{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.10")},
+	}), "apply")
+	// and holes are unaffected by allocations
+	ipa.GetIp()
+	ipa.RemoveRange(net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10"))
+
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.21"), net.ParseIP("10.0.2.0")},
+		{net.ParseIP("10.0.3.11"), net.ParseIP("10.0.4.255")},
+	}, ipa.Holes(), "between ranges")
+}
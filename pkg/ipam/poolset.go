@@ -0,0 +1,148 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// A set of IP pools identified by name, e.g. one per environment
+type PoolSet struct {
+	pools map[string]*IpAlloc
+}
+
+// Create a new empty PoolSet
+func NewPoolSet() *PoolSet {
+	return &PoolSet{
+		pools: make(map[string]*IpAlloc),
+	}
+}
+
+// Add a pool to the set under the given name, replacing any existing
+// pool with that name
+func (ps *PoolSet) Add(name string, pool *IpAlloc) {
+	ps.pools[name] = pool
+}
+
+// Get the pool with the given name, or nil if there is none
+func (ps *PoolSet) Pool(name string) *IpAlloc {
+	return ps.pools[name]
+}
+
+func (ps *PoolSet) lookup(name string) (*IpAlloc, error) {
+	pool, ok := ps.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown IP pool %q", name)
+	}
+	return pool, nil
+}
+
+// Return a free IP address from the named pool and remove it from the
+// pool's free list
+func (ps *PoolSet) Get(name string) (net.IP, error) {
+	pool, err := ps.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return pool.GetIp()
+}
+
+// Return an IP address to the free list of the named pool, after the
+// quarantine period of the pool if it has one
+func (ps *PoolSet) Release(name string, ip net.IP) error {
+	pool, err := ps.lookup(name)
+	if err != nil {
+		return err
+	}
+	pool.ReleaseIp(ip)
+	return nil
+}
+
+// Move up to want free addresses from the other pools of the set to
+// the named pool, for example when that pool has run out while its
+// siblings have plenty.  Each other pool gives up a share of the
+// addresses proportional to its number of free addresses, taking the
+// lowest of them.  Pools of a different address family from the named
+// pool are left alone.  Returns the number of addresses moved, and an
+// error if none could be moved.
+func (ps *PoolSet) Rebalance(name string, want int64) (int64, error) {
+	pool, err := ps.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	if want <= 0 {
+		return 0, nil
+	}
+
+	var names []string
+	for n := range ps.pools {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	ref := familyRef(pool)
+	var donors []string
+	free := make(map[string]int64)
+	total := big.NewInt(0)
+	for _, n := range names {
+		p := ps.pools[n]
+		if n == name || p.Empty() {
+			continue
+		}
+		if ref == nil {
+			ref = p.FreeList[0].Start
+		} else if (ref.To4() != nil) != (p.FreeList[0].Start.To4() != nil) {
+			continue
+		}
+		donors = append(donors, n)
+		free[n] = p.GetSize()
+		total.Add(total, big.NewInt(free[n]))
+	}
+
+	moved := int64(0)
+	for _, n := range donors {
+		if moved >= want {
+			break
+		}
+		// share = ceil(want * free / total), so the shares add up to
+		// at least want
+		share := new(big.Int).Mul(big.NewInt(want), big.NewInt(free[n]))
+		share.Add(share, new(big.Int).Sub(total, one))
+		share.Div(share, total)
+		count := share.Int64()
+		if count > free[n] {
+			count = free[n]
+		}
+		if count > want-moved {
+			count = want - moved
+		}
+
+		donor := ps.pools[n]
+		chunk, err := donor.GetIpChunk(count)
+		if err != nil {
+			continue
+		}
+		pool.AddRanges(chunk)
+		moved += count
+	}
+	if moved == 0 {
+		return 0, errors.New("No free IP addresses in other pools")
+	}
+	return moved, nil
+}
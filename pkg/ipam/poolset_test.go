@@ -0,0 +1,120 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolSet(t *testing.T) {
+	ps := NewPoolSet()
+	ps.Add("dev", NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+	}))
+	ps.Add("prod", NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.2")},
+	}))
+
+	ip, err := ps.Get("dev")
+	assert.Nil(t, err, "get dev")
+	assert.Equal(t, net.ParseIP("10.0.1.1"), ip, "get dev")
+	ip, err = ps.Get("prod")
+	assert.Nil(t, err, "get prod")
+	assert.Equal(t, net.ParseIP("10.0.2.1"), ip, "get prod")
+
+	// exhausting one pool does not affect the other
+	_, err = ps.Get("dev")
+	assert.Nil(t, err, "get dev last")
+	_, err = ps.Get("dev")
+	assert.NotNil(t, err, "dev exhausted")
+	assert.Equal(t, int64(1), ps.Pool("prod").GetSize(), "prod size")
+
+	assert.Nil(t, ps.Release("dev", net.ParseIP("10.0.1.2")), "release dev")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.2"), net.ParseIP("10.0.1.2")},
+	}, ps.Pool("dev").FreeList, "released to dev")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.2.2"), net.ParseIP("10.0.2.2")},
+	}, ps.Pool("prod").FreeList, "prod unchanged")
+
+	_, err = ps.Get("staging")
+	assert.NotNil(t, err, "get unknown")
+	assert.NotNil(t, ps.Release("staging", net.ParseIP("10.0.3.1")),
+		"release unknown")
+	assert.Nil(t, ps.Pool("staging"), "unknown pool")
+}
+
+func TestPoolSetRebalance(t *testing.T) {
+	ps := NewPoolSet()
+	ps.Add("node1", NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+	}))
+	ps.Add("node2", NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.8")},
+	}))
+	ps.Add("node3", NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.3.1"), net.ParseIP("10.0.3.4")},
+	}))
+	ps.Add("v6", NewFromRanges([]IpRange{
+		{net.ParseIP("fd00::1"), net.ParseIP("fd00::ff")},
+	}))
+
+	// drain node1
+	for i := 0; i < 2; i++ {
+		_, err := ps.Get("node1")
+		assert.Nil(t, err, "drain")
+	}
+	_, err := ps.Get("node1")
+	assert.NotNil(t, err, "drained")
+
+	// node2 has twice the free space of node3, so gives twice as much
+	moved, err := ps.Rebalance("node1", 6)
+	assert.Nil(t, err, "rebalance")
+	assert.Equal(t, int64(6), moved, "rebalance")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.4")},
+		{net.ParseIP("10.0.3.1"), net.ParseIP("10.0.3.2")},
+	}, ps.Pool("node1").FreeList, "borrowed")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.2.5"), net.ParseIP("10.0.2.8")},
+	}, ps.Pool("node2").FreeList, "node2 lent")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.3.3"), net.ParseIP("10.0.3.4")},
+	}, ps.Pool("node3").FreeList, "node3 lent")
+	assert.Equal(t, int64(255), ps.Pool("v6").GetSize(), "other family")
+
+	ip, err := ps.Get("node1")
+	assert.Nil(t, err, "get borrowed")
+	assert.Equal(t, net.ParseIP("10.0.2.1"), ip, "get borrowed")
+
+	// no more than the siblings have free is moved
+	moved, err = ps.Rebalance("node1", 100)
+	assert.Nil(t, err, "rebalance all")
+	assert.Equal(t, int64(6), moved, "rebalance all")
+	assert.True(t, ps.Pool("node2").Empty(), "node2 empty")
+	assert.True(t, ps.Pool("node3").Empty(), "node3 empty")
+	assert.Nil(t, ps.Pool("node1").Validate(), "valid")
+
+	_, err = ps.Rebalance("node2", 1)
+	assert.Nil(t, err, "borrow back")
+	ps.Pool("node1").GetIpChunk(ps.Pool("node1").GetSize())
+	_, err = ps.Rebalance("node2", 1)
+	assert.NotNil(t, err, "nothing to borrow")
+	_, err = ps.Rebalance("node4", 1)
+	assert.NotNil(t, err, "unknown pool")
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+)
+
+// A range of released addresses held out of the free list until it
+// expires
+type quarantinedRange struct {
+	r      IpRange
+	expiry time.Time
+}
+
+// Set how long addresses released by ReleaseIp and ReleaseRange are
+// held before they can be allocated again, for example to let
+// connections to a crashed pod die out before its address is reused.
+// Zero, the default, returns released addresses to the free list
+// immediately.
+func (ipa *IpAlloc) SetQuarantine(d time.Duration) {
+	ipa.quarantineTime = d
+}
+
+// Release an allocated IP address, returning it to the free list
+// after the quarantine period
+func (ipa *IpAlloc) ReleaseIp(ip net.IP) {
+	ipa.ReleaseRange(ip, ip)
+}
+
+// Release a range of allocated IP addresses, returning them to the
+// free list after the quarantine period.  Until then they are not
+// allocatable, but are no longer reported by AllocatedIps.  Addresses
+// in the range that are already free or quarantined are ignored, so
+// releasing an address twice does not quarantine it twice.
+func (ipa *IpAlloc) ReleaseRange(start net.IP, end net.IP) {
+	if ipa.quarantineTime <= 0 {
+		ipa.AddRange(start, end)
+		return
+	}
+	start, end = ipa.canonicalIp(start), ipa.canonicalIp(end)
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+		return
+	}
+	ipa.releaseAllocated(start, end)
+
+	held := NewFromRanges([]IpRange{{Start: start, End: end}})
+	held.RemoveRanges(ipa.FreeList)
+	for _, q := range ipa.quarantined {
+		held.RemoveRange(q.r.Start, q.r.End)
+	}
+	expiry := time.Now().Add(ipa.quarantineTime)
+	for _, r := range held.FreeList {
+		ipa.quarantined = append(ipa.quarantined, quarantinedRange{
+			r:      r,
+			expiry: expiry,
+		})
+	}
+}
+
+// Return the quarantined addresses whose quarantine expired before now
+// to the free list.  Returns the ranges that were returned, in
+// ascending order.
+func (ipa *IpAlloc) SweepQuarantine(now time.Time) []IpRange {
+	var expired []IpRange
+	remaining := ipa.quarantined[:0]
+	for _, q := range ipa.quarantined {
+		if q.expiry.Before(now) {
+			expired = append(expired, q.r)
+		} else {
+			remaining = append(remaining, q)
+		}
+	}
+	ipa.quarantined = remaining
+	sort.Slice(expired, func(i, j int) bool {
+		return bytes.Compare(expired[i].Start, expired[j].Start) < 0
+	})
+	for _, r := range expired {
+		ipa.AddRange(r.Start, r.End)
+	}
+	return expired
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3")},
+	})
+	ipa.SetQuarantine(time.Hour)
+
+	ip, err := ipa.GetIp()
+	assert.Nil(t, err, "allocate")
+	assert.Equal(t, net.ParseIP("10.0.1.1"), ip, "allocate")
+	ipa.ReleaseIp(ip)
+	assert.Empty(t, ipa.AllocatedIps(), "no longer allocated")
+	assert.Equal(t, int64(2), ipa.GetSize(), "not free while quarantined")
+
+	// the released address is not handed out again
+	for _, expected := range []string{"10.0.1.2", "10.0.1.3"} {
+		ip, err = ipa.GetIp()
+		assert.Nil(t, err, "allocate other")
+		assert.Equal(t, net.ParseIP(expected), ip, "allocate other")
+	}
+	_, err = ipa.GetIp()
+	assert.NotNil(t, err, "exhausted while quarantined")
+
+	ipa.ReleaseRange(net.ParseIP("10.0.1.2"), net.ParseIP("10.0.1.3"))
+	assert.Nil(t, ipa.SweepQuarantine(time.Now()), "sweep early")
+	assert.True(t, ipa.Empty(), "sweep early")
+
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		{net.ParseIP("10.0.1.2"), net.ParseIP("10.0.1.3")},
+	}, ipa.SweepQuarantine(time.Now().Add(2*time.Hour)), "sweep")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.3")},
+	}, ipa.FreeList, "sweep merged")
+	assert.Nil(t, ipa.SweepQuarantine(time.Now().Add(2*time.Hour)),
+		"sweep again")
+
+	ip, err = ipa.GetIp()
+	assert.Nil(t, err, "allocate swept")
+	assert.Equal(t, net.ParseIP("10.0.1.1"), ip, "allocate swept")
+
+	// without a quarantine the address is free immediately
+	ipa.SetQuarantine(0)
+	ipa.ReleaseIp(ip)
+	assert.Equal(t, int64(3), ipa.GetSize(), "no quarantine")
+}
+
+func TestQuarantineDoubleRelease(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.4")},
+	})
+	ipa.SetQuarantine(time.Hour)
+	ip1, _ := ipa.GetIp()
+	ip2, _ := ipa.GetIp()
+
+	ipa.ReleaseIp(ip1)
+	ipa.ReleaseIp(ip1)
+	ipa.ReleaseRange(ip1, ip2)
+	ipa.ReleaseRange(net.ParseIP("10.0.1.3"), net.ParseIP("10.0.1.4"))
+	assert.Nil(t, ipa.Validate(), "validate")
+	assert.Equal(t, int64(2), ipa.GetSize(), "free addresses untouched")
+
+	var buf bytes.Buffer
+	assert.Nil(t, ipa.Save(&buf), "save")
+	loaded := New()
+	assert.Nil(t, loaded.Load(&buf), "load")
+
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		{net.ParseIP("10.0.1.2"), net.ParseIP("10.0.1.2")},
+	}, ipa.SweepQuarantine(time.Now().Add(2*time.Hour)), "sweep")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.4")},
+	}, ipa.FreeList, "sweep")
+}
+
+func TestQuarantineSaveLoad(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")},
+	})
+	ipa.SetQuarantine(time.Hour)
+	ip1, _ := ipa.GetIp()
+	ip2, _ := ipa.GetIp()
+	ipa.ReleaseIp(ip1)
+	ipa.ReleaseIp(ip2)
+
+	// a release of the other family is ignored even with nothing free
+	// or allocated
+	ipa.ReleaseIp(net.ParseIP("fd00::1"))
+	assert.Nil(t, ipa.Validate(), "valid")
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, ipa.Save(buf), "save")
+	loaded := New()
+	assert.Nil(t, loaded.Load(bytes.NewReader(buf.Bytes())), "load")
+	assert.True(t, loaded.Empty(), "still quarantined")
+	assert.Nil(t, loaded.SweepQuarantine(time.Now()), "sweep early")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.1")},
+		{net.ParseIP("10.0.1.2"), net.ParseIP("10.0.1.2")},
+	}, loaded.SweepQuarantine(time.Now().Add(2*time.Hour)), "sweep")
+
+	for _, state := range []string{
+		`{"free-list":[{"start":"10.0.1.1","end":"10.0.1.2"}],` +
+			`"quarantine":[{"start":"10.0.1.2","end":"10.0.1.2"}]}`,
+		`{"free-list":[{"start":"10.0.1.1","end":"10.0.1.1"}],` +
+			`"quarantine":[{"start":"fd00::1","end":"fd00::1"}]}`,
+		`{"free-list":[],"quarantine":[` +
+			`{"start":"10.0.1.1","end":"10.0.1.4"},` +
+			`{"start":"10.0.1.3","end":"10.0.1.3"}]}`,
+	} {
+		err := New().Load(bytes.NewReader([]byte(state)))
+		_, ok := err.(*CorruptStateError)
+		assert.True(t, ok, state)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+// An address held out of the free list until it expires
+type reservation struct {
+	ip     net.IP
+	expiry time.Time
+}
+
+// Reserve the given free IP address for the given duration, removing
+// it from the free list.  Unless the reservation is confirmed, the
+// address is returned to the free list by SweepExpired once the
+// duration has elapsed.
+func (ipa *IpAlloc) Reserve(ip net.IP, ttl time.Duration) error {
+	ip = ipa.canonicalIp(ip)
+	if ip == nil || !ipa.RemoveIp(ip) {
+		return errors.New("IP address is not available")
+	}
+	if ipa.reservations == nil {
+		ipa.reservations = make(map[string]reservation)
+	}
+	ipa.reservations[string(ip)] = reservation{
+		ip:     ip,
+		expiry: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// Confirm the reservation for the given IP address so that it is no
+// longer subject to expiry.  Returns false if there was no
+// reservation.
+func (ipa *IpAlloc) ConfirmReservation(ip net.IP) bool {
+	ip = ipa.canonicalIp(ip)
+	if _, ok := ipa.reservations[string(ip)]; !ok {
+		return false
+	}
+	delete(ipa.reservations, string(ip))
+	return true
+}
+
+// Return all reservations that expired before now to the free list.
+// Returns the addresses that were returned, in ascending order.
+func (ipa *IpAlloc) SweepExpired(now time.Time) []net.IP {
+	var expired []net.IP
+	for key, r := range ipa.reservations {
+		if r.expiry.Before(now) {
+			expired = append(expired, r.ip)
+			delete(ipa.reservations, key)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return bytes.Compare(expired[i], expired[j]) < 0
+	})
+	for _, ip := range expired {
+		ipa.AddIp(ip)
+	}
+	return expired
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservation(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+	})
+
+	assert.Nil(t, ipa.Reserve(net.ParseIP("10.0.1.5"), time.Millisecond),
+		"reserve")
+	assert.Nil(t, ipa.Reserve(net.ParseIP("10.0.1.6"), time.Millisecond),
+		"reserve adjacent")
+	assert.Nil(t, ipa.Reserve(net.ParseIP("10.0.1.8"), time.Hour),
+		"reserve long")
+	assert.Nil(t, ipa.Reserve(net.ParseIP("10.0.1.9"), time.Millisecond),
+		"reserve confirmed")
+	assert.NotNil(t, ipa.Reserve(net.ParseIP("10.0.1.5"), time.Hour),
+		"reserve twice")
+	assert.NotNil(t, ipa.Reserve(net.ParseIP("10.0.2.1"), time.Hour),
+		"reserve unavailable")
+	assert.True(t, ipa.ConfirmReservation(net.ParseIP("10.0.1.9")),
+		"confirm")
+	assert.False(t, ipa.ConfirmReservation(net.ParseIP("10.0.1.9")),
+		"confirm twice")
+	assert.Equal(t, int64(6), ipa.GetSize(), "reserved size")
+
+	assert.Nil(t, ipa.SweepExpired(time.Now().Add(-time.Minute)),
+		"sweep early")
+	assert.Equal(t, []net.IP{
+		net.ParseIP("10.0.1.5"),
+		net.ParseIP("10.0.1.6"),
+	}, ipa.SweepExpired(time.Now().Add(time.Minute)), "sweep")
+	assert.Equal(t, []IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.7")},
+		{net.ParseIP("10.0.1.10"), net.ParseIP("10.0.1.10")},
+	}, ipa.FreeList, "sweep merged")
+
+	ip, err := ipa.GetIpNear(net.ParseIP("10.0.1.5"))
+	assert.Nil(t, err, "allocate swept")
+	assert.Equal(t, net.ParseIP("10.0.1.5"), ip, "allocate swept")
+}
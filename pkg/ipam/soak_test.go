@@ -0,0 +1,153 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build soak
+// +build soak
+
+package ipam
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Number of randomized operations run by the soak test, and how often
+// the invariants are checked
+const (
+	soakOps        = 2000000
+	soakCheckEvery = 20000
+)
+
+func soakIp(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func soakInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// Addresses taken from the pool by the soak test, with a list for
+// picking one at random
+type soakModel struct {
+	taken   map[uint32]bool
+	singles []uint32
+	chunks  [][]IpRange
+}
+
+func (m *soakModel) take(t *testing.T, ip net.IP) {
+	n := soakInt(ip)
+	if m.taken[n] {
+		t.Fatalf("Address %s allocated twice", ip)
+	}
+	m.taken[n] = true
+}
+
+// Run millions of random allocate, release and chunk operations
+// against a large pool, checking periodically that the free list is
+// valid and fully merged, that no address is handed out twice and
+// that every address is either free or taken.  Run with:
+//
+//	go test -tags soak -run TestSoak ./pkg/ipam
+func TestSoak(t *testing.T) {
+	const first, capacity = 0x0a000000, 1 << 16
+	ipa := New()
+	ipa.AddRange(soakIp(first), soakIp(first+capacity-1))
+	m := &soakModel{taken: make(map[uint32]bool)}
+	r := rand.New(rand.NewSource(42))
+
+	for op := 1; op <= soakOps; op++ {
+		switch p := r.Intn(100); {
+		case p < 45:
+			ip, err := ipa.GetIp()
+			if err != nil {
+				assert.Equal(t, capacity, len(m.taken), "exhausted")
+				break
+			}
+			m.take(t, ip)
+			m.singles = append(m.singles, soakInt(ip))
+		case p < 90:
+			if len(m.singles) == 0 {
+				break
+			}
+			i := r.Intn(len(m.singles))
+			n := m.singles[i]
+			m.singles[i] = m.singles[len(m.singles)-1]
+			m.singles = m.singles[:len(m.singles)-1]
+			delete(m.taken, n)
+			ipa.AddIp(soakIp(n))
+		case p < 95:
+			chunk, err := ipa.GetIpChunk(int64(1 + r.Intn(64)))
+			if err != nil {
+				break
+			}
+			for _, c := range chunk {
+				for n := soakInt(c.Start); n <= soakInt(c.End); n++ {
+					m.take(t, soakIp(n))
+				}
+			}
+			m.chunks = append(m.chunks, chunk)
+		default:
+			if len(m.chunks) == 0 {
+				break
+			}
+			i := r.Intn(len(m.chunks))
+			chunk := m.chunks[i]
+			m.chunks[i] = m.chunks[len(m.chunks)-1]
+			m.chunks = m.chunks[:len(m.chunks)-1]
+			for _, c := range chunk {
+				for n := soakInt(c.Start); n <= soakInt(c.End); n++ {
+					delete(m.taken, n)
+				}
+				ipa.AddRange(c.Start, c.End)
+			}
+		}
+
+		if op%soakCheckEvery == 0 {
+			soakCheck(t, op, ipa, m, capacity)
+		}
+	}
+}
+
+func soakCheck(t *testing.T, op int, ipa *IpAlloc, m *soakModel,
+	capacity int) {
+	if err := ipa.Validate(); err != nil {
+		t.Fatalf("Invalid free list after %d operations: %v", op, err)
+	}
+	if free := ipa.GetSize(); free+int64(len(m.taken)) != int64(capacity) {
+		t.Fatalf("After %d operations %d free and %d taken is not %d",
+			op, free, len(m.taken), capacity)
+	}
+	if allocated := len(ipa.AllocatedIps()); allocated != len(m.singles) {
+		t.Fatalf("After %d operations %d addresses tracked as allocated, "+
+			"expected %d", op, allocated, len(m.singles))
+	}
+	for i, r := range ipa.FreeList {
+		if i > 0 && soakInt(ipa.FreeList[i-1].End)+1 == soakInt(r.Start) {
+			t.Fatalf("After %d operations adjacent free ranges %s and %s "+
+				"are not merged", op, ipa.FreeList[i-1], r)
+		}
+		for n := soakInt(r.Start); n <= soakInt(r.End); n++ {
+			if m.taken[n] {
+				t.Fatalf("After %d operations taken address %s is free",
+					op, soakIp(n))
+			}
+		}
+	}
+}
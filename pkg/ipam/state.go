@@ -0,0 +1,180 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Error returned by Load when the saved state cannot be parsed or does
+// not describe a consistent free list.  Callers can check for it to
+// decide whether to start with a fresh pool or abort.
+type CorruptStateError struct {
+	Err error
+}
+
+func (e *CorruptStateError) Error() string {
+	return "Corrupt IP pool state: " + e.Err.Error()
+}
+
+// Check that a range is a valid range of addresses of the family of
+// ref, if ref is set
+func checkRange(r IpRange, ref net.IP) error {
+	if len(r.Start) == 0 || len(r.End) == 0 {
+		return errors.New("is missing an address")
+	}
+	if (r.Start.To4() == nil) != (r.End.To4() == nil) ||
+		len(r.Start) != len(r.End) ||
+		(r.Start.To16() == nil) {
+		return errors.New("is not a valid range")
+	}
+	if ref != nil && (r.Start.To4() == nil) != (ref.To4() == nil) {
+		return errors.New("has mixed address families")
+	}
+	if bytes.Compare(r.Start, r.End) > 0 {
+		return errors.New("ends before it starts")
+	}
+	return nil
+}
+
+// Check that the free list is consistent: every range is a valid
+// range of addresses of the same family, and the ranges are sorted
+// and do not overlap.  Quarantined ranges must also be valid ranges of
+// that family, and must not overlap each other or the free list.
+func (ipa *IpAlloc) Validate() error {
+	var ref net.IP
+	for i, r := range ipa.FreeList {
+		if err := checkRange(r, ref); err != nil {
+			return fmt.Errorf("Range %d (%s) %s", i, r, err)
+		}
+		if i > 0 && bytes.Compare(ipa.FreeList[i-1].End, r.Start) >= 0 {
+			return fmt.Errorf("Range %d (%s) is out of order or "+
+				"overlaps the previous range", i, r)
+		}
+		ref = r.Start
+	}
+
+	held := NewFromRanges(ipa.FreeList)
+	for i, q := range ipa.quarantined {
+		if err := checkRange(q.r, ref); err != nil {
+			return fmt.Errorf("Quarantined range %d (%s) %s", i, q.r, err)
+		}
+		if !held.Intersect(NewFromRanges([]IpRange{q.r})).Empty() {
+			return fmt.Errorf("Quarantined range %d (%s) overlaps "+
+				"free or quarantined addresses", i, q.r)
+		}
+		held.AddRange(q.r.Start, q.r.End)
+		ref = q.r.Start
+	}
+	return nil
+}
+
+// Saved state of a pool whose allocation policy has state of its own
+// or that has quarantined ranges.  Other pools are saved as just the
+// free list.
+type savedState struct {
+	FreeList   []IpRange         `json:"free-list"`
+	Policy     json.RawMessage   `json:"policy,omitempty"`
+	Quarantine []savedQuarantine `json:"quarantine,omitempty"`
+}
+
+type savedQuarantine struct {
+	IpRange
+	Expiry time.Time `json:"expiry"`
+}
+
+// Write the free list as JSON, for restoring with Load.  The state of
+// a PersistentPolicy and the quarantined ranges are written along with
+// it.
+func (ipa *IpAlloc) Save(w io.Writer) error {
+	policy, ok := ipa.policy.(PersistentPolicy)
+	if !ok && len(ipa.quarantined) == 0 {
+		return json.NewEncoder(w).Encode(ipa.FreeList)
+	}
+	saved := &savedState{FreeList: ipa.FreeList}
+	if ok {
+		data, err := policy.SaveState()
+		if err != nil {
+			return err
+		}
+		saved.Policy = data
+	}
+	for _, q := range ipa.quarantined {
+		saved.Quarantine = append(saved.Quarantine,
+			savedQuarantine{IpRange: q.r, Expiry: q.expiry})
+	}
+	return json.NewEncoder(w).Encode(saved)
+}
+
+// Replace the free list with one written by Save, and restore the
+// state of the pool's PersistentPolicy and the quarantined ranges if
+// they were saved.  Allocated addresses, reservations, configured
+// ranges, range heads and exclusions are cleared as for a new pool,
+// since they described the old free list.  If the state cannot be parsed or fails
+// validation a *CorruptStateError is returned and the pool is left
+// unchanged.
+func (ipa *IpAlloc) Load(r io.Reader) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return &CorruptStateError{Err: err}
+	}
+
+	state := New()
+	saved := &savedState{}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		if err := json.Unmarshal(raw, saved); err != nil {
+			return &CorruptStateError{Err: err}
+		}
+		if saved.FreeList == nil {
+			return &CorruptStateError{Err: errors.New("Missing free list")}
+		}
+		state.FreeList = saved.FreeList
+		for _, q := range saved.Quarantine {
+			state.quarantined = append(state.quarantined,
+				quarantinedRange{r: q.IpRange, expiry: q.Expiry})
+		}
+	} else if err := json.Unmarshal(raw, &state.FreeList); err != nil {
+		return &CorruptStateError{Err: err}
+	}
+	if state.FreeList == nil {
+		state.FreeList = make([]IpRange, 0)
+	}
+	if err := state.Validate(); err != nil {
+		return &CorruptStateError{Err: err}
+	}
+
+	if policy, ok := ipa.policy.(PersistentPolicy); ok &&
+		len(saved.Policy) > 0 {
+		if err := policy.LoadState(saved.Policy); err != nil {
+			return &CorruptStateError{Err: err}
+		}
+	}
+	ipa.FreeList = state.FreeList
+	ipa.allocated = nil
+	ipa.reservations = nil
+	ipa.configured = nil
+	ipa.configuredRanges = nil
+	ipa.headRanges = nil
+	ipa.exclusions = nil
+	ipa.quarantined = state.quarantined
+	ipa.updateStats()
+	return nil
+}
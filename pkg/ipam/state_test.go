@@ -0,0 +1,110 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveLoad(t *testing.T) {
+	ipa := New()
+	ipa.AddRange(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10"))
+	ipa.AddRange(net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.10"))
+	ipa.RemoveIp(net.ParseIP("10.0.1.5"))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, ipa.Save(buf), "save")
+
+	loaded := New()
+	assert.Nil(t, loaded.Load(buf), "load")
+	assert.Equal(t, ipa.GetSize(), loaded.GetSize(), "size")
+	assert.Nil(t, loaded.Validate(), "valid")
+	for i := range ipa.FreeList {
+		assert.True(t, ipa.FreeList[i].Start.Equal(loaded.FreeList[i].Start),
+			fmt.Sprintf("start %d", i))
+		assert.True(t, ipa.FreeList[i].End.Equal(loaded.FreeList[i].End),
+			fmt.Sprintf("end %d", i))
+	}
+}
+
+var corruptStateTests = []struct {
+	state string
+	desc  string
+}{
+	{`[{"start":"10.0.1.1","end":"10.0.1.10"},{"start":"10.0`, "truncated"},
+	{`{"start":"10.0.1.1"}`, "wrong type"},
+	{`[{"start":"10.0.1.1"}]`, "missing end"},
+	{`[{"start":"10.0.1.10","end":"10.0.1.1"}]`, "reversed"},
+	{`[{"start":"10.0.1.1","end":"fd00::1"}]`, "mixed range"},
+	{`[{"start":"10.0.1.1","end":"10.0.1.1"},` +
+		`{"start":"fd00::1","end":"fd00::1"}]`, "mixed families"},
+	{`[{"start":"10.0.2.1","end":"10.0.2.10"},` +
+		`{"start":"10.0.1.1","end":"10.0.1.10"}]`, "unsorted"},
+	{`[{"start":"10.0.1.1","end":"10.0.1.10"},` +
+		`{"start":"10.0.1.5","end":"10.0.1.20"}]`, "overlapping"},
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	for i, ct := range corruptStateTests {
+		ipa := NewFromRanges([]IpRange{
+			{net.ParseIP("10.0.9.1"), net.ParseIP("10.0.9.1")},
+		})
+		err := ipa.Load(strings.NewReader(ct.state))
+		_, ok := err.(*CorruptStateError)
+		assert.True(t, ok, fmt.Sprintf("error %d: %s", i, ct.desc))
+		assert.Equal(t, int64(1), ipa.GetSize(),
+			fmt.Sprintf("unchanged %d: %s", i, ct.desc))
+	}
+
+	ipa := New()
+	assert.Nil(t, ipa.Load(strings.NewReader("[]")), "empty")
+	assert.True(t, ipa.Empty(), "empty")
+}
+
+func TestLoadResets(t *testing.T) {
+	ipa := New()
+	assert.Nil(t, ipa.ApplyConfig([]IpRange{
+		{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.10")},
+		{net.ParseIP("10.0.1.20"), net.ParseIP("10.0.1.30")},
+	}), "config")
+	assert.NotNil(t, ipa.Holes(), "holes")
+	ipa.ReserveRangeHeads(1)
+	ipa.GetIp()
+	ipa.Reserve(net.ParseIP("10.0.1.9"), time.Hour)
+	ipa.SetDynamicExclusions([]net.IP{net.ParseIP("10.0.2.1")})
+	ipa.SetQuarantine(time.Hour)
+	ip, _ := ipa.GetIp()
+	ipa.ReleaseIp(ip)
+
+	assert.Nil(t, ipa.Load(strings.NewReader(
+		`[{"start":"10.0.2.1","end":"10.0.2.4"}]`)), "load")
+	assert.Empty(t, ipa.AllocatedIps(), "allocated")
+	assert.Nil(t, ipa.Holes(), "configured")
+	assert.Empty(t, ipa.SweepExpired(time.Now().Add(2*time.Hour)),
+		"reservations")
+	assert.Empty(t, ipa.SweepQuarantine(time.Now().Add(2*time.Hour)),
+		"quarantine")
+	ip, err := ipa.GetIp()
+	assert.Nil(t, err, "get")
+	assert.Equal(t, "10.0.2.1", ip.String(), "exclusions")
+	assert.Equal(t, int64(3), ipa.GetSize(), "size")
+}
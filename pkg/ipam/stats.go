@@ -0,0 +1,97 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"expvar"
+)
+
+// Pool statistics published as an expvar map
+type allocStats struct {
+	free        expvar.Int
+	capacity    expvar.Int
+	fragments   expvar.Int
+	allocations expvar.Int
+	releases    expvar.Int
+
+	// free addresses as of the last update, and addresses removed
+	// from the free list that have not yet been returned
+	lastFree    int64
+	outstanding int64
+}
+
+// Publish free, capacity, fragments, allocations and releases for the
+// pool as an expvar map with the given name, reusing an existing map.
+// Until this is called the pool does no statistics work.
+func (ipa *IpAlloc) PublishStats(name string) {
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+	}
+
+	stats := &allocStats{}
+	vars.Set("free", &stats.free)
+	vars.Set("capacity", &stats.capacity)
+	vars.Set("fragments", &stats.fragments)
+	vars.Set("allocations", &stats.allocations)
+	vars.Set("releases", &stats.releases)
+
+	stats.lastFree = ipa.GetSize()
+	ipa.stats = stats
+	ipa.updateStats()
+}
+
+// Zero the cumulative allocation and release counters, for example at
+// the start of a reporting window.  The pool and the free, capacity
+// and fragment statistics are unchanged.  Does nothing if statistics
+// have not been published.
+func (ipa *IpAlloc) ResetStats() {
+	if ipa.stats == nil {
+		return
+	}
+	ipa.stats.allocations.Set(0)
+	ipa.stats.releases.Set(0)
+}
+
+// Update the published statistics after a change to the free list,
+// or return immediately if none have been published.
+// Addresses leaving the free list count as allocations, and addresses
+// added while there are outstanding allocations count as releases;
+// anything beyond that grows the capacity of the pool.
+func (ipa *IpAlloc) updateStats() {
+	stats := ipa.stats
+	if stats == nil {
+		return
+	}
+
+	free := ipa.GetSize()
+	delta := free - stats.lastFree
+	if delta < 0 {
+		stats.allocations.Add(-delta)
+		stats.outstanding -= delta
+	} else if delta > 0 {
+		released := delta
+		if released > stats.outstanding {
+			released = stats.outstanding
+		}
+		stats.releases.Add(released)
+		stats.outstanding -= released
+	}
+	stats.lastFree = free
+
+	stats.free.Set(free)
+	stats.capacity.Set(free + stats.outstanding)
+	stats.fragments.Set(int64(len(ipa.FreeList)))
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Cisco Systems, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"expvar"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishStats(t *testing.T) {
+	ipa := New()
+	ipa.PublishStats("ipam-test-pool")
+	ipa.AddRange(net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.9"))
+	ipa.AddRange(net.ParseIP("10.0.2.0"), net.ParseIP("10.0.2.9"))
+
+	ip, err := ipa.GetIp()
+	assert.Nil(t, err, "get")
+	_, err = ipa.GetIpChunk(4)
+	assert.Nil(t, err, "get chunk")
+	ipa.RemoveIp(net.ParseIP("10.0.2.5"))
+	ipa.AddIp(ip)
+	ipa.AddIp(ip)
+
+	vars, ok := expvar.Get("ipam-test-pool").(*expvar.Map)
+	if !assert.True(t, ok, "published") {
+		return
+	}
+	expected := map[string]string{
+		"free":        "15",
+		"capacity":    "20",
+		"fragments":   "4",
+		"allocations": "6",
+		"releases":    "1",
+	}
+	for k, v := range expected {
+		if assert.NotNil(t, vars.Get(k), k) {
+			assert.Equal(t, v, vars.Get(k).String(), k)
+		}
+	}
+
+	// publishing another pool under the same name replaces the values
+	other := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.3.0"), net.ParseIP("10.0.3.3")},
+	})
+	other.PublishStats("ipam-test-pool")
+	assert.Equal(t, "4", vars.Get("free").String(), "republish free")
+	assert.Equal(t, "0", vars.Get("allocations").String(),
+		"republish allocations")
+}
+
+func TestResetStats(t *testing.T) {
+	ipa := NewFromRanges([]IpRange{
+		{net.ParseIP("10.0.1.0"), net.ParseIP("10.0.1.9")},
+	})
+	ipa.ResetStats()
+	ipa.PublishStats("ipam-test-reset")
+
+	first, _ := ipa.GetIp()
+	second, _ := ipa.GetIp()
+	ipa.AddIp(first)
+	ipa.ResetStats()
+
+	ipa.GetIp()
+	ipa.AddIp(second)
+
+	vars := expvar.Get("ipam-test-reset").(*expvar.Map)
+	expected := map[string]string{
+		"free":        "9",
+		"capacity":    "10",
+		"fragments":   "1",
+		"allocations": "1",
+		"releases":    "1",
+	}
+	for k, v := range expected {
+		assert.Equal(t, v, vars.Get(k).String(), k)
+	}
+}
@@ -63,3 +63,31 @@ const CompEgAnnotation = "opflex.cisco.com/computed-endpoint-group"
 
 // Computed security groups for pod
 const CompSgAnnotation = "opflex.cisco.com/computed-security-group"
+
+// Override the service MAC used for the external service mapping
+const ServiceMacAnnotation = "opflex.cisco.com/service-mac"
+
+// Override the interface IP used for the external service mapping
+const ServiceIfaceIpAnnotation = "opflex.cisco.com/service-interface-ip"
+
+// Override the uplink interface used for the external service mapping
+const ServiceIfaceNameAnnotation = "opflex.cisco.com/service-interface-name"
+
+// Override the service VLAN used for the external service mapping
+const ServiceIfaceVlanAnnotation = "opflex.cisco.com/service-interface-vlan"
+
+// Enable or disable connection tracking for service mappings.  Either
+// a boolean applied to all mappings or a comma-separated list of
+// protocol=boolean pairs, e.g. "tcp=true,udp=false"
+const ServiceConntrackAnnotation = "opflex.cisco.com/service-conntrack"
+
+// Request that the datapath synchronize connection tracking state for
+// the service mappings, e.g. between the members of an HA pair
+const ServiceConntrackStateSyncAnnotation = "opflex.cisco.com/service-conntrack-state-sync"
+
+// Request that the datapath preserve the client source IP for traffic
+// to the service
+const ServicePreserveSourceIpAnnotation = "opflex.cisco.com/preserve-source-ip"
+
+// Raise the log level for log messages about the service, e.g. "debug"
+const ServiceLogLevelAnnotation = "opflex.cisco.com/log-level"